@@ -0,0 +1,45 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/markkurossi/mpc64/prg"
+)
+
+func main() {
+	auto := flag.Bool("auto", false, "parse programs without BASIC stub")
+	flag.Parse()
+
+	if len(flag.Args()) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: prgdiff [options] a.prg b.prg\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	opts := prg.ParseOptions{
+		Auto: *auto,
+	}
+	a, err := prg.LoadWith(flag.Arg(0), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := prg.LoadWith(flag.Arg(1), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	diff, err := prg.Compare(a, b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := diff.Print(os.Stdout, flag.Arg(0), flag.Arg(1)); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,171 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/markkurossi/mpc64/prg"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: prgproj [options] command project [args...]
+
+commands:
+  new project file.prg        create project from PRG file
+  label project addr [name]   set or remove label
+  comment project addr [text] set or remove comment
+  entry project addr          add code entry point
+  segment project addr size type
+                              force segment type (none removes)
+  list project                print disassembly
+  json project                print analysis in JSON
+  html project                print HTML report
+
+options:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	auto := flag.Bool("auto", false, "parse programs without BASIC stub")
+	emulate := flag.Uint64("emulate", 0, "emulate program for cycles")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+	}
+	cmd, file, args := args[0], args[1], args[2:]
+
+	if cmd == "new" {
+		if len(args) != 1 {
+			usage()
+		}
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		proj, err := prg.NewProject(args[0], data, prg.ParseOptions{
+			Auto:    *auto,
+			Emulate: *emulate,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := proj.Save(file); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	proj, err := prg.OpenProject(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var modified bool
+
+	switch cmd {
+	case "label", "comment":
+		if len(args) < 1 {
+			usage()
+		}
+		addr, err := parseAddr(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		text := strings.Join(args[1:], " ")
+		if cmd == "label" {
+			proj.SetLabel(addr, text)
+		} else {
+			proj.SetComment(addr, text)
+		}
+		modified = true
+
+	case "entry":
+		if len(args) != 1 {
+			usage()
+		}
+		addr, err := parseAddr(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := proj.AddEntry(addr); err != nil {
+			log.Fatal(err)
+		}
+		modified = true
+
+	case "segment":
+		if len(args) != 3 {
+			usage()
+		}
+		addr, err := parseAddr(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		size, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		var t prg.SegType
+		if err := t.UnmarshalText([]byte(args[2])); err != nil {
+			log.Fatal(err)
+		}
+		if err := proj.SetSegment(addr, size, t); err != nil {
+			log.Fatal(err)
+		}
+		modified = true
+
+	case "list", "json", "html":
+		p, err := proj.Prg()
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch cmd {
+		case "list":
+			err = p.Print()
+		case "json":
+			var a *prg.Analysis
+			a, err = p.Analysis()
+			if err == nil {
+				err = a.JSON(os.Stdout)
+			}
+		case "html":
+			err = p.HTML(os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	default:
+		usage()
+	}
+
+	if modified {
+		if err := proj.Save(file); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// parseAddr parses the hexadecimal address with an optional $ or 0x
+// prefix.
+func parseAddr(s string) (uint16, error) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "$"), "0x")
+	v, err := strconv.ParseUint(s, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address: %s", s)
+	}
+	return uint16(v), nil
+}
@@ -0,0 +1,559 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package mos6510
+
+import (
+	"fmt"
+)
+
+// Status register flags.
+const (
+	FlagC byte = 1 << iota
+	FlagZ
+	FlagI
+	FlagD
+	FlagB
+	FlagU
+	FlagV
+	FlagN
+)
+
+// Interrupt vectors.
+const (
+	VectorNMI   uint16 = 0xfffa
+	VectorReset uint16 = 0xfffc
+	VectorIRQ   uint16 = 0xfffe
+)
+
+// Memory defines the memory interface of the CPU.
+type Memory interface {
+	Read(addr uint16) byte
+	Write(addr uint16, val byte)
+}
+
+// RAM implements 64kB of flat memory.
+type RAM [0x10000]byte
+
+// Read implements Memory.Read.
+func (ram *RAM) Read(addr uint16) byte {
+	return ram[addr]
+}
+
+// Write implements Memory.Write.
+func (ram *RAM) Write(addr uint16, val byte) {
+	ram[addr] = val
+}
+
+// HaltError is returned when the CPU executes a KIL instruction.
+type HaltError struct {
+	PC uint16
+	Op Opcode
+}
+
+func (e *HaltError) Error() string {
+	return fmt.Sprintf("%04X: %v: CPU halted", e.PC, e.Op)
+}
+
+// CPU implements the 6510 CPU core. The core executes all
+// documented instructions and the stable undocumented instructions.
+// The unstable undocumented instructions are implemented with their
+// common behavior.
+type CPU struct {
+	A      byte
+	X      byte
+	Y      byte
+	SP     byte
+	P      byte
+	PC     uint16
+	Cycles uint64
+	Mem    Memory
+}
+
+// NewCPU creates a new CPU with the memory.
+func NewCPU(mem Memory) *CPU {
+	return &CPU{
+		SP:  0xff,
+		P:   FlagU | FlagI,
+		Mem: mem,
+	}
+}
+
+// Reset resets the CPU and loads the program counter from the reset
+// vector.
+func (cpu *CPU) Reset() {
+	cpu.SP = 0xfd
+	cpu.P = FlagU | FlagI
+	cpu.PC = cpu.read16(VectorReset)
+}
+
+// IRQ triggers an interrupt request if interrupts are enabled.
+func (cpu *CPU) IRQ() {
+	if cpu.P&FlagI == 0 {
+		cpu.interrupt(VectorIRQ, false)
+		cpu.Cycles += 7
+	}
+}
+
+// NMI triggers a non-maskable interrupt.
+func (cpu *CPU) NMI() {
+	cpu.interrupt(VectorNMI, false)
+	cpu.Cycles += 7
+}
+
+func (cpu *CPU) interrupt(vector uint16, brk bool) {
+	cpu.push16(cpu.PC)
+	p := cpu.P | FlagU
+	if brk {
+		p |= FlagB
+	} else {
+		p &^= FlagB
+	}
+	cpu.Push(p)
+	cpu.P |= FlagI
+	cpu.PC = cpu.read16(vector)
+}
+
+// Flag tests if the status flag is set.
+func (cpu *CPU) Flag(flag byte) bool {
+	return cpu.P&flag != 0
+}
+
+// SetFlag sets or clears the status flag.
+func (cpu *CPU) SetFlag(flag byte, set bool) {
+	if set {
+		cpu.P |= flag
+	} else {
+		cpu.P &^= flag
+	}
+}
+
+func (cpu *CPU) setNZ(val byte) {
+	cpu.SetFlag(FlagZ, val == 0)
+	cpu.SetFlag(FlagN, val&0x80 != 0)
+}
+
+func (cpu *CPU) read(addr uint16) byte {
+	return cpu.Mem.Read(addr)
+}
+
+func (cpu *CPU) read16(addr uint16) uint16 {
+	return uint16(cpu.read(addr)) | uint16(cpu.read(addr+1))<<8
+}
+
+// read16zp reads a word from the zero page, wrapping around inside the
+// zero page.
+func (cpu *CPU) read16zp(addr byte) uint16 {
+	return uint16(cpu.read(uint16(addr))) | uint16(cpu.read(uint16(addr+1)))<<8
+}
+
+func (cpu *CPU) write(addr uint16, val byte) {
+	cpu.Mem.Write(addr, val)
+}
+
+// Push pushes the value into the stack.
+func (cpu *CPU) Push(val byte) {
+	cpu.write(0x0100|uint16(cpu.SP), val)
+	cpu.SP--
+}
+
+func (cpu *CPU) push16(val uint16) {
+	cpu.Push(byte(val >> 8))
+	cpu.Push(byte(val))
+}
+
+// Pull pulls a value from the stack.
+func (cpu *CPU) Pull() byte {
+	cpu.SP++
+	return cpu.read(0x0100 | uint16(cpu.SP))
+}
+
+func (cpu *CPU) pull16() uint16 {
+	lo := cpu.Pull()
+	hi := cpu.Pull()
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+// Step executes one instruction and returns the number of cycles it
+// took. The function returns a HaltError if the instruction is KIL.
+func (cpu *CPU) Step() (int, error) {
+	pc := cpu.PC
+	op := Opcode(cpu.read(pc))
+	instr := &Instructions[op]
+	cpu.PC += uint16(instr.Size())
+	cycles := instr.Cycles
+
+	var addr uint16
+	var crossed bool
+
+	switch instr.Addr {
+	case AddrImp:
+	case AddrIMM:
+		addr = pc + 1
+	case AddrZP:
+		addr = uint16(cpu.read(pc + 1))
+	case AddrZPX:
+		addr = uint16(cpu.read(pc+1) + cpu.X)
+	case AddrZPY:
+		addr = uint16(cpu.read(pc+1) + cpu.Y)
+	case AddrABS:
+		addr = cpu.read16(pc + 1)
+	case AddrABX:
+		base := cpu.read16(pc + 1)
+		addr = base + uint16(cpu.X)
+		crossed = base&0xff00 != addr&0xff00
+	case AddrABY:
+		base := cpu.read16(pc + 1)
+		addr = base + uint16(cpu.Y)
+		crossed = base&0xff00 != addr&0xff00
+	case AddrIND:
+		// The vector does not cross a page boundary.
+		ptr := cpu.read16(pc + 1)
+		addr = uint16(cpu.read(ptr)) |
+			uint16(cpu.read(ptr&0xff00|(ptr+1)&0x00ff))<<8
+	case AddrIZX:
+		addr = cpu.read16zp(cpu.read(pc+1) + cpu.X)
+	case AddrIZY:
+		base := cpu.read16zp(cpu.read(pc + 1))
+		addr = base + uint16(cpu.Y)
+		crossed = base&0xff00 != addr&0xff00
+	case AddrREL:
+		addr = cpu.PC + uint16(int8(cpu.read(pc+1)))
+	}
+	if crossed && instr.PageBoundary {
+		cycles++
+	}
+
+	switch instr.Name {
+	case "KIL":
+		cpu.PC = pc
+		return cycles, &HaltError{
+			PC: pc,
+			Op: op,
+		}
+
+	case "LDA":
+		cpu.A = cpu.read(addr)
+		cpu.setNZ(cpu.A)
+	case "LDX":
+		cpu.X = cpu.read(addr)
+		cpu.setNZ(cpu.X)
+	case "LDY":
+		cpu.Y = cpu.read(addr)
+		cpu.setNZ(cpu.Y)
+	case "LAX":
+		cpu.A = cpu.read(addr)
+		cpu.X = cpu.A
+		cpu.setNZ(cpu.A)
+	case "LAS":
+		val := cpu.read(addr) & cpu.SP
+		cpu.A, cpu.X, cpu.SP = val, val, val
+		cpu.setNZ(val)
+
+	case "STA":
+		cpu.write(addr, cpu.A)
+	case "STX":
+		cpu.write(addr, cpu.X)
+	case "STY":
+		cpu.write(addr, cpu.Y)
+	case "SAX":
+		cpu.write(addr, cpu.A&cpu.X)
+	case "AHX":
+		cpu.write(addr, cpu.A&cpu.X&(byte(addr>>8)+1))
+	case "SHX":
+		cpu.write(addr, cpu.X&(byte(addr>>8)+1))
+	case "SHY":
+		cpu.write(addr, cpu.Y&(byte(addr>>8)+1))
+	case "TAS":
+		cpu.SP = cpu.A & cpu.X
+		cpu.write(addr, cpu.SP&(byte(addr>>8)+1))
+
+	case "TAX":
+		cpu.X = cpu.A
+		cpu.setNZ(cpu.X)
+	case "TAY":
+		cpu.Y = cpu.A
+		cpu.setNZ(cpu.Y)
+	case "TXA":
+		cpu.A = cpu.X
+		cpu.setNZ(cpu.A)
+	case "TYA":
+		cpu.A = cpu.Y
+		cpu.setNZ(cpu.A)
+	case "TSX":
+		cpu.X = cpu.SP
+		cpu.setNZ(cpu.X)
+	case "TXS":
+		cpu.SP = cpu.X
+
+	case "PHA":
+		cpu.Push(cpu.A)
+	case "PHP":
+		cpu.Push(cpu.P | FlagB | FlagU)
+	case "PLA":
+		cpu.A = cpu.Pull()
+		cpu.setNZ(cpu.A)
+	case "PLP":
+		cpu.P = cpu.Pull()&^FlagB | FlagU
+
+	case "AND":
+		cpu.A &= cpu.read(addr)
+		cpu.setNZ(cpu.A)
+	case "ORA":
+		cpu.A |= cpu.read(addr)
+		cpu.setNZ(cpu.A)
+	case "EOR":
+		cpu.A ^= cpu.read(addr)
+		cpu.setNZ(cpu.A)
+	case "ADC":
+		cpu.adc(cpu.read(addr))
+	case "SBC":
+		cpu.sbc(cpu.read(addr))
+	case "CMP":
+		cpu.compare(cpu.A, cpu.read(addr))
+	case "CPX":
+		cpu.compare(cpu.X, cpu.read(addr))
+	case "CPY":
+		cpu.compare(cpu.Y, cpu.read(addr))
+	case "BIT":
+		val := cpu.read(addr)
+		cpu.SetFlag(FlagZ, cpu.A&val == 0)
+		cpu.SetFlag(FlagV, val&0x40 != 0)
+		cpu.SetFlag(FlagN, val&0x80 != 0)
+
+	case "INC":
+		val := cpu.read(addr) + 1
+		cpu.write(addr, val)
+		cpu.setNZ(val)
+	case "DEC":
+		val := cpu.read(addr) - 1
+		cpu.write(addr, val)
+		cpu.setNZ(val)
+	case "INX":
+		cpu.X++
+		cpu.setNZ(cpu.X)
+	case "INY":
+		cpu.Y++
+		cpu.setNZ(cpu.Y)
+	case "DEX":
+		cpu.X--
+		cpu.setNZ(cpu.X)
+	case "DEY":
+		cpu.Y--
+		cpu.setNZ(cpu.Y)
+
+	case "ASL", "LSR", "ROL", "ROR":
+		if instr.Addr == AddrImp {
+			cpu.A = cpu.shift(instr.Name, cpu.A)
+		} else {
+			cpu.write(addr, cpu.shift(instr.Name, cpu.read(addr)))
+		}
+
+	case "SLO":
+		val := cpu.shift("ASL", cpu.read(addr))
+		cpu.write(addr, val)
+		cpu.A |= val
+		cpu.setNZ(cpu.A)
+	case "RLA":
+		val := cpu.shift("ROL", cpu.read(addr))
+		cpu.write(addr, val)
+		cpu.A &= val
+		cpu.setNZ(cpu.A)
+	case "SRE":
+		val := cpu.shift("LSR", cpu.read(addr))
+		cpu.write(addr, val)
+		cpu.A ^= val
+		cpu.setNZ(cpu.A)
+	case "RRA":
+		val := cpu.shift("ROR", cpu.read(addr))
+		cpu.write(addr, val)
+		cpu.adc(val)
+	case "DCP":
+		val := cpu.read(addr) - 1
+		cpu.write(addr, val)
+		cpu.compare(cpu.A, val)
+	case "ISC":
+		val := cpu.read(addr) + 1
+		cpu.write(addr, val)
+		cpu.sbc(val)
+
+	case "ANC":
+		cpu.A &= cpu.read(addr)
+		cpu.setNZ(cpu.A)
+		cpu.SetFlag(FlagC, cpu.A&0x80 != 0)
+	case "ALR":
+		cpu.A = cpu.shift("LSR", cpu.A&cpu.read(addr))
+	case "ARR":
+		cpu.A = cpu.shift("ROR", cpu.A&cpu.read(addr))
+		cpu.SetFlag(FlagC, cpu.A&0x40 != 0)
+		cpu.SetFlag(FlagV, (cpu.A>>6^cpu.A>>5)&1 != 0)
+	case "AXS":
+		val := cpu.read(addr)
+		ax := cpu.A & cpu.X
+		cpu.SetFlag(FlagC, ax >= val)
+		cpu.X = ax - val
+		cpu.setNZ(cpu.X)
+	case "XAA":
+		cpu.A = cpu.X & cpu.read(addr)
+		cpu.setNZ(cpu.A)
+
+	case "BPL":
+		cycles += cpu.branch(!cpu.Flag(FlagN), addr)
+	case "BMI":
+		cycles += cpu.branch(cpu.Flag(FlagN), addr)
+	case "BVC":
+		cycles += cpu.branch(!cpu.Flag(FlagV), addr)
+	case "BVS":
+		cycles += cpu.branch(cpu.Flag(FlagV), addr)
+	case "BCC":
+		cycles += cpu.branch(!cpu.Flag(FlagC), addr)
+	case "BCS":
+		cycles += cpu.branch(cpu.Flag(FlagC), addr)
+	case "BNE":
+		cycles += cpu.branch(!cpu.Flag(FlagZ), addr)
+	case "BEQ":
+		cycles += cpu.branch(cpu.Flag(FlagZ), addr)
+
+	case "JMP":
+		cpu.PC = addr
+	case "JSR":
+		cpu.push16(cpu.PC - 1)
+		cpu.PC = addr
+	case "RTS":
+		cpu.PC = cpu.pull16() + 1
+	case "RTI":
+		cpu.P = cpu.Pull()&^FlagB | FlagU
+		cpu.PC = cpu.pull16()
+	case "BRK":
+		cpu.PC++
+		cpu.interrupt(VectorIRQ, true)
+
+	case "CLC":
+		cpu.SetFlag(FlagC, false)
+	case "SEC":
+		cpu.SetFlag(FlagC, true)
+	case "CLI":
+		cpu.SetFlag(FlagI, false)
+	case "SEI":
+		cpu.SetFlag(FlagI, true)
+	case "CLV":
+		cpu.SetFlag(FlagV, false)
+	case "CLD":
+		cpu.SetFlag(FlagD, false)
+	case "SED":
+		cpu.SetFlag(FlagD, true)
+
+	case "NOP":
+
+	default:
+		return 0, fmt.Errorf("%04X: %v: not implemented", pc, op)
+	}
+	cpu.Cycles += uint64(cycles)
+
+	return cycles, nil
+}
+
+func (cpu *CPU) branch(taken bool, addr uint16) int {
+	if !taken {
+		return 0
+	}
+	cycles := 1
+	if cpu.PC&0xff00 != addr&0xff00 {
+		cycles++
+	}
+	cpu.PC = addr
+	return cycles
+}
+
+func (cpu *CPU) compare(reg, val byte) {
+	cpu.SetFlag(FlagC, reg >= val)
+	cpu.setNZ(reg - val)
+}
+
+func (cpu *CPU) shift(name string, val byte) byte {
+	var carry byte
+	if cpu.Flag(FlagC) {
+		carry = 1
+	}
+	var result byte
+	switch name {
+	case "ASL":
+		cpu.SetFlag(FlagC, val&0x80 != 0)
+		result = val << 1
+	case "LSR":
+		cpu.SetFlag(FlagC, val&0x01 != 0)
+		result = val >> 1
+	case "ROL":
+		cpu.SetFlag(FlagC, val&0x80 != 0)
+		result = val<<1 | carry
+	case "ROR":
+		cpu.SetFlag(FlagC, val&0x01 != 0)
+		result = val>>1 | carry<<7
+	}
+	cpu.setNZ(result)
+	return result
+}
+
+func (cpu *CPU) adc(val byte) {
+	var carry int
+	if cpu.Flag(FlagC) {
+		carry = 1
+	}
+	a := int(cpu.A)
+	bin := a + int(val) + carry
+	if !cpu.Flag(FlagD) {
+		cpu.SetFlag(FlagC, bin > 0xff)
+		cpu.SetFlag(FlagV, (a^bin)&(int(val)^bin)&0x80 != 0)
+		cpu.A = byte(bin)
+		cpu.setNZ(cpu.A)
+		return
+	}
+
+	// Decimal mode: Z is set from the binary result, N and V from
+	// the intermediate result.
+	cpu.SetFlag(FlagZ, byte(bin) == 0)
+	lo := a&0x0f + int(val)&0x0f + carry
+	if lo > 0x09 {
+		lo += 0x06
+	}
+	hi := a>>4 + int(val)>>4
+	if lo > 0x0f {
+		hi++
+	}
+	cpu.SetFlag(FlagN, hi&0x08 != 0)
+	cpu.SetFlag(FlagV, (a^hi<<4)&^(a^int(val))&0x80 != 0)
+	if hi > 0x09 {
+		hi += 0x06
+	}
+	cpu.SetFlag(FlagC, hi > 0x0f)
+	cpu.A = byte(hi<<4 | lo&0x0f)
+}
+
+func (cpu *CPU) sbc(val byte) {
+	var borrow int
+	if !cpu.Flag(FlagC) {
+		borrow = 1
+	}
+	a := int(cpu.A)
+	bin := a - int(val) - borrow
+	cpu.SetFlag(FlagC, bin >= 0)
+	cpu.SetFlag(FlagV, (a^int(val))&(a^bin)&0x80 != 0)
+	cpu.setNZ(byte(bin))
+	if !cpu.Flag(FlagD) {
+		cpu.A = byte(bin)
+		return
+	}
+	lo := a&0x0f - int(val)&0x0f - borrow
+	hi := a>>4 - int(val)>>4
+	if lo < 0 {
+		lo -= 6
+		hi--
+	}
+	if hi < 0 {
+		hi -= 6
+	}
+	cpu.A = byte(hi<<4 | lo&0x0f)
+}
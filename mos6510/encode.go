@@ -0,0 +1,70 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package mos6510
+
+import (
+	"fmt"
+	"strings"
+)
+
+type encodeKey struct {
+	name string
+	mode AddrMode
+}
+
+// encodings map instruction names and addressing modes to opcodes.
+// For ambiguous instructions, the table holds the documented opcode
+// or the lowest undocumented opcode.
+var encodings = make(map[encodeKey]Opcode)
+
+func init() {
+	for idx := len(Instructions) - 1; idx >= 0; idx-- {
+		instr := Instructions[idx]
+		encodings[encodeKey{instr.Name, instr.Addr}] = Opcode(idx)
+	}
+	encodings[encodeKey{"NOP", AddrImp}] = OpNOP0xEA
+	encodings[encodeKey{"SBC", AddrIMM}] = OpSBCimm0xE9
+}
+
+// Lookup returns the opcode of the instruction with the name and
+// addressing mode.
+func Lookup(name string, mode AddrMode) (Opcode, error) {
+	op, ok := encodings[encodeKey{strings.ToUpper(name), mode}]
+	if !ok {
+		return 0, fmt.Errorf("unknown instruction %s %v", name, mode)
+	}
+	return op, nil
+}
+
+// Encode encodes the opcode and its argument. For relative
+// addressing, the argument is the signed branch offset.
+func Encode(op Opcode, arg uint16) ([]byte, error) {
+	switch op.ArgSize() {
+	case 0:
+		if arg != 0 {
+			return nil, fmt.Errorf("%v: unexpected argument $%X", op, arg)
+		}
+		return []byte{byte(op)}, nil
+	case 1:
+		if arg > 0xff {
+			return nil, fmt.Errorf("%v: argument $%X out of range", op, arg)
+		}
+		return []byte{byte(op), byte(arg)}, nil
+	default:
+		return []byte{byte(op), byte(arg), byte(arg >> 8)}, nil
+	}
+}
+
+// Assemble encodes the instruction with the name, addressing mode,
+// and argument.
+func Assemble(name string, mode AddrMode, arg uint16) ([]byte, error) {
+	op, err := Lookup(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(op, arg)
+}
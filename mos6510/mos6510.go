@@ -53,6 +53,16 @@ func (op Opcode) Jump() bool {
 	return Instructions[op].Jump
 }
 
+// Read describes if the opcode reads its memory operand.
+func (op Opcode) Read() bool {
+	return Instructions[op].Read
+}
+
+// Write describes if the opcode writes memory.
+func (op Opcode) Write() bool {
+	return Instructions[op].Write
+}
+
 // BlockEnd describes if the opcode terminates a basic block i.e. the
 // program will not advance to the next instruction.
 func (op Opcode) BlockEnd() bool {
@@ -158,6 +168,8 @@ type Instr struct {
 	Cycles       int
 	PageBoundary bool
 	Data         bool
+	Read         bool
+	Write        bool
 	Jump         bool
 	BlockEnd     bool
 }
@@ -225,6 +237,41 @@ var dataInstructions = map[string]bool{
 	"STY": true,
 }
 
+var writeInstructions = map[string]bool{
+	"STA": true,
+	"STX": true,
+	"STY": true,
+	"INC": true,
+	"DEC": true,
+	"ASL": true,
+	"ROL": true,
+	"LSR": true,
+	"ROR": true,
+	"SLO": true,
+	"RLA": true,
+	"SRE": true,
+	"RRA": true,
+	"SAX": true,
+	"DCP": true,
+	"ISC": true,
+	"AHX": true,
+	"SHX": true,
+	"SHY": true,
+	"TAS": true,
+}
+
+// storeInstructions write memory without reading it.
+var storeInstructions = map[string]bool{
+	"STA": true,
+	"STX": true,
+	"STY": true,
+	"SAX": true,
+	"AHX": true,
+	"SHX": true,
+	"SHY": true,
+	"TAS": true,
+}
+
 var jumpInstructions = map[string]bool{
 	"BPL": true,
 	"BMI": true,
@@ -250,9 +297,19 @@ func init() {
 		if dataInstructions[instr.Name] {
 			Instructions[idx].Data = true
 		}
+		if writeInstructions[instr.Name] && instr.Addr != AddrImp {
+			Instructions[idx].Write = true
+		}
 		if jumpInstructions[instr.Name] {
 			Instructions[idx].Jump = true
 		}
+		switch instr.Addr {
+		case AddrImp, AddrIMM, AddrREL:
+		default:
+			if !Instructions[idx].Jump && !storeInstructions[instr.Name] {
+				Instructions[idx].Read = true
+			}
+		}
 		if blockEndInstuctions[instr.Name] {
 			Instructions[idx].BlockEnd = true
 		}
@@ -76,3 +76,95 @@ func testCommandSet(t *testing.T, names []string) {
 	}
 	tab.Print(os.Stdout)
 }
+
+func runCPU(t *testing.T, code []byte, steps int) *CPU {
+	var ram RAM
+	copy(ram[0xc000:], code)
+	ram[VectorReset] = 0x00
+	ram[VectorReset+1] = 0xc0
+
+	cpu := NewCPU(&ram)
+	cpu.Reset()
+	for i := 0; i < steps; i++ {
+		if _, err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cpu
+}
+
+func TestCPU(t *testing.T) {
+	// Sum 1..10 into A with a counted loop and a subroutine.
+	cpu := runCPU(t, []byte{
+		0xa9, 0x00, // C000: LDA #$00
+		0xa2, 0x0a, // C002: LDX #$0A
+		0x20, 0x0b, 0xc0, // C004: JSR $C00B
+		0xca,       // C007: DEX
+		0xd0, 0xfa, // C008: BNE $C004
+		0x02,       // C00A: KIL
+		0x86, 0xfb, // C00B: STX $FB
+		0x18,       // C00D: CLC
+		0x65, 0xfb, // C00E: ADC $FB
+		0x60, // C010: RTS
+	}, 2+10*7)
+	if cpu.A != 55 || cpu.X != 0 || cpu.PC != 0xc00a || cpu.SP != 0xfd {
+		t.Errorf("invalid state: A=%d X=%d PC=%04X SP=%02X",
+			cpu.A, cpu.X, cpu.PC, cpu.SP)
+	}
+	if _, err := cpu.Step(); err == nil {
+		t.Errorf("KIL did not halt")
+	}
+}
+
+func TestCPUDecimal(t *testing.T) {
+	cpu := runCPU(t, []byte{
+		0xf8,       // SED
+		0x18,       // CLC
+		0xa9, 0x19, // LDA #$19
+		0x69, 0x28, // ADC #$28
+		0x85, 0x02, // STA $02
+		0x38,       // SEC
+		0xa9, 0x42, // LDA #$42
+		0xe9, 0x13, // SBC #$13
+	}, 8)
+	if cpu.Mem.Read(0x02) != 0x47 {
+		t.Errorf("ADC: got $%02X, expected $47", cpu.Mem.Read(0x02))
+	}
+	if cpu.A != 0x29 || !cpu.Flag(FlagC) {
+		t.Errorf("SBC: got $%02X C=%v, expected $29 C=true",
+			cpu.A, cpu.Flag(FlagC))
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode AddrMode
+		arg  uint16
+		data []byte
+	}{
+		{"NOP", AddrImp, 0, []byte{0xea}},
+		{"lda", AddrIMM, 0x12, []byte{0xa9, 0x12}},
+		{"SBC", AddrIMM, 0x01, []byte{0xe9, 0x01}},
+		{"JMP", AddrABS, 0xc000, []byte{0x4c, 0x00, 0xc0}},
+		{"BNE", AddrREL, 0xfe, []byte{0xd0, 0xfe}},
+		{"LAX", AddrZP, 0x02, []byte{0xa7, 0x02}},
+	}
+	for _, test := range tests {
+		data, err := Assemble(test.name, test.mode, test.arg)
+		if err != nil {
+			t.Errorf("%s %v: %v", test.name, test.mode, err)
+			continue
+		}
+		if string(data) != string(test.data) {
+			t.Errorf("%s %v: got % X, expected % X", test.name, test.mode,
+				data, test.data)
+		}
+	}
+	if _, err := Assemble("JSR", AddrIMM, 0); err == nil {
+		t.Errorf("Assemble accepted invalid addressing mode")
+	}
+	if _, err := Encode(OpLDAimm, 0x100); err == nil {
+		t.Errorf("Encode accepted out of range argument")
+	}
+}
@@ -0,0 +1,102 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package petscii
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ControlCodes define the mnemonics of the PETSCII control
+// codes. The mnemonics are rendered in braces, for example {clr},
+// inside BASIC program listings.
+var ControlCodes = map[byte]string{
+	0x05: "wht",
+	0x08: "dish",
+	0x09: "ensh",
+	0x0D: "return",
+	0x0E: "swlc",
+	0x11: "down",
+	0x12: "rvon",
+	0x13: "home",
+	0x14: "del",
+	0x1C: "red",
+	0x1D: "rght",
+	0x1E: "grn",
+	0x1F: "blu",
+	0x81: "orng",
+	0x85: "f1",
+	0x86: "f3",
+	0x87: "f5",
+	0x88: "f7",
+	0x89: "f2",
+	0x8A: "f4",
+	0x8B: "f6",
+	0x8C: "f8",
+	0x8D: "sret",
+	0x8E: "swuc",
+	0x90: "blk",
+	0x91: "up",
+	0x92: "rvof",
+	0x93: "clr",
+	0x94: "inst",
+	0x95: "brn",
+	0x96: "lred",
+	0x97: "gry1",
+	0x98: "gry2",
+	0x99: "lgrn",
+	0x9A: "lblu",
+	0x9B: "gry3",
+	0x9C: "pur",
+	0x9D: "left",
+	0x9E: "yel",
+	0x9F: "cyn",
+	0xA0: "sspc",
+}
+
+var controlNames map[string]byte
+
+func init() {
+	controlNames = make(map[string]byte)
+	for code, name := range ControlCodes {
+		controlNames[name] = code
+	}
+}
+
+// Escape returns the escaped form of the PETSCII code: the control
+// codes are returned as {mnemonic} and the codes without printable
+// representation in the character set as {$xx}.
+func Escape(code byte, charset []rune) string {
+	name, ok := ControlCodes[code]
+	if ok {
+		return "{" + name + "}"
+	}
+	r := charset[code]
+	if r == 0 {
+		return fmt.Sprintf("{$%02X}", code)
+	}
+	return string(r)
+}
+
+// Unescape parses the escape sequence name (without the braces) and
+// returns the corresponding PETSCII code. The name can be a control
+// code mnemonic or a hexadecimal value in the $xx format.
+func Unescape(name string) (byte, error) {
+	name = strings.ToLower(name)
+	code, ok := controlNames[name]
+	if ok {
+		return code, nil
+	}
+	if strings.HasPrefix(name, "$") {
+		v, err := strconv.ParseUint(name[1:], 16, 8)
+		if err == nil {
+			return byte(v), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown PETSCII escape {%s}", name)
+}
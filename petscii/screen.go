@@ -0,0 +1,48 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package petscii
+
+// ScreenToPETSCII converts the screen code to the PETSCII code of
+// the same character. The reverse video bit 7 of the screen code is
+// ignored.
+func ScreenToPETSCII(code byte) byte {
+	code &= 0x7f
+	switch {
+	case code < 0x20:
+		return code + 0x40
+	case code < 0x40:
+		return code
+	case code < 0x60:
+		return code + 0x20
+	default:
+		return code + 0x40
+	}
+}
+
+// PETSCIIToScreen converts the PETSCII code to the screen code of
+// the same character. The function returns false if the PETSCII code
+// does not have a screen code i.e. it is a control code.
+func PETSCIIToScreen(code byte) (byte, bool) {
+	switch {
+	case code < 0x20:
+		return 0, false
+	case code < 0x40:
+		return code, true
+	case code < 0x60:
+		return code - 0x40, true
+	case code < 0x80:
+		return code - 0x20, true
+	case code < 0xa0:
+		return 0, false
+	case code < 0xc0:
+		return code - 0x40, true
+	case code < 0xff:
+		return code - 0x80, true
+	default:
+		return 0x5e, true
+	}
+}
@@ -0,0 +1,363 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+// Analysis defines the results of the program analysis. The
+// structure is the stable interface to the analysis: its fields and
+// their JSON encoding are kept backwards compatible. All addresses
+// are absolute memory addresses.
+type Analysis struct {
+	// Load is the program load address and Size is the program size
+	// in bytes.
+	Load uint16 `json:"load"`
+	Size int    `json:"size"`
+
+	// Start is the program start address.
+	Start uint16 `json:"start"`
+
+	// Entries lists the code entry points as in Prg.Entries: the
+	// program start address, the SYS targets or explicit entry
+	// points, the additional code entries and forced code segments,
+	// the resolved indirect jump targets and interrupt handlers, and
+	// the code discovered by the emulation.
+	Entries []uint16 `json:"entries"`
+
+	// Dynamic lists the instructions found by the emulation.
+	Dynamic []uint16 `json:"dynamic,omitempty"`
+
+	// Segments lists the program segments in address order. The
+	// segments cover the whole program.
+	Segments []Segment `json:"segments"`
+
+	// Instructions lists the decoded instructions in address order.
+	Instructions []InstrInfo `json:"instructions"`
+
+	// Labels lists the address labels in address order.
+	Labels []Label `json:"labels"`
+
+	// XRefs lists the memory references of the instructions, sorted
+	// by the referenced address.
+	XRefs []XRefInfo `json:"xrefs"`
+
+	// Warnings lists the analysis warnings in address order.
+	Warnings []Warning `json:"warnings"`
+}
+
+// Segment defines Size bytes of the program starting from Addr, all
+// of the same segment type.
+type Segment struct {
+	Addr uint16  `json:"addr"`
+	Size int     `json:"size"`
+	Type SegType `json:"type"`
+}
+
+// InstrInfo defines a decoded instruction. Mode is the addressing
+// mode and Operand the operand in assembler syntax. For relative
+// branches, Arg is the signed offset byte. Target is the target
+// address of branches and jumps with a static target, and zero
+// otherwise. Cycles holds the minimum and maximum cycle counts.
+type InstrInfo struct {
+	Addr    uint16 `json:"addr"`
+	Opcode  byte   `json:"opcode"`
+	Name    string `json:"name"`
+	Mode    string `json:"mode"`
+	Arg     uint16 `json:"arg"`
+	Size    int    `json:"size"`
+	Operand string `json:"operand,omitempty"`
+	Target  uint16 `json:"target,omitempty"`
+	Cycles  [2]int `json:"cycles"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// LabelKind specifies the origin of a label.
+type LabelKind byte
+
+// Label kinds.
+const (
+	LabelUser LabelKind = iota
+	LabelSub
+	LabelCode
+	LabelData
+)
+
+var labelKinds = map[LabelKind]string{
+	LabelUser: "user",
+	LabelSub:  "sub",
+	LabelCode: "code",
+	LabelData: "data",
+}
+
+func (k LabelKind) String() string {
+	name, ok := labelKinds[k]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{LabelKind %d}", k)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k LabelKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (k *LabelKind) UnmarshalText(text []byte) error {
+	for kind, name := range labelKinds {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown label kind: %s", text)
+}
+
+// Label defines an address label. The user labels come from
+// Prg.Labels. The other labels are generated for the subroutine
+// entry points, the jump targets, and the data addresses referenced
+// by code.
+type Label struct {
+	Addr uint16    `json:"addr"`
+	Name string    `json:"name"`
+	Kind LabelKind `json:"kind"`
+}
+
+// XRefInfo defines a reference from the instruction at From to the
+// address Addr. Index is the index register of indexed references.
+type XRefInfo struct {
+	Addr  uint16  `json:"addr"`
+	From  uint16  `json:"from"`
+	Kind  RefKind `json:"kind"`
+	Index string  `json:"index,omitempty"`
+}
+
+// WarningKind specifies the analysis warning types.
+type WarningKind byte
+
+// Warning kinds.
+const (
+	// Code/data conflict or overlapping instructions.
+	WarnConflict WarningKind = iota
+
+	// Self-modifying code.
+	WarnSMC
+
+	// Indirect jump without resolved targets.
+	WarnIndirect
+
+	// Instruction truncated by the end of the program.
+	WarnTruncated
+
+	// Entry point outside the program.
+	WarnEntry
+
+	// Possible pointer table not referenced by the code.
+	WarnTable
+)
+
+var warningKinds = map[WarningKind]string{
+	WarnConflict:  "conflict",
+	WarnSMC:       "smc",
+	WarnIndirect:  "indirect",
+	WarnTruncated: "truncated",
+	WarnEntry:     "entry",
+	WarnTable:     "table",
+}
+
+func (k WarningKind) String() string {
+	name, ok := warningKinds[k]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{WarningKind %d}", k)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k WarningKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (k *WarningKind) UnmarshalText(text []byte) error {
+	for kind, name := range warningKinds {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown warning kind: %s", text)
+}
+
+// Warning defines an analysis warning at the address.
+type Warning struct {
+	Addr    uint16      `json:"addr"`
+	Kind    WarningKind `json:"kind"`
+	Message string      `json:"message"`
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("$%04X: %v: %s", w.Addr, w.Kind, w.Message)
+}
+
+// Analysis returns the results of the program analysis.
+func (prg *Prg) Analysis() (*Analysis, error) {
+	cfg, err := prg.CFG()
+	if err != nil {
+		return nil, err
+	}
+	xref, err := prg.XRef()
+	if err != nil {
+		return nil, err
+	}
+	a := &Analysis{
+		Load:         prg.Load,
+		Size:         len(prg.Data),
+		Start:        prg.Start,
+		Entries:      append([]uint16{}, prg.Entries...),
+		Dynamic:      prg.Dynamic,
+		Segments:     []Segment{},
+		Instructions: []InstrInfo{},
+		XRefs:        []XRefInfo{},
+		Warnings:     append([]Warning{}, prg.Warnings...),
+	}
+
+	for ofs := 0; ofs < len(prg.Data); {
+		end := prg.segEnd(ofs)
+		a.Segments = append(a.Segments, Segment{
+			Addr: prg.DataToMem(ofs),
+			Size: end - ofs,
+			Type: prg.SegTypes[ofs],
+		})
+		ofs = end
+	}
+
+	comments := prg.comments()
+	for ofs := range prg.Data {
+		if prg.starts == nil || !prg.starts[ofs] {
+			continue
+		}
+		instr, err := prg.Decode(prg.DataToMem(ofs))
+		if err != nil {
+			return nil, err
+		}
+		min, max := instr.Cycles()
+		info := InstrInfo{
+			Addr:    instr.Addr,
+			Opcode:  byte(instr.Op),
+			Name:    instr.Op.String(),
+			Mode:    instr.Op.AddrMode().String(),
+			Arg:     instr.Arg,
+			Size:    instr.Size(),
+			Operand: instr.Operand(),
+			Cycles:  [2]int{min, max},
+			Comment: comments[instr.Addr],
+		}
+		if target, ok := instr.Target(); ok {
+			info.Target = target
+		}
+		a.Instructions = append(a.Instructions, info)
+
+		if instr.Op == mos6510.OpJMPind && len(prg.Indirect[instr.Addr]) == 0 {
+			a.Warnings = append(a.Warnings, Warning{
+				Addr:    instr.Addr,
+				Kind:    WarnIndirect,
+				Message: fmt.Sprintf("%v: unresolved jump targets", instr),
+			})
+		}
+	}
+
+	a.Labels = prg.labels(cfg, xref)
+
+	for _, ref := range xref.Refs {
+		var index string
+		if ref.Index != 0 {
+			index = string(ref.Index)
+		}
+		a.XRefs = append(a.XRefs, XRefInfo{
+			Addr:  ref.Addr,
+			From:  ref.Instr.Addr,
+			Kind:  ref.Kind,
+			Index: index,
+		})
+	}
+
+	for _, c := range prg.Conflicts {
+		a.Warnings = append(a.Warnings, Warning{
+			Addr:    c.Addr,
+			Kind:    WarnConflict,
+			Message: c.String(),
+		})
+	}
+	for _, smc := range prg.SelfModifying() {
+		a.Warnings = append(a.Warnings, Warning{
+			Addr:    smc.Instr,
+			Kind:    WarnSMC,
+			Message: smc.String(),
+		})
+	}
+	sort.SliceStable(a.Warnings, func(i, j int) bool {
+		return a.Warnings[i].Addr < a.Warnings[j].Addr
+	})
+
+	return a, nil
+}
+
+// labels returns the address labels of the program, sorted by
+// address.
+func (prg *Prg) labels(cfg *CFG, xref *XRef) []Label {
+	labels := make(map[uint16]Label)
+	add := func(addr uint16, name string, kind LabelKind) {
+		if _, ok := labels[addr]; !ok {
+			labels[addr] = Label{
+				Addr: addr,
+				Name: name,
+				Kind: kind,
+			}
+		}
+	}
+	for addr, name := range prg.Labels {
+		add(addr, name, LabelUser)
+	}
+	for _, sub := range cfg.Subroutines {
+		add(sub.Entry, sub.Name(), LabelSub)
+	}
+	for _, ref := range xref.Refs {
+		if _, err := prg.MemToData(ref.Addr); err != nil {
+			continue
+		}
+		switch ref.Kind {
+		case RefJump, RefCall:
+			add(ref.Addr, fmt.Sprintf("loc_%04X", ref.Addr), LabelCode)
+		default:
+			add(ref.Addr, fmt.Sprintf("data_%04X", ref.Addr), LabelData)
+		}
+	}
+
+	result := []Label{}
+	for _, label := range labels {
+		result = append(result, label)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Addr < result[j].Addr
+	})
+	return result
+}
+
+// JSON writes the analysis in JSON.
+func (a *Analysis) JSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a)
+}
@@ -0,0 +1,354 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/markkurossi/mpc64/petscii"
+)
+
+// BASIC V2 tokens used by the parser.
+const (
+	tokenREM   = 0x8f
+	tokenSYS   = 0x9e
+	tokenPlus  = 0xaa
+	tokenMinus = 0xab
+	tokenMul   = 0xac
+	tokenDiv   = 0xad
+	tokenPi    = 0xff
+)
+
+// Tokens define the BASIC V2 keywords for the tokens $80-$CB.
+var Tokens = []string{
+	// 0x80 - 0x8F
+	"END", "FOR", "NEXT", "DATA", "INPUT#", "INPUT", "DIM", "READ",
+	"LET", "GOTO", "RUN", "IF", "RESTORE", "GOSUB", "RETURN", "REM",
+
+	// 0x90 - 0x9F
+	"STOP", "ON", "WAIT", "LOAD", "SAVE", "VERIFY", "DEF", "POKE",
+	"PRINT#", "PRINT", "CONT", "LIST", "CLR", "CMD", "SYS", "OPEN",
+
+	// 0xA0 - 0xAF
+	"CLOSE", "GET", "NEW", "TAB(", "TO", "FN", "SPC(", "THEN",
+	"NOT", "STEP", "+", "-", "*", "/", "\u2191", "AND",
+
+	// 0xB0 - 0xBF
+	"OR", ">", "=", "<", "SGN", "INT", "ABS", "USR",
+	"FRE", "POS", "SQR", "RND", "LOG", "EXP", "COS", "SIN",
+
+	// 0xC0 - 0xCB
+	"TAN", "ATN", "PEEK", "LEN", "STR$", "VAL", "ASC", "CHR$",
+	"LEFT$", "RIGHT$", "MID$", "GO",
+}
+
+// Line defines a BASIC program line.
+type Line struct {
+	Addr   uint16
+	Next   uint16
+	Number uint16
+	Data   []byte
+}
+
+// String returns the line as the C64 LIST prints it. Like LIST, the
+// bytes $80 and above are expanded as keywords also after REM; only
+// the bytes inside quotes are printed as PETSCII escapes.
+func (line Line) String() string {
+	str := strconv.Itoa(int(line.Number)) + " "
+	var quoted bool
+
+	for _, b := range line.Data {
+		switch {
+		case b == '"':
+			quoted = !quoted
+			str += "\""
+		case quoted || b < 0x80:
+			str += petscii.Escape(b, petscii.Unshifted)
+		case int(b-0x80) < len(Tokens):
+			str += Tokens[b-0x80]
+		case b == tokenPi:
+			str += "\u03c0"
+		default:
+			str += fmt.Sprintf("{$%02X}", b)
+		}
+	}
+	return str
+}
+
+// BasicLines follows the line-link chain from the beginning of the
+// program data and returns the BASIC program lines and the data
+// offset after the end-of-program marker.
+func (prg *Prg) BasicLines() ([]Line, int, error) {
+	var lines []Line
+
+	pc := 0
+	for {
+		if pc+2 > len(prg.Data) {
+			return nil, 0, prg.errorf(ErrBasic, pc, "line link out of bounds")
+		}
+		link := bo.Uint16(prg.Data[pc:])
+		if link == 0 {
+			return lines, pc + 2, nil
+		}
+		next, err := prg.MemToData(link)
+		if err != nil || next < pc+5 || next+2 > len(prg.Data) {
+			return nil, 0, prg.errorf(ErrBasic, pc,
+				"next line $%04X out of bounds", link)
+		}
+		lines = append(lines, Line{
+			Addr:   prg.DataToMem(pc),
+			Next:   link,
+			Number: bo.Uint16(prg.Data[pc+2:]),
+			Data:   prg.Data[pc+4 : next-1],
+		})
+		pc = next
+	}
+}
+
+// ListBasic writes a LIST-style listing of the BASIC program.
+func (prg *Prg) ListBasic(w io.Writer) error {
+	lines, _, err := prg.BasicLines()
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBasic parses the BASIC program lines and marks the BASIC
+// segments. It returns the lines and the offset after the
+// end-of-program marker.
+func (prg *Prg) parseBasic() ([]Line, int, error) {
+	lines, end, err := prg.BasicLines()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, line := range lines {
+		pc, _ := prg.MemToData(line.Addr)
+		next, _ := prg.MemToData(line.Next)
+
+		prg.SegTypes[pc] = SegAddr
+		prg.SegTypes[pc+1] = SegAddr
+		for i := pc + 2; i < next; i++ {
+			prg.SegTypes[i] = SegBasic
+		}
+	}
+	prg.SegTypes[end-2] = SegAddr
+	prg.SegTypes[end-1] = SegAddr
+
+	return lines, end, nil
+}
+
+// SysTargets returns the target addresses of all SYS statements of
+// the line. Only the SYS statements with constant expression
+// arguments are returned.
+func (line Line) SysTargets() []uint16 {
+	var result []uint16
+	var quoted bool
+
+	for i := 0; i < len(line.Data); i++ {
+		switch line.Data[i] {
+		case '"':
+			quoted = !quoted
+		case tokenSYS:
+			if quoted {
+				continue
+			}
+			p := &sysParser{
+				data: line.Data,
+				pos:  i + 1,
+			}
+			val, ok := p.expr()
+			if ok && val >= 0 && val <= 0xffff {
+				p.skipSpace()
+				if p.pos >= len(p.data) || p.data[p.pos] == ':' {
+					result = append(result, uint16(val))
+				}
+			}
+			i = p.pos - 1
+		}
+	}
+	return result
+}
+
+// replaceSys returns the line with the SYS statements to the address
+// from replaced with SYS statements to the address to. The function
+// returns false if the line has no SYS statements to from.
+func (line Line) replaceSys(from, to uint16) (Line, bool) {
+	var data []byte
+	var quoted, replaced bool
+	var copied int
+
+	for i := 0; i < len(line.Data); i++ {
+		switch line.Data[i] {
+		case '"':
+			quoted = !quoted
+		case tokenSYS:
+			if quoted {
+				continue
+			}
+			p := &sysParser{
+				data: line.Data,
+				pos:  i + 1,
+			}
+			val, ok := p.expr()
+			p.skipSpace()
+			if ok && val == int(from) &&
+				(p.pos >= len(p.data) || p.data[p.pos] == ':') {
+				data = append(data, line.Data[copied:i+1]...)
+				if i+1 < len(line.Data) && line.Data[i+1] == ' ' {
+					data = append(data, ' ')
+				}
+				data = append(data, strconv.Itoa(int(to))...)
+				copied = p.pos
+				replaced = true
+			}
+			i = p.pos - 1
+		}
+	}
+	if !replaced {
+		return line, false
+	}
+	line.Data = append(data, line.Data[copied:]...)
+	return line, true
+}
+
+// linkBasic links the BASIC program lines at BasicStart and returns
+// the program data with the end-of-program marker.
+func linkBasic(lines []Line) []byte {
+	var data []byte
+	for _, line := range lines {
+		next := BasicStart + len(data) + 4 + len(line.Data) + 1
+		data = append(data, byte(next), byte(next>>8))
+		data = append(data, byte(line.Number), byte(line.Number>>8))
+		data = append(data, line.Data...)
+		data = append(data, 0)
+	}
+	return append(data, 0, 0)
+}
+
+// sysParser evaluates simple constant arithmetic expressions from
+// the tokenized BASIC line data.
+type sysParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *sysParser) skipSpace() {
+	for p.pos < len(p.data) && p.data[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *sysParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.data) {
+		return p.data[p.pos]
+	}
+	return 0
+}
+
+func (p *sysParser) expr() (int, bool) {
+	val, ok := p.term()
+	if !ok {
+		return 0, false
+	}
+	for {
+		switch p.peek() {
+		case tokenPlus:
+			p.pos++
+			v, ok := p.term()
+			if !ok {
+				return 0, false
+			}
+			val += v
+		case tokenMinus:
+			p.pos++
+			v, ok := p.term()
+			if !ok {
+				return 0, false
+			}
+			val -= v
+		default:
+			return val, true
+		}
+	}
+}
+
+func (p *sysParser) term() (int, bool) {
+	val, ok := p.factor()
+	if !ok {
+		return 0, false
+	}
+	for {
+		switch p.peek() {
+		case tokenMul:
+			p.pos++
+			v, ok := p.factor()
+			if !ok {
+				return 0, false
+			}
+			val *= v
+		case tokenDiv:
+			p.pos++
+			v, ok := p.factor()
+			if !ok || v == 0 {
+				return 0, false
+			}
+			val /= v
+		default:
+			return val, true
+		}
+	}
+}
+
+func (p *sysParser) factor() (int, bool) {
+	switch p.peek() {
+	case '(':
+		p.pos++
+		val, ok := p.expr()
+		if !ok || p.peek() != ')' {
+			return 0, false
+		}
+		p.pos++
+		return val, true
+
+	case tokenMinus:
+		p.pos++
+		val, ok := p.factor()
+		return -val, ok
+
+	case tokenPlus:
+		p.pos++
+		return p.factor()
+	}
+
+	var val int
+	start := p.pos
+	for p.pos < len(p.data) {
+		ch := p.data[p.pos]
+		if ch >= '0' && ch <= '9' {
+			val = val*10 + int(ch-'0')
+			if val > 0xffff {
+				return 0, false
+			}
+		} else if ch != ' ' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return 0, false
+	}
+	return val, true
+}
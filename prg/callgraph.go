@@ -0,0 +1,228 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Function defines a function in the call graph. The function
+// entries are the program entry points and the JSR targets.
+type Function struct {
+	Entry     uint16
+	Start     uint16
+	End       uint16
+	External  bool
+	Recursive bool
+	Sub       *Subroutine
+	Callers   []*Function
+	Callees   []*Function
+}
+
+// Name returns the function name.
+func (f *Function) Name() string {
+	return fmt.Sprintf("sub_%04X", f.Entry)
+}
+
+// Leaf tests if the function does not call any other functions.
+func (f *Function) Leaf() bool {
+	return len(f.Callees) == 0
+}
+
+func (f *Function) String() string {
+	return f.Name()
+}
+
+func (f *Function) addCallee(callee *Function) {
+	for _, c := range f.Callees {
+		if c == callee {
+			return
+		}
+	}
+	f.Callees = append(f.Callees, callee)
+	callee.Callers = append(callee.Callers, f)
+}
+
+// CallGraph defines the program's call graph.
+type CallGraph struct {
+	Functions []*Function
+	functions map[uint16]*Function
+}
+
+// Function returns the function with the entry address. The function
+// returns nil if no function starts at the address.
+func (cg *CallGraph) Function(addr uint16) *Function {
+	return cg.functions[addr]
+}
+
+func (cg *CallGraph) function(addr uint16) *Function {
+	f, ok := cg.functions[addr]
+	if !ok {
+		f = &Function{
+			Entry:    addr,
+			Start:    addr,
+			End:      addr,
+			External: true,
+		}
+		cg.functions[addr] = f
+		cg.Functions = append(cg.Functions, f)
+	}
+	return f
+}
+
+// CallGraph creates the call graph of the program.
+func (prg *Prg) CallGraph() (*CallGraph, error) {
+	cfg, err := prg.CFG()
+	if err != nil {
+		return nil, err
+	}
+	cg := &CallGraph{
+		functions: make(map[uint16]*Function),
+	}
+	for _, sub := range cfg.Subroutines {
+		f := &Function{
+			Entry: sub.Entry,
+			Start: sub.Entry,
+			End:   sub.Entry,
+			Sub:   sub,
+		}
+		for _, bb := range sub.Blocks {
+			if bb.Start < f.Start {
+				f.Start = bb.Start
+			}
+			if bb.End > f.End {
+				f.End = bb.End
+			}
+		}
+		cg.functions[f.Entry] = f
+		cg.Functions = append(cg.Functions, f)
+	}
+	for _, sub := range cfg.Subroutines {
+		caller := cg.functions[sub.Entry]
+		for _, bb := range sub.Blocks {
+			for _, call := range bb.Calls {
+				caller.addCallee(cg.function(call))
+			}
+		}
+	}
+	sort.Slice(cg.Functions, func(i, j int) bool {
+		return cg.Functions[i].Entry < cg.Functions[j].Entry
+	})
+	cg.markRecursion()
+
+	return cg, nil
+}
+
+// markRecursion finds the strongly connected components of the call
+// graph with Tarjan's algorithm and marks all functions in cycles
+// recursive.
+func (cg *CallGraph) markRecursion() {
+	var index int
+	var stack []*Function
+	indices := make(map[*Function]int)
+	lowlinks := make(map[*Function]int)
+	onStack := make(map[*Function]bool)
+
+	var visit func(f *Function)
+	visit = func(f *Function) {
+		indices[f] = index
+		lowlinks[f] = index
+		index++
+		stack = append(stack, f)
+		onStack[f] = true
+
+		for _, callee := range f.Callees {
+			if callee == f {
+				f.Recursive = true
+			}
+			if _, ok := indices[callee]; !ok {
+				visit(callee)
+				lowlinks[f] = min(lowlinks[f], lowlinks[callee])
+			} else if onStack[callee] {
+				lowlinks[f] = min(lowlinks[f], indices[callee])
+			}
+		}
+		if lowlinks[f] == indices[f] {
+			var scc []*Function
+			for {
+				n := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[n] = false
+				scc = append(scc, n)
+				if n == f {
+					break
+				}
+			}
+			if len(scc) > 1 {
+				for _, n := range scc {
+					n.Recursive = true
+				}
+			}
+		}
+	}
+	for _, f := range cg.Functions {
+		if _, ok := indices[f]; !ok {
+			visit(f)
+		}
+	}
+}
+
+// Print prints the call graph in text format.
+func (cg *CallGraph) Print(w io.Writer) error {
+	var buf bytes.Buffer
+	for _, f := range cg.Functions {
+		var attrs string
+		if f.External {
+			attrs += " external"
+		} else {
+			attrs += fmt.Sprintf(" $%04X-$%04X", f.Start, f.End)
+		}
+		if f.Leaf() {
+			attrs += " leaf"
+		}
+		if f.Recursive {
+			attrs += " recursive"
+		}
+		fmt.Fprintf(&buf, "%s:%s\n", f.Name(), attrs)
+		for _, caller := range f.Callers {
+			fmt.Fprintf(&buf, "  <- %s\n", caller.Name())
+		}
+		for _, callee := range f.Callees {
+			fmt.Fprintf(&buf, "  -> %s\n", callee.Name())
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// DOT writes the call graph in Graphviz DOT format.
+func (cg *CallGraph) DOT(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "digraph \"callgraph\" {")
+	fmt.Fprintln(&buf, "  node [shape=box fontname=\"monospace\"];")
+	for _, f := range cg.Functions {
+		var attrs string
+		if f.External {
+			attrs = " style=dashed"
+		} else if f.Recursive {
+			attrs = " style=bold"
+		}
+		fmt.Fprintf(&buf, "  %q [label=\"%s\"%s];\n", f.Name(), f.Name(),
+			attrs)
+	}
+	for _, f := range cg.Functions {
+		for _, callee := range f.Callees {
+			fmt.Fprintf(&buf, "  %q -> %q;\n", f.Name(), callee.Name())
+		}
+	}
+	fmt.Fprintln(&buf, "}")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,319 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+// BasicBlock defines a basic block: a sequence of instructions with
+// a single entry point and a single exit point.
+type BasicBlock struct {
+	Start  uint16
+	End    uint16
+	Instrs []Instr
+	Succs  []*BasicBlock
+	Preds  []*BasicBlock
+	Calls  []uint16
+
+	// The loop counter ranges at the block entry.
+	bounds indexBounds
+}
+
+// Last returns the last instruction of the basic block.
+func (bb *BasicBlock) Last() Instr {
+	return bb.Instrs[len(bb.Instrs)-1]
+}
+
+func (bb *BasicBlock) String() string {
+	return fmt.Sprintf("%04X-%04X", bb.Start, bb.End)
+}
+
+func (bb *BasicBlock) addSucc(succ *BasicBlock) {
+	for _, s := range bb.Succs {
+		if s == succ {
+			return
+		}
+	}
+	bb.Succs = append(bb.Succs, succ)
+	succ.Preds = append(succ.Preds, bb)
+}
+
+// Subroutine defines a subroutine, starting from its entry point and
+// containing all basic blocks reachable from it without following
+// subroutine calls.
+type Subroutine struct {
+	Entry  uint16
+	Blocks []*BasicBlock
+}
+
+// Name returns the subroutine name.
+func (sub *Subroutine) Name() string {
+	return fmt.Sprintf("sub_%04X", sub.Entry)
+}
+
+// Returns tests if the subroutine contains an RTS instruction.
+func (sub *Subroutine) Returns() bool {
+	for _, bb := range sub.Blocks {
+		if bb.Last().Op == mos6510.OpRTS {
+			return true
+		}
+	}
+	return false
+}
+
+// DOT writes the subroutine's control-flow graph in Graphviz DOT
+// format.
+func (sub *Subroutine) DOT(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "digraph %q {\n", sub.Name())
+	fmt.Fprintf(&buf, "  node [shape=box fontname=\"monospace\"];\n")
+	for _, bb := range sub.Blocks {
+		var label string
+		for _, instr := range bb.Instrs {
+			label += fmt.Sprintf("%04X: %v\\l", instr.Addr, instr)
+		}
+		fmt.Fprintf(&buf, "  \"%04X\" [label=\"%s\"];\n", bb.Start, label)
+	}
+	for _, bb := range sub.Blocks {
+		for _, succ := range bb.Succs {
+			fmt.Fprintf(&buf, "  \"%04X\" -> \"%04X\";\n", bb.Start,
+				succ.Start)
+		}
+		for _, call := range bb.Calls {
+			fmt.Fprintf(&buf, "  \"%04X\" -> \"sub_%04X\" [style=dashed];\n",
+				bb.Start, call)
+		}
+	}
+	fmt.Fprintln(&buf, "}")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// CFG defines the program's control-flow graph.
+type CFG struct {
+	Blocks      []*BasicBlock
+	Subroutines []*Subroutine
+	blocks      map[uint16]*BasicBlock
+}
+
+// Block returns the basic block starting at the address. The
+// function returns nil if no block starts at the address.
+func (cfg *CFG) Block(addr uint16) *BasicBlock {
+	return cfg.blocks[addr]
+}
+
+// blockContaining returns the basic block containing the address or
+// nil if the address is not in any block.
+func (cfg *CFG) blockContaining(addr uint16) *BasicBlock {
+	for _, bb := range cfg.Blocks {
+		if bb.Start <= addr && addr < bb.End {
+			return bb
+		}
+	}
+	return nil
+}
+
+// Subroutine returns the subroutine with the entry address. The
+// function returns nil if no subroutine starts at the address.
+func (cfg *CFG) Subroutine(addr uint16) *Subroutine {
+	for _, sub := range cfg.Subroutines {
+		if sub.Entry == addr {
+			return sub
+		}
+	}
+	return nil
+}
+
+// DOT writes the control-flow graphs of all subroutines in Graphviz
+// DOT format.
+func (cfg *CFG) DOT(w io.Writer) error {
+	for _, sub := range cfg.Subroutines {
+		if err := sub.DOT(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CFG extracts the basic blocks and the control-flow graph from the
+// code segments of the program. The graph is cached until the code
+// segments change and it must not be modified by the caller.
+func (prg *Prg) CFG() (*CFG, error) {
+	if prg.cfg != nil {
+		return prg.cfg, nil
+	}
+	instrs := make(map[uint16]Instr)
+	leaders := make(map[uint16]bool)
+	calls := make(map[uint16]bool)
+
+	// Discover all reachable instructions and basic block leaders.
+	pending := append([]uint16(nil), prg.Entries...)
+	pending = append(pending, prg.guesses...)
+	for _, addr := range pending {
+		leaders[addr] = true
+	}
+	for len(pending) > 0 {
+		addr := pending[0]
+		pending = pending[1:]
+
+		for prg.isCode(addr) {
+			if _, ok := instrs[addr]; ok {
+				break
+			}
+			instr, err := prg.Decode(addr)
+			if err != nil {
+				// Truncated code, reported in the parse warnings.
+				break
+			}
+			instrs[addr] = instr
+
+			target, ok := instr.Target()
+			if ok && prg.isCode(target) {
+				leaders[target] = true
+				pending = append(pending, target)
+				if instr.Call() {
+					calls[target] = true
+				}
+			}
+			for _, target := range prg.Indirect[addr] {
+				if prg.isCode(target) {
+					leaders[target] = true
+					pending = append(pending, target)
+				}
+			}
+			if instr.Op.BlockEnd() {
+				break
+			}
+			if instr.Op.Jump() {
+				leaders[instr.Next()] = true
+			}
+			addr = instr.Next()
+		}
+	}
+
+	cfg := &CFG{
+		blocks: make(map[uint16]*BasicBlock),
+	}
+
+	// Create basic blocks.
+	var starts []uint16
+	for addr := range leaders {
+		if _, ok := instrs[addr]; ok {
+			starts = append(starts, addr)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i] < starts[j]
+	})
+	for _, start := range starts {
+		bb := &BasicBlock{
+			Start: start,
+		}
+		for addr := start; ; {
+			instr, ok := instrs[addr]
+			if !ok {
+				break
+			}
+			bb.Instrs = append(bb.Instrs, instr)
+			addr = instr.Next()
+			bb.End = addr
+			if instr.Op.Jump() || instr.Op.BlockEnd() || leaders[addr] {
+				break
+			}
+		}
+		cfg.Blocks = append(cfg.Blocks, bb)
+		cfg.blocks[start] = bb
+	}
+
+	// Connect basic blocks.
+	for _, bb := range cfg.Blocks {
+		last := bb.Last()
+		target, ok := last.Target()
+		if ok {
+			if last.Call() {
+				bb.Calls = append(bb.Calls, target)
+			} else if succ := cfg.blocks[target]; succ != nil {
+				bb.addSucc(succ)
+			}
+		}
+		for _, target := range prg.Indirect[last.Addr] {
+			if succ := cfg.blocks[target]; succ != nil {
+				bb.addSucc(succ)
+			}
+		}
+		if !last.Op.BlockEnd() {
+			if succ := cfg.blocks[bb.End]; succ != nil {
+				bb.addSucc(succ)
+			}
+		}
+	}
+
+	// Collect subroutines from program entry points and call
+	// targets.
+	seen := make(map[uint16]bool)
+	var entries []uint16
+	for _, addr := range prg.Entries {
+		if !seen[addr] {
+			seen[addr] = true
+			entries = append(entries, addr)
+		}
+	}
+	for _, start := range starts {
+		if calls[start] && !seen[start] {
+			seen[start] = true
+			entries = append(entries, start)
+		}
+	}
+	for _, entry := range entries {
+		bb := cfg.blocks[entry]
+		if bb == nil {
+			continue
+		}
+		sub := &Subroutine{
+			Entry: entry,
+		}
+		visited := map[*BasicBlock]bool{
+			bb: true,
+		}
+		queue := []*BasicBlock{bb}
+		for len(queue) > 0 {
+			bb := queue[0]
+			queue = queue[1:]
+			sub.Blocks = append(sub.Blocks, bb)
+			for _, succ := range bb.Succs {
+				if !visited[succ] {
+					visited[succ] = true
+					queue = append(queue, succ)
+				}
+			}
+		}
+		sort.Slice(sub.Blocks, func(i, j int) bool {
+			return sub.Blocks[i].Start < sub.Blocks[j].Start
+		})
+		cfg.Subroutines = append(cfg.Subroutines, sub)
+	}
+	cfg.setBounds()
+	prg.cfg = cfg
+
+	return cfg, nil
+}
+
+// isCode tests if the address is inside the program and marked as
+// code.
+func (prg *Prg) isCode(addr uint16) bool {
+	ofs, err := prg.MemToData(addr)
+	if err != nil {
+		return false
+	}
+	return prg.SegTypes[ofs] == SegCode
+}
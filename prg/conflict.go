@@ -0,0 +1,136 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"fmt"
+)
+
+// ConflictKind specifies the code/data conflict types.
+type ConflictKind byte
+
+// Conflict kinds.
+const (
+	// Control flow to the middle of an instruction, or an
+	// instruction overlapping the following instruction.
+	ConflictOperand ConflictKind = iota
+
+	// Control flow to a byte marked as data.
+	ConflictData
+)
+
+var conflictKinds = map[ConflictKind]string{
+	ConflictOperand: "operand",
+	ConflictData:    "data",
+}
+
+func (k ConflictKind) String() string {
+	name, ok := conflictKinds[k]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{ConflictKind %d}", k)
+}
+
+// Conflict defines a code/data conflict. Addr is the conflicting
+// address. For operand conflicts, Instr is the address of the
+// instruction containing Addr in its operand. If HasFrom is true, the
+// conflicting control flow comes from the instruction at From.
+type Conflict struct {
+	Kind    ConflictKind
+	Addr    uint16
+	Instr   uint16
+	From    uint16
+	HasFrom bool
+}
+
+func (c Conflict) String() string {
+	var from string
+	if c.HasFrom {
+		from = fmt.Sprintf(" from $%04X", c.From)
+	}
+	switch c.Kind {
+	case ConflictOperand:
+		return fmt.Sprintf("$%04X: flow%s into operand of instruction $%04X",
+			c.Addr, from, c.Instr)
+	case ConflictData:
+		return fmt.Sprintf("$%04X: flow%s into data", c.Addr, from)
+	default:
+		return fmt.Sprintf("$%04X: %v conflict%s", c.Addr, c.Kind, from)
+	}
+}
+
+// InstrStart tests if an instruction starts at the address.
+func (prg *Prg) InstrStart(addr uint16) bool {
+	ofs, err := prg.MemToData(addr)
+	if err != nil || ofs >= len(prg.starts) {
+		return false
+	}
+	return prg.starts[ofs]
+}
+
+// addConflict adds a conflict at the data offset.
+func (prg *Prg) addConflict(kind ConflictKind, ofs int, f flow) {
+	c := Conflict{
+		Kind:    kind,
+		Addr:    prg.DataToMem(ofs),
+		From:    f.from,
+		HasFrom: f.hasFrom,
+	}
+	if kind == ConflictOperand {
+		start, ok := prg.instrContaining(ofs)
+		if !ok {
+			start = ofs
+		}
+		c.Instr = prg.DataToMem(start)
+	}
+	for _, old := range prg.Conflicts {
+		if old == c {
+			return
+		}
+	}
+	prg.Conflicts = append(prg.Conflicts, c)
+}
+
+// instrContaining returns the data offset of the recorded
+// instruction starting at the data offset or containing it in its
+// operand. The boolean result is false if no recorded instruction
+// covers the offset.
+func (prg *Prg) instrContaining(ofs int) (int, bool) {
+	if prg.starts[ofs] {
+		return ofs, true
+	}
+	for start := ofs - 1; start >= 0 && start > ofs-3; start-- {
+		if prg.starts[start] && start+prg.instrSize(start) > ofs {
+			return start, true
+		}
+	}
+	return ofs, false
+}
+
+// instrSize returns the size of the instruction at the data offset.
+func (prg *Prg) instrSize(ofs int) int {
+	instr, err := prg.Decode(prg.DataToMem(ofs))
+	if err != nil {
+		return 1
+	}
+	return instr.Size()
+}
+
+// overlapEnd returns the data offset of the first instruction start
+// inside the operand of the instruction at the data offset. If the
+// instruction does not overlap other instructions, the function
+// returns the offset of the next instruction.
+func (prg *Prg) overlapEnd(ofs int) int {
+	size := prg.instrSize(ofs)
+	for i := 1; i < size; i++ {
+		if ofs+i < len(prg.starts) && prg.starts[ofs+i] {
+			return ofs + i
+		}
+	}
+	return ofs + size
+}
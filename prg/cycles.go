@@ -0,0 +1,509 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/markkurossi/mpc64/mos6510"
+	"github.com/markkurossi/tabulate"
+)
+
+// Raster line cycle budgets.
+const (
+	CyclesPerLinePAL  = 63
+	CyclesPerLineNTSC = 65
+)
+
+// Cycles returns the minimum and maximum cycle counts of the
+// instruction. For branches, the minimum is the not taken case and
+// the maximum is the taken case, including the extra cycle if the
+// branch target is on a different page. For indexed reads, the
+// maximum includes the extra cycle for the page crossing if the
+// operand address allows the index to cross a page.
+func (i Instr) Cycles() (int, int) {
+	return i.cycles(nil)
+}
+
+// cycles returns the minimum and maximum cycle counts of the
+// instruction with the known index register ranges.
+func (i Instr) cycles(bounds indexBounds) (int, int) {
+	info := mos6510.Instructions[i.Op]
+	cycles := info.Cycles
+	switch info.Addr {
+	case mos6510.AddrREL:
+		return cycles, i.TakenCycles()
+	}
+	if i.pageCross(bounds) {
+		return cycles, cycles + 1
+	}
+	return cycles, cycles
+}
+
+// TakenCycles returns the cycle count of a taken branch.
+func (i Instr) TakenCycles() int {
+	cycles := mos6510.Instructions[i.Op].Cycles + 1
+	target, _ := i.Target()
+	if target&0xff00 != i.Next()&0xff00 {
+		cycles++
+	}
+	return cycles
+}
+
+// PageCross tests if the instruction's cycle count depends on a page
+// crossing. Absolute indexed reads can cross a page unless the
+// operand is page aligned, the (zp),Y pointer is not known
+// statically, and taken branches cross a page if the target is on a
+// different page.
+func (i Instr) PageCross() bool {
+	return i.pageCross(nil)
+}
+
+// indexBounds defines the known value ranges of the index registers.
+type indexBounds map[byte][2]int
+
+// pageCross tests if the instruction can cross a page with the known
+// index register ranges. Absolute indexed reads with a known index
+// range cross a page if the operand address plus the maximum index
+// is on the next page.
+func (i Instr) pageCross(bounds indexBounds) bool {
+	info := mos6510.Instructions[i.Op]
+	if !info.PageBoundary {
+		return false
+	}
+	switch info.Addr {
+	case mos6510.AddrABX, mos6510.AddrABY:
+		reg := byte('X')
+		if info.Addr == mos6510.AddrABY {
+			reg = 'Y'
+		}
+		if b, ok := bounds[reg]; ok {
+			return int(i.Arg&0xff)+b[1] > 0xff
+		}
+		return i.Arg&0xff != 0
+	case mos6510.AddrIZY:
+		return true
+	case mos6510.AddrREL:
+		target, _ := i.Target()
+		return target&0xff00 != i.Next()&0xff00
+	default:
+		return false
+	}
+}
+
+// Cycles returns the minimum and maximum cycle counts of the basic
+// block. The counts do not include the called subroutines. The page
+// crossings of the indexed reads take into account the loop counter
+// ranges and the index registers loaded with immediate values in the
+// block.
+func (bb *BasicBlock) Cycles() (int, int) {
+	var min, max int
+	bb.walkBounds(func(instr Instr, bounds indexBounds) {
+		lo, hi := instr.cycles(bounds)
+		min += lo
+		max += hi
+	})
+	return min, max
+}
+
+// PageCrosses returns the instructions of the basic block whose cycle
+// counts depend on page crossings.
+func (bb *BasicBlock) PageCrosses() []Instr {
+	var result []Instr
+	bb.walkBounds(func(instr Instr, bounds indexBounds) {
+		if instr.pageCross(bounds) {
+			result = append(result, instr)
+		}
+	})
+	return result
+}
+
+// walkBounds calls the function for the block's instructions with the
+// known index register ranges before each instruction.
+func (bb *BasicBlock) walkBounds(f func(instr Instr, bounds indexBounds)) {
+	bounds := make(indexBounds)
+	for reg, b := range bb.bounds {
+		bounds[reg] = b
+	}
+	for _, instr := range bb.Instrs {
+		f(instr, bounds)
+		for _, reg := range []byte{'X', 'Y'} {
+			switch {
+			case reg == 'X' && instr.Op == mos6510.OpLDXimm,
+				reg == 'Y' && instr.Op == mos6510.OpLDYimm:
+				bounds[reg] = [2]int{int(instr.Arg), int(instr.Arg)}
+			case writesReg(instr.Op, reg):
+				delete(bounds, reg)
+			}
+		}
+	}
+}
+
+// setBounds sets the counter ranges of the counted loops to their
+// blocks. The blocks entered from outside the loop are not updated.
+func (cfg *CFG) setBounds() {
+	for _, loop := range cfg.Loops() {
+		in := make(map[*BasicBlock]bool)
+		for _, bb := range loop.Blocks {
+			in[bb] = true
+		}
+	blocks:
+		for idx, bb := range loop.Blocks {
+			if idx > 0 {
+				for _, pred := range bb.Preds {
+					if !in[pred] {
+						break blocks
+					}
+				}
+			}
+			if bb.bounds == nil {
+				bb.bounds = make(indexBounds)
+			}
+			b := [2]int{loop.CounterMin, loop.CounterMax}
+			if old, ok := bb.bounds[loop.Counter]; ok {
+				b[0] = min(b[0], old[0])
+				b[1] = max(b[1], old[1])
+			}
+			bb.bounds[loop.Counter] = b
+		}
+	}
+}
+
+// PathCycles returns the minimum and maximum cycle counts of the
+// straight-line path through the basic blocks starting at the
+// addresses. Each block must be a successor of the previous one. The
+// branch at the end of a block is counted as taken if the path
+// continues at the branch target, and as not taken otherwise. The
+// last block is counted fully.
+func (cfg *CFG) PathCycles(addrs ...uint16) (int, int, error) {
+	var min, max int
+	for idx, addr := range addrs {
+		bb := cfg.Block(addr)
+		if bb == nil {
+			return 0, 0, fmt.Errorf("no basic block at $%04X", addr)
+		}
+		lo, hi := bb.Cycles()
+		if idx+1 < len(addrs) {
+			next := cfg.Block(addrs[idx+1])
+			if next == nil || !bb.hasSucc(next) {
+				return 0, 0, fmt.Errorf("$%04X does not follow %v",
+					addrs[idx+1], bb)
+			}
+			last := bb.Last()
+			if last.Branch() {
+				// Replace the branch range with the actual edge.
+				blo, bhi := last.Cycles()
+				lo -= blo
+				hi -= bhi
+				cycles := blo
+				if target, _ := last.Target(); target == next.Start {
+					cycles = last.TakenCycles()
+				}
+				lo += cycles
+				hi += cycles
+			}
+		}
+		min += lo
+		max += hi
+	}
+	return min, max, nil
+}
+
+func (bb *BasicBlock) hasSucc(succ *BasicBlock) bool {
+	for _, s := range bb.Succs {
+		if s == succ {
+			return true
+		}
+	}
+	return false
+}
+
+// Loop defines a simple counted loop: a straight chain of basic
+// blocks from Header to the backward branch at Latch, counting the
+// X or Y register from an immediate value. CounterMin and CounterMax
+// are the counter values in the loop body. Min and Max are the cycle
+// counts of all iterations.
+type Loop struct {
+	Header     uint16
+	Latch      uint16
+	Counter    byte
+	CounterMin int
+	CounterMax int
+	Iterations int
+	Min        int
+	Max        int
+	Blocks     []*BasicBlock
+}
+
+func (l Loop) String() string {
+	return fmt.Sprintf("loop $%04X-$%04X: %c x %d: %d-%d cycles",
+		l.Header, l.Latch, l.Counter, l.Iterations, l.Min, l.Max)
+}
+
+// Loops returns the simple counted loops of the program.
+func (cfg *CFG) Loops() []Loop {
+	var result []Loop
+	for _, latch := range cfg.Blocks {
+		last := latch.Last()
+		if !last.Branch() {
+			continue
+		}
+		target, _ := last.Target()
+		header := cfg.Block(target)
+		if header == nil || header.Start > latch.Start {
+			continue
+		}
+		loop, ok := cfg.countedLoop(header, latch)
+		if ok {
+			result = append(result, loop)
+		}
+	}
+	return result
+}
+
+func (cfg *CFG) countedLoop(header, latch *BasicBlock) (Loop, bool) {
+	// Collect the straight chain of blocks from header to latch.
+	var blocks []*BasicBlock
+	for bb := header; ; {
+		blocks = append(blocks, bb)
+		if bb == latch {
+			break
+		}
+		if len(bb.Succs) != 1 || len(bb.Calls) > 0 ||
+			bb.Succs[0].Start <= bb.Start || bb.Succs[0].Start > latch.Start {
+			return Loop{}, false
+		}
+		bb = bb.Succs[0]
+	}
+
+	// The counter update before the latch branch.
+	instrs := latch.Instrs
+	if len(instrs) < 2 {
+		return Loop{}, false
+	}
+	branch := instrs[len(instrs)-1]
+	update := instrs[len(instrs)-2]
+	cmp := -1
+	var cmpReg byte
+	if len(instrs) >= 3 {
+		switch update.Op {
+		case mos6510.OpCPXimm:
+			cmp, cmpReg = int(update.Arg), 'X'
+			update = instrs[len(instrs)-3]
+		case mos6510.OpCPYimm:
+			cmp, cmpReg = int(update.Arg), 'Y'
+			update = instrs[len(instrs)-3]
+		}
+	}
+	var reg byte
+	var step int
+	switch update.Op {
+	case mos6510.OpDEX:
+		reg, step = 'X', -1
+	case mos6510.OpDEY:
+		reg, step = 'Y', -1
+	case mos6510.OpINX:
+		reg, step = 'X', 1
+	case mos6510.OpINY:
+		reg, step = 'Y', 1
+	default:
+		return Loop{}, false
+	}
+	if cmp >= 0 && (step < 0 || cmpReg != reg) {
+		return Loop{}, false
+	}
+
+	// The counter must not be modified elsewhere in the loop.
+	for _, bb := range blocks {
+		for _, instr := range bb.Instrs {
+			if instr.Addr != update.Addr && writesReg(instr.Op, reg) {
+				return Loop{}, false
+			}
+		}
+	}
+
+	// The counter initialization in the unique loop entry block.
+	var entry *BasicBlock
+	for _, pred := range header.Preds {
+		if pred.Start >= header.Start && pred.Start <= latch.Start {
+			continue
+		}
+		if entry != nil {
+			return Loop{}, false
+		}
+		entry = pred
+	}
+	if entry == nil {
+		return Loop{}, false
+	}
+	init := -1
+	for _, instr := range entry.Instrs {
+		switch {
+		case reg == 'X' && instr.Op == mos6510.OpLDXimm,
+			reg == 'Y' && instr.Op == mos6510.OpLDYimm:
+			init = int(instr.Arg)
+		case writesReg(instr.Op, reg):
+			init = -1
+		}
+	}
+	if init < 0 {
+		return Loop{}, false
+	}
+
+	var iterations int
+	switch {
+	case cmp >= 0 && branch.Op == mos6510.OpBNErel:
+		iterations = (cmp - init) & 0xff
+	case cmp >= 0 && branch.Op == mos6510.OpBCCrel:
+		if cmp <= init {
+			return Loop{}, false
+		}
+		iterations = cmp - init
+	case cmp < 0 && branch.Op == mos6510.OpBNErel && step < 0:
+		iterations = init
+	case cmp < 0 && branch.Op == mos6510.OpBNErel && step > 0:
+		iterations = (256 - init) & 0xff
+	case cmp < 0 && branch.Op == mos6510.OpBPLrel && step < 0:
+		if init >= 0x80 {
+			return Loop{}, false
+		}
+		iterations = init + 1
+	default:
+		return Loop{}, false
+	}
+	if iterations == 0 {
+		iterations = 256
+	}
+	counterMin, counterMax := init, init+iterations-1
+	if step < 0 {
+		counterMin, counterMax = init-iterations+1, init
+	}
+	if counterMin < 0 || counterMax > 0xff {
+		counterMin, counterMax = 0, 0xff
+	}
+
+	// Body cycles without the latch branch.
+	var bodyMin, bodyMax int
+	for _, bb := range blocks {
+		lo, hi := bb.Cycles()
+		bodyMin += lo
+		bodyMax += hi
+	}
+	blo, bhi := branch.Cycles()
+	bodyMin -= blo
+	bodyMax -= bhi
+	taken := branch.TakenCycles()
+
+	return Loop{
+		Header:     header.Start,
+		Latch:      branch.Addr,
+		Counter:    reg,
+		CounterMin: counterMin,
+		CounterMax: counterMax,
+		Iterations: iterations,
+		Min:        iterations*bodyMin + (iterations-1)*taken + blo,
+		Max:        iterations*bodyMax + (iterations-1)*taken + blo,
+		Blocks:     blocks,
+	}, true
+}
+
+// writesReg tests if the opcode writes the register 'A', 'X', or
+// 'Y'.
+func writesReg(op mos6510.Opcode, reg byte) bool {
+	switch op {
+	case mos6510.OpLAXabs, mos6510.OpLAXaby, mos6510.OpLAXimm,
+		mos6510.OpLAXizx, mos6510.OpLAXizy, mos6510.OpLAXzp,
+		mos6510.OpLAXzpy, mos6510.OpLASaby:
+		return reg == 'A' || reg == 'X'
+	case mos6510.OpLDAizx, mos6510.OpLDAzp, mos6510.OpLDAimm,
+		mos6510.OpLDAabs, mos6510.OpLDAizy, mos6510.OpLDAzpx,
+		mos6510.OpLDAaby, mos6510.OpLDAabx, mos6510.OpTXA, mos6510.OpTYA,
+		mos6510.OpPLA, mos6510.OpORAizx, mos6510.OpORAzp, mos6510.OpORAimm,
+		mos6510.OpORAabs, mos6510.OpORAizy, mos6510.OpORAzpx,
+		mos6510.OpORAaby, mos6510.OpORAabx, mos6510.OpANDizx, mos6510.OpANDzp,
+		mos6510.OpANDimm, mos6510.OpANDabs, mos6510.OpANDizy,
+		mos6510.OpANDzpx, mos6510.OpANDaby, mos6510.OpANDabx,
+		mos6510.OpEORizx, mos6510.OpEORzp, mos6510.OpEORimm, mos6510.OpEORabs,
+		mos6510.OpEORizy, mos6510.OpEORzpx, mos6510.OpEORaby,
+		mos6510.OpEORabx, mos6510.OpADCizx, mos6510.OpADCzp, mos6510.OpADCimm,
+		mos6510.OpADCabs, mos6510.OpADCizy, mos6510.OpADCzpx,
+		mos6510.OpADCaby, mos6510.OpADCabx, mos6510.OpSBCizx, mos6510.OpSBCzp,
+		mos6510.OpSBCimm0xE9, mos6510.OpSBCimm0xEB, mos6510.OpSBCabs,
+		mos6510.OpSBCizy, mos6510.OpSBCzpx, mos6510.OpSBCaby,
+		mos6510.OpSBCabx, mos6510.OpASL, mos6510.OpROL, mos6510.OpLSR,
+		mos6510.OpROR, mos6510.OpANCimm0x0B, mos6510.OpANCimm0x2B,
+		mos6510.OpALRimm, mos6510.OpARRimm, mos6510.OpXAAimm,
+		mos6510.OpSLOizx, mos6510.OpSLOzp, mos6510.OpSLOabs, mos6510.OpSLOizy,
+		mos6510.OpSLOzpx, mos6510.OpSLOaby, mos6510.OpSLOabx,
+		mos6510.OpRLAizx, mos6510.OpRLAzp, mos6510.OpRLAabs, mos6510.OpRLAizy,
+		mos6510.OpRLAzpx, mos6510.OpRLAaby, mos6510.OpRLAabx,
+		mos6510.OpSREizx, mos6510.OpSREzp, mos6510.OpSREabs, mos6510.OpSREizy,
+		mos6510.OpSREzpx, mos6510.OpSREaby, mos6510.OpSREabx,
+		mos6510.OpRRAizx, mos6510.OpRRAzp, mos6510.OpRRAabs, mos6510.OpRRAizy,
+		mos6510.OpRRAzpx, mos6510.OpRRAaby, mos6510.OpRRAabx,
+		mos6510.OpISCizx, mos6510.OpISCzp, mos6510.OpISCabs, mos6510.OpISCizy,
+		mos6510.OpISCzpx, mos6510.OpISCaby, mos6510.OpISCabx:
+		return reg == 'A'
+	case mos6510.OpLDXabs, mos6510.OpLDXaby, mos6510.OpLDXimm,
+		mos6510.OpLDXzp, mos6510.OpLDXzpy, mos6510.OpTAX, mos6510.OpTSX,
+		mos6510.OpINX, mos6510.OpDEX, mos6510.OpAXSimm:
+		return reg == 'X'
+	case mos6510.OpLDYabs, mos6510.OpLDYabx, mos6510.OpLDYimm,
+		mos6510.OpLDYzp, mos6510.OpLDYzpx, mos6510.OpTAY,
+		mos6510.OpINY, mos6510.OpDEY:
+		return reg == 'Y'
+	default:
+		return false
+	}
+}
+
+// PrintCycles prints the cycle counts of the program's basic blocks
+// and counted loops. The raster line counts are for PAL.
+func (prg *Prg) PrintCycles(w io.Writer) error {
+	cfg, err := prg.CFG()
+	if err != nil {
+		return err
+	}
+	tab := tabulate.New(tabulate.Simple)
+	tab.Header("Block")
+	tab.Header("Min").SetAlign(tabulate.MR)
+	tab.Header("Max").SetAlign(tabulate.MR)
+	tab.Header("Lines").SetAlign(tabulate.MR)
+	tab.Header("Page crossings").SetAlign(tabulate.ML)
+
+	row := func(label string, min, max int, crosses []Instr) {
+		r := tab.Row()
+		r.Column(label)
+		r.Column(fmt.Sprintf("%d", min))
+		r.Column(fmt.Sprintf("%d", max))
+		r.Column(fmt.Sprintf("%.2f", float64(max)/CyclesPerLinePAL))
+		var addrs []string
+		for _, instr := range crosses {
+			addrs = append(addrs, fmt.Sprintf("$%04X", instr.Addr))
+		}
+		r.Column(strings.Join(addrs, " "))
+	}
+	for _, bb := range cfg.Blocks {
+		min, max := bb.Cycles()
+		row(bb.String(), min, max, bb.PageCrosses())
+	}
+	for _, loop := range cfg.Loops() {
+		var crosses []Instr
+		for _, bb := range loop.Blocks {
+			crosses = append(crosses, bb.PageCrosses()...)
+		}
+		row(fmt.Sprintf("loop %04X x%d", loop.Header, loop.Iterations),
+			loop.Min, loop.Max, crosses)
+	}
+	var buf bytes.Buffer
+	tab.Print(&buf)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,303 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/markkurossi/mpc64/mos6510"
+	"github.com/markkurossi/mpc64/petscii"
+)
+
+// Sizes of the graphics data blocks.
+const (
+	SpriteSize = 63
+	CharSize   = 8
+)
+
+// VIC-II registers and memory locations used by the data detection
+// heuristics. The heuristics assume the default VIC-II bank 0 and
+// screen memory at $0400.
+const (
+	vicMemSetup    = 0xd018
+	spritePointers = 0x07f8
+)
+
+// minTableLen specifies the minimum number of entries in the
+// automatically detected word and pointer tables.
+const minTableLen = 3
+
+// segEnd returns the end offset of the segment of the same type
+// starting from the offset.
+func (prg *Prg) segEnd(from int) int {
+	t := prg.SegTypes[from]
+	to := from
+	for to < len(prg.Data) && prg.SegTypes[to] == t {
+		to++
+	}
+	return to
+}
+
+// markData marks the unmarked or SegData bytes [from, to) with the
+// segment type. The function returns false if any of the bytes have
+// other segment types or forced segment types.
+func (prg *Prg) markData(from, to int, t SegType) bool {
+	if from < 0 || to > len(prg.Data) {
+		return false
+	}
+	for i := from; i < to; i++ {
+		if prg.SegTypes[i] != SegNone && prg.SegTypes[i] != SegData {
+			return false
+		}
+		if prg.forced != nil && prg.forced[i] {
+			return false
+		}
+	}
+	for i := from; i < to; i++ {
+		prg.SegTypes[i] = t
+	}
+	prg.invalidate()
+	return true
+}
+
+// detectData runs heuristics that detect typed data segments inside
+// the SegData segments.
+func (prg *Prg) detectData() {
+	prg.detectGraphics()
+	prg.detectTables(true)
+	prg.detectStrings()
+	prg.detectTables(false)
+}
+
+// detectGraphics detects sprites and character sets from the values
+// the code stores into the sprite pointers and into the VIC-II memory
+// setup register.
+func (prg *Prg) detectGraphics() {
+	cfg, err := prg.CFG()
+	if err != nil {
+		return
+	}
+	for _, bb := range cfg.Blocks {
+		a, x, y := -1, -1, -1
+		for _, instr := range bb.Instrs {
+			val := -1
+			switch instr.Op {
+			case mos6510.OpLDAimm:
+				a = int(instr.Arg)
+			case mos6510.OpLDXimm:
+				x = int(instr.Arg)
+			case mos6510.OpLDYimm:
+				y = int(instr.Arg)
+			case mos6510.OpSTAabs:
+				val = a
+			case mos6510.OpSTXabs:
+				val = x
+			case mos6510.OpSTYabs:
+				val = y
+			default:
+				a, x, y = -1, -1, -1
+			}
+			if val < 0 {
+				continue
+			}
+			switch {
+			case instr.Arg >= spritePointers && instr.Arg < spritePointers+8:
+				ofs, err := prg.MemToData(uint16(val) * 64)
+				if err == nil {
+					prg.markData(ofs, ofs+SpriteSize, SegSprite)
+				}
+			case instr.Arg == vicMemSetup:
+				ofs, err := prg.MemToData(uint16(val&0x0e) * 0x400)
+				if err == nil {
+					limit := min(ofs+256*CharSize, len(prg.Data))
+					end := ofs
+					for end < limit && prg.SegTypes[end] == SegData {
+						end++
+					}
+					end -= (end - ofs) % CharSize
+					prg.markData(ofs, end, SegChar)
+				}
+			}
+		}
+	}
+}
+
+// detectTables detects tables of little-endian words pointing inside
+// the program. If the ptrs argument is true, the function detects
+// only pointer tables where all entries point to code. The code must
+// reference the table start or its high byte, or store the table
+// address into memory as a lo/hi byte pair. The unreferenced pointer
+// tables are reported as warnings.
+func (prg *Prg) detectTables(ptrs bool) {
+	cfg, err := prg.CFG()
+	if err != nil {
+		return
+	}
+	xref, err := prg.XRef()
+	if err != nil {
+		return
+	}
+	splits := immPointers(cfg)
+
+	for pc := 0; pc < len(prg.Data); pc++ {
+		if prg.SegTypes[pc] != SegData {
+			continue
+		}
+		addr := prg.DataToMem(pc)
+		referenced := len(xref.To(addr)) > 0 || len(xref.To(addr+1)) > 0 ||
+			splits[addr]
+		if !referenced && !ptrs {
+			continue
+		}
+		var count int
+		distinct := make(map[uint16]bool)
+		for i := pc; i+1 < len(prg.Data); i += 2 {
+			if prg.SegTypes[i] != SegData || prg.SegTypes[i+1] != SegData {
+				break
+			}
+			addr := bo.Uint16(prg.Data[i:])
+			if _, err := prg.MemToData(addr); err != nil {
+				break
+			}
+			if ptrs && !prg.isCode(addr) {
+				break
+			}
+			count++
+			distinct[addr] = true
+		}
+		if len(distinct) < minTableLen {
+			continue
+		}
+		if !referenced {
+			prg.warn(WarnTable, addr, "possible pointer table of %d entries",
+				count)
+			pc += count*2 - 1
+			continue
+		}
+		t := SegWord
+		if ptrs {
+			t = SegPtr
+		}
+		prg.markData(pc, pc+count*2, t)
+		pc += count*2 - 1
+	}
+}
+
+// immPointers returns the addresses the code stores into memory as
+// lo/hi pairs of immediate values.
+func immPointers(cfg *CFG) map[uint16]bool {
+	result := make(map[uint16]bool)
+	for _, bb := range cfg.Blocks {
+		var regs [3]int
+		for i := range regs {
+			regs[i] = -1
+		}
+		mem := make(map[uint16]byte)
+		for _, instr := range bb.Instrs {
+			reg := -1
+			switch instr.Op {
+			case mos6510.OpLDAimm:
+				regs[regA] = int(instr.Arg)
+				continue
+			case mos6510.OpLDXimm:
+				regs[regX] = int(instr.Arg)
+				continue
+			case mos6510.OpLDYimm:
+				regs[regY] = int(instr.Arg)
+				continue
+			case mos6510.OpSTAabs, mos6510.OpSTAzp:
+				reg = regA
+			case mos6510.OpSTXabs, mos6510.OpSTXzp:
+				reg = regX
+			case mos6510.OpSTYabs, mos6510.OpSTYzp:
+				reg = regY
+			case mos6510.OpJSRabs:
+				for i := range regs {
+					regs[i] = -1
+				}
+				continue
+			}
+			if reg < 0 {
+				for i, name := range regNames {
+					if writesReg(instr.Op, name) {
+						regs[i] = -1
+					}
+				}
+				continue
+			}
+			if regs[reg] < 0 {
+				delete(mem, instr.Arg)
+				continue
+			}
+			mem[instr.Arg] = byte(regs[reg])
+			for _, lo := range []uint16{instr.Arg - 1, instr.Arg} {
+				l, ok1 := mem[lo]
+				h, ok2 := mem[lo+1]
+				if ok1 && ok2 {
+					result[uint16(h)<<8|uint16(l)] = true
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (prg *Prg) printText(from, to int, label string, screen bool) {
+	for from < to {
+		end := min(from+32, to)
+		var str string
+		for i := from; i < end; i++ {
+			code := prg.Data[i]
+			if screen {
+				code = petscii.ScreenToPETSCII(code)
+			}
+			if code == '"' {
+				str += "{$22}"
+			} else {
+				str += petscii.Escape(code, petscii.Shifted)
+			}
+		}
+		fmt.Printf("%04X: %s \"%s\"\n", prg.DataToMem(from), label, str)
+		from = end
+	}
+}
+
+func (prg *Prg) printWords(from, to int, label string) int {
+	for from+1 < to {
+		end := min(from+8, to-(to-from)%2)
+		var args []string
+		for i := from; i < end; i += 2 {
+			args = append(args, fmt.Sprintf("$%04X", bo.Uint16(prg.Data[i:])))
+		}
+		fmt.Printf("%04X: %s %s\n", prg.DataToMem(from), label,
+			strings.Join(args, ", "))
+		from = end
+	}
+	return from
+}
+
+func (prg *Prg) printBitmap(from, to, width int) {
+	for from < to {
+		end := min(from+width, to)
+		var args []string
+		var bits string
+		for i := from; i < end; i++ {
+			args = append(args, fmt.Sprintf("$%02X", prg.Data[i]))
+			for bit := 7; bit >= 0; bit-- {
+				if prg.Data[i]&(1<<bit) != 0 {
+					bits += "#"
+				} else {
+					bits += "."
+				}
+			}
+		}
+		fmt.Printf("%04X: .byte %s\t; %s\n", prg.DataToMem(from),
+			strings.Join(args, ","), bits)
+		from = end
+	}
+}
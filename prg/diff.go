@@ -0,0 +1,699 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+// DiffStatus specifies how a routine or data segment changed between
+// two programs.
+type DiffStatus byte
+
+// Diff statuses.
+const (
+	DiffSame DiffStatus = iota
+	DiffMoved
+	DiffChanged
+	DiffAdded
+	DiffRemoved
+)
+
+var diffStatuses = map[DiffStatus]string{
+	DiffSame:    "same",
+	DiffMoved:   "moved",
+	DiffChanged: "changed",
+	DiffAdded:   "added",
+	DiffRemoved: "removed",
+}
+
+func (s DiffStatus) String() string {
+	name, ok := diffStatuses[s]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{DiffStatus %d}", s)
+}
+
+// DiffLine defines a line of an instruction diff. The Op is ' ' for
+// unchanged instructions, '-' for instructions removed from the first
+// program, and '+' for instructions added in the second program. A
+// and B are the instructions in the first and second programs.
+type DiffLine struct {
+	Op byte
+	A  Instr
+	B  Instr
+}
+
+func (l DiffLine) String() string {
+	switch l.Op {
+	case '-':
+		return fmt.Sprintf("-%04X      %v", l.A.Addr, l.A)
+	case '+':
+		return fmt.Sprintf("+     %04X %v", l.B.Addr, l.B)
+	default:
+		return fmt.Sprintf(" %04X %04X %v", l.A.Addr, l.B.Addr, l.B)
+	}
+}
+
+// RoutineDiff defines the differences of a routine between two
+// programs. For added routines, only the B fields are set and for
+// removed routines, only the A fields are set.
+type RoutineDiff struct {
+	Status DiffStatus
+	NameA  string
+	NameB  string
+	EntryA uint16
+	EntryB uint16
+	Lines  []DiffLine
+}
+
+// DataDiff defines the differences of a data segment between two
+// programs.
+type DataDiff struct {
+	Status DiffStatus
+	Type   SegType
+	AddrA  uint16
+	AddrB  uint16
+	SizeA  int
+	SizeB  int
+}
+
+// Diff defines the semantic differences between two programs.
+type Diff struct {
+	A        *Prg
+	B        *Prg
+	Routines []RoutineDiff
+	Data     []DataDiff
+}
+
+// diffRoutine holds a routine's basic blocks for the diff. The norm
+// holds the instructions with the absolute addresses inside the
+// program masked and it is used for pairing the routines.
+type diffRoutine struct {
+	name   string
+	entry  uint16
+	blocks []*diffBlock
+	norm   []string
+	key    string
+}
+
+// diffBlock holds a basic block's instructions for the diff. The syms
+// holds the instructions with the addresses inside the program
+// replaced with their symbolic locations and the key holds the joined
+// syms.
+type diffBlock struct {
+	instrs []Instr
+	syms   []string
+	key    string
+}
+
+// Compare computes the semantic differences between the programs a
+// and b. The routines are paired by their labels, by identical code,
+// by their offsets from the load addresses, and by code similarity,
+// so moved and relocated code is matched. The paired routines are
+// aligned by their basic blocks and the instructions are compared
+// with the absolute addresses inside the programs replaced with
+// their locations in the paired routines and data segments, so
+// changed call and data targets are reported.
+func Compare(a, b *Prg) (*Diff, error) {
+	ra, err := a.diffRoutines()
+	if err != nil {
+		return nil, err
+	}
+	rb, err := b.diffRoutines()
+	if err != nil {
+		return nil, err
+	}
+	diff := &Diff{
+		A: a,
+		B: b,
+	}
+
+	pairs := make(map[*diffRoutine]*diffRoutine)
+	used := make(map[*diffRoutine]bool)
+	match := func(pred func(x, y *diffRoutine) bool) {
+		for _, x := range ra {
+			if pairs[x] != nil {
+				continue
+			}
+			for _, y := range rb {
+				if !used[y] && pred(x, y) {
+					pairs[x] = y
+					used[y] = true
+					break
+				}
+			}
+		}
+	}
+	match(func(x, y *diffRoutine) bool {
+		return a.Labels[x.entry] != "" && a.Labels[x.entry] == b.Labels[y.entry]
+	})
+	match(func(x, y *diffRoutine) bool {
+		return x.key == y.key
+	})
+	match(func(x, y *diffRoutine) bool {
+		return x.entry-a.Load == y.entry-b.Load &&
+			similarity(x.norm, y.norm) >= 0.5
+	})
+	match(func(x, y *diffRoutine) bool {
+		return similarity(x.norm, y.norm) >= 0.5
+	})
+
+	sa := a.dataSegments()
+	sb := b.dataSegments()
+	dataPairs := pairData(a, b, sa, sb)
+
+	// Name the program locations by the routine and data pairs.
+	symsA := newDiffSyms(a)
+	symsB := newDiffSyms(b)
+	for i, x := range ra {
+		if y := pairs[x]; y != nil {
+			symsA.addRoutine(x, fmt.Sprintf("r%d", i))
+			symsB.addRoutine(y, fmt.Sprintf("r%d", i))
+		} else {
+			symsA.addRoutine(x, fmt.Sprintf("-r%d", i))
+		}
+	}
+	for j, y := range rb {
+		if !used[y] {
+			symsB.addRoutine(y, fmt.Sprintf("+r%d", j))
+		}
+	}
+	for i, x := range sa {
+		if j, ok := dataPairs[i]; ok {
+			symsA.addData(x, fmt.Sprintf("d%d", i))
+			symsB.addData(sb[j], fmt.Sprintf("d%d", i))
+		} else {
+			symsA.addData(x, fmt.Sprintf("-d%d", i))
+		}
+	}
+	for j, y := range sb {
+		if !dataUsed(dataPairs, j) {
+			symsB.addData(y, fmt.Sprintf("+d%d", j))
+		}
+	}
+	for _, x := range ra {
+		symsA.symbolize(x)
+	}
+	for _, y := range rb {
+		symsB.symbolize(y)
+	}
+
+	for _, x := range ra {
+		y := pairs[x]
+		if y == nil {
+			diff.Routines = append(diff.Routines, RoutineDiff{
+				Status: DiffRemoved,
+				NameA:  x.name,
+				EntryA: x.entry,
+			})
+			continue
+		}
+		rd := RoutineDiff{
+			NameA:  x.name,
+			NameB:  y.name,
+			EntryA: x.entry,
+			EntryB: y.entry,
+			Lines:  diffBlocks(x, y),
+		}
+		switch {
+		case x.symKey() != y.symKey():
+			rd.Status = DiffChanged
+		case x.entry-a.Load != y.entry-b.Load:
+			rd.Status = DiffMoved
+		default:
+			rd.Status = DiffSame
+		}
+		diff.Routines = append(diff.Routines, rd)
+	}
+	for _, y := range rb {
+		if !used[y] {
+			diff.Routines = append(diff.Routines, RoutineDiff{
+				Status: DiffAdded,
+				NameB:  y.name,
+				EntryB: y.entry,
+			})
+		}
+	}
+	diff.Data = compareData(a, b, sa, sb, dataPairs)
+
+	return diff, nil
+}
+
+// diffRoutines returns the program's routines with their normalized
+// instructions.
+func (prg *Prg) diffRoutines() ([]*diffRoutine, error) {
+	cfg, err := prg.CFG()
+	if err != nil {
+		return nil, err
+	}
+	var result []*diffRoutine
+	for _, sub := range cfg.Subroutines {
+		r := &diffRoutine{
+			name:  sub.Name(),
+			entry: sub.Entry,
+		}
+		if label, ok := prg.Labels[sub.Entry]; ok {
+			r.name = label
+		}
+		blocks := append([]*BasicBlock(nil), sub.Blocks...)
+		sort.Slice(blocks, func(i, j int) bool {
+			return blocks[i].Start < blocks[j].Start
+		})
+		for _, bb := range blocks {
+			r.blocks = append(r.blocks, &diffBlock{
+				instrs: bb.Instrs,
+			})
+			for _, instr := range bb.Instrs {
+				r.norm = append(r.norm, prg.normalize(instr, nil))
+			}
+		}
+		r.key = strings.Join(r.norm, "\n")
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// symKey returns the routine's instructions with the symbolic
+// addresses.
+func (r *diffRoutine) symKey() string {
+	var keys []string
+	for _, b := range r.blocks {
+		keys = append(keys, b.key)
+	}
+	return strings.Join(keys, "\n")
+}
+
+// diffSyms names the program's addresses by their locations in the
+// routines and data segments.
+type diffSyms struct {
+	prg  *Prg
+	code map[uint16]string
+	data []diffSymRange
+}
+
+// diffSymRange defines a named data segment.
+type diffSymRange struct {
+	addr uint16
+	size int
+	name string
+}
+
+func newDiffSyms(prg *Prg) *diffSyms {
+	return &diffSyms{
+		prg:  prg,
+		code: make(map[uint16]string),
+	}
+}
+
+// addRoutine names the routine's instruction bytes by their offsets
+// from the routine entry.
+func (syms *diffSyms) addRoutine(r *diffRoutine, name string) {
+	for _, b := range r.blocks {
+		for _, instr := range b.instrs {
+			for i := 0; i < instr.Size(); i++ {
+				addr := instr.Addr + uint16(i)
+				if _, ok := syms.code[addr]; !ok {
+					syms.code[addr] = fmt.Sprintf("%s%+d", name,
+						int(addr)-int(r.entry))
+				}
+			}
+		}
+	}
+}
+
+// addData names the data segment's bytes by their offsets from the
+// segment start.
+func (syms *diffSyms) addData(seg dataSegment, name string) {
+	syms.data = append(syms.data, diffSymRange{
+		addr: seg.addr,
+		size: len(seg.data),
+		name: name,
+	})
+}
+
+// name returns the symbolic name of the address inside the program.
+// The addresses outside the routines and data segments are named by
+// their offsets from the load address.
+func (syms *diffSyms) name(addr uint16) string {
+	if name, ok := syms.code[addr]; ok {
+		return name
+	}
+	for _, r := range syms.data {
+		if addr >= r.addr && int(addr) < int(r.addr)+r.size {
+			return fmt.Sprintf("%s%+d", r.name, addr-r.addr)
+		}
+	}
+	return fmt.Sprintf("@%+d", addr-syms.prg.Load)
+}
+
+// symbolize sets the symbolic instructions of the routine's blocks.
+func (syms *diffSyms) symbolize(r *diffRoutine) {
+	for _, b := range r.blocks {
+		b.syms = nil
+		for _, instr := range b.instrs {
+			b.syms = append(b.syms, syms.prg.normalize(instr, syms))
+		}
+		b.key = strings.Join(b.syms, "\n")
+	}
+}
+
+// normalize returns the instruction in a form which does not depend
+// on the program's location in memory. The absolute addresses inside
+// the program are replaced with their symbolic names, or masked if
+// syms is nil. The relative branches are kept as their offsets.
+func (prg *Prg) normalize(instr Instr, syms *diffSyms) string {
+	switch instr.Op.AddrMode() {
+	case mos6510.AddrREL:
+		return fmt.Sprintf("%v *%+d", instr.Op, int8(instr.Arg))
+	case mos6510.AddrABS, mos6510.AddrABX, mos6510.AddrABY,
+		mos6510.AddrIND:
+		if _, err := prg.MemToData(instr.Arg); err == nil {
+			target := "@"
+			if syms != nil {
+				target = syms.name(instr.Arg)
+			}
+			operand := strings.Replace(instr.Operand(),
+				fmt.Sprintf("$%04X", instr.Arg), target, 1)
+			return instr.Op.String() + " " + operand
+		}
+	}
+	return instr.String()
+}
+
+// similarity returns the similarity of the normalized instruction
+// multisets in the range [0, 1].
+func similarity(a, b []string) float64 {
+	if len(a)+len(b) == 0 {
+		return 1
+	}
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	var common int
+	for _, s := range b {
+		if count[s] > 0 {
+			count[s]--
+			common++
+		}
+	}
+	return float64(2*common) / float64(len(a)+len(b))
+}
+
+// lcs returns the index pairs of the longest common subsequence of a
+// and b.
+func lcs(a, b []string) [][2]int {
+	n, m := len(a), len(b)
+	dp := make([][]int, n+1)
+	for i := range dp {
+		dp[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				dp[i][j] = dp[i+1][j+1] + 1
+			} else {
+				dp[i][j] = max(dp[i+1][j], dp[i][j+1])
+			}
+		}
+	}
+	var result [][2]int
+	for i, j := 0, 0; i < n && j < m; {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, [2]int{i, j})
+			i++
+			j++
+		case dp[i+1][j] >= dp[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return result
+}
+
+// diffBlocks computes the instruction diff of the paired routines.
+// The identical basic blocks are aligned first and the instructions
+// of the unaligned blocks between them are diffed.
+func diffBlocks(x, y *diffRoutine) []DiffLine {
+	var keysX, keysY []string
+	for _, b := range x.blocks {
+		keysX = append(keysX, b.key)
+	}
+	for _, b := range y.blocks {
+		keysY = append(keysY, b.key)
+	}
+	var result []DiffLine
+	var i, j int
+	for _, pair := range append(lcs(keysX, keysY),
+		[2]int{len(keysX), len(keysY)}) {
+		var gapX, gapY []Instr
+		var symsX, symsY []string
+		for ; i < pair[0]; i++ {
+			gapX = append(gapX, x.blocks[i].instrs...)
+			symsX = append(symsX, x.blocks[i].syms...)
+		}
+		for ; j < pair[1]; j++ {
+			gapY = append(gapY, y.blocks[j].instrs...)
+			symsY = append(symsY, y.blocks[j].syms...)
+		}
+		result = append(result, diffInstrs(gapX, gapY, symsX, symsY)...)
+
+		if i < len(x.blocks) && j < len(y.blocks) {
+			for k, instr := range x.blocks[i].instrs {
+				result = append(result, DiffLine{
+					Op: ' ',
+					A:  instr,
+					B:  y.blocks[j].instrs[k],
+				})
+			}
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// diffInstrs computes the diff of the instruction sequences a and b
+// with the symbolic instructions sa and sb.
+func diffInstrs(a, b []Instr, sa, sb []string) []DiffLine {
+	var result []DiffLine
+	var i, j int
+	for _, pair := range append(lcs(sa, sb), [2]int{len(sa), len(sb)}) {
+		for ; i < pair[0]; i++ {
+			result = append(result, DiffLine{
+				Op: '-',
+				A:  a[i],
+			})
+		}
+		for ; j < pair[1]; j++ {
+			result = append(result, DiffLine{
+				Op: '+',
+				B:  b[j],
+			})
+		}
+		if i < len(a) && j < len(b) {
+			result = append(result, DiffLine{
+				Op: ' ',
+				A:  a[i],
+				B:  b[j],
+			})
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// dataSegment defines a data segment for the diff.
+type dataSegment struct {
+	t    SegType
+	addr uint16
+	data []byte
+}
+
+func (prg *Prg) dataSegments() []dataSegment {
+	var result []dataSegment
+	for pc := 0; pc < len(prg.Data); {
+		end := prg.segEnd(pc)
+		if prg.SegTypes[pc] != SegCode {
+			result = append(result, dataSegment{
+				t:    prg.SegTypes[pc],
+				addr: prg.DataToMem(pc),
+				data: prg.Data[pc:end],
+			})
+		}
+		pc = end
+	}
+	return result
+}
+
+// pairData pairs the data segments of the programs. The segments are
+// paired by their types and contents, and then by their types and
+// offsets from the load addresses. The function returns the indices
+// of the paired segments of b, keyed by the indices of a.
+func pairData(a, b *Prg, sa, sb []dataSegment) map[int]int {
+	pairs := make(map[int]int)
+	used := make(map[int]bool)
+	match := func(pred func(x, y dataSegment) bool) {
+		for i, x := range sa {
+			if _, ok := pairs[i]; ok {
+				continue
+			}
+			for j, y := range sb {
+				if !used[j] && pred(x, y) {
+					pairs[i] = j
+					used[j] = true
+					break
+				}
+			}
+		}
+	}
+	match(func(x, y dataSegment) bool {
+		return x.t == y.t && string(x.data) == string(y.data)
+	})
+	match(func(x, y dataSegment) bool {
+		return x.t == y.t && x.addr-a.Load == y.addr-b.Load
+	})
+	return pairs
+}
+
+// dataUsed tests if the segment j of b is paired.
+func dataUsed(pairs map[int]int, j int) bool {
+	for _, v := range pairs {
+		if v == j {
+			return true
+		}
+	}
+	return false
+}
+
+// compareData compares the paired data segments of the programs.
+func compareData(a, b *Prg, sa, sb []dataSegment,
+	pairs map[int]int) []DataDiff {
+
+	var result []DataDiff
+	for i, x := range sa {
+		j, ok := pairs[i]
+		if !ok {
+			result = append(result, DataDiff{
+				Status: DiffRemoved,
+				Type:   x.t,
+				AddrA:  x.addr,
+				SizeA:  len(x.data),
+			})
+			continue
+		}
+		y := sb[j]
+		dd := DataDiff{
+			Type:  x.t,
+			AddrA: x.addr,
+			AddrB: y.addr,
+			SizeA: len(x.data),
+			SizeB: len(y.data),
+		}
+		switch {
+		case string(x.data) != string(y.data):
+			dd.Status = DiffChanged
+		case x.addr-a.Load != y.addr-b.Load:
+			dd.Status = DiffMoved
+		default:
+			dd.Status = DiffSame
+		}
+		result = append(result, dd)
+	}
+	for j, y := range sb {
+		if !dataUsed(pairs, j) {
+			result = append(result, DataDiff{
+				Status: DiffAdded,
+				Type:   y.t,
+				AddrB:  y.addr,
+				SizeB:  len(y.data),
+			})
+		}
+	}
+	return result
+}
+
+// diffContext specifies the number of unchanged instructions shown
+// around the changes.
+const diffContext = 3
+
+// Print prints the differences in the unified diff style. The
+// unchanged routines and data segments are omitted.
+func (diff *Diff) Print(w io.Writer, nameA, nameB string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\t$%04X-$%04X\n", nameA,
+		diff.A.Load, int(diff.A.Load)+len(diff.A.Data))
+	fmt.Fprintf(&buf, "+++ %s\t$%04X-$%04X\n", nameB,
+		diff.B.Load, int(diff.B.Load)+len(diff.B.Data))
+
+	for _, rd := range diff.Routines {
+		switch rd.Status {
+		case DiffAdded:
+			fmt.Fprintf(&buf, "@@ +%s $%04X @@ added routine\n",
+				rd.NameB, rd.EntryB)
+		case DiffRemoved:
+			fmt.Fprintf(&buf, "@@ -%s $%04X @@ removed routine\n",
+				rd.NameA, rd.EntryA)
+		case DiffMoved:
+			fmt.Fprintf(&buf, "@@ -%s $%04X +%s $%04X @@ moved routine\n",
+				rd.NameA, rd.EntryA, rd.NameB, rd.EntryB)
+		case DiffChanged:
+			fmt.Fprintf(&buf, "@@ -%s $%04X +%s $%04X @@\n",
+				rd.NameA, rd.EntryA, rd.NameB, rd.EntryB)
+			printHunks(&buf, rd.Lines)
+		}
+	}
+	for _, dd := range diff.Data {
+		switch dd.Status {
+		case DiffAdded:
+			fmt.Fprintf(&buf, "@@ +%v $%04X (%d bytes) @@ added data\n",
+				dd.Type, dd.AddrB, dd.SizeB)
+		case DiffRemoved:
+			fmt.Fprintf(&buf, "@@ -%v $%04X (%d bytes) @@ removed data\n",
+				dd.Type, dd.AddrA, dd.SizeA)
+		case DiffMoved, DiffChanged:
+			fmt.Fprintf(&buf, "@@ -%v $%04X (%d bytes) +%v $%04X (%d bytes) @@ %v data\n",
+				dd.Type, dd.AddrA, dd.SizeA, dd.Type, dd.AddrB, dd.SizeB,
+				dd.Status)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// printHunks prints the changed lines with their context.
+func printHunks(w io.Writer, lines []DiffLine) {
+	show := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.Op == ' ' {
+			continue
+		}
+		for j := max(0, i-diffContext); j < min(len(lines), i+diffContext+1); j++ {
+			show[j] = true
+		}
+	}
+	for i, l := range lines {
+		if !show[i] {
+			if i > 0 && show[i-1] {
+				fmt.Fprintln(w, " ...")
+			}
+			continue
+		}
+		fmt.Fprintln(w, l)
+	}
+}
@@ -0,0 +1,290 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+// DefaultEmulateCycles specifies the default cycle limit of the
+// emulation.
+const DefaultEmulateCycles = 1000000
+
+// emuExit is the return address of the emulated program. The
+// program exits when it returns to the address.
+const emuExit = 0xfff0
+
+// Stop reasons of the emulation.
+const (
+	StopCycles = "cycles"
+	StopExit   = "exit"
+	StopHalt   = "halt"
+)
+
+// EmulateOptions define options for the emulation.
+type EmulateOptions struct {
+	// Start specifies the emulation start address. If zero, the
+	// emulation starts from the program start address.
+	Start uint16
+
+	// MaxCycles limits the number of emulated cycles. If zero,
+	// DefaultEmulateCycles is used.
+	MaxCycles uint64
+}
+
+// Trace defines the result of an emulation run. Executed lists the
+// addresses of the executed instructions inside the program. Jumps
+// holds the observed targets of the indirect jumps, indexed by the
+// jump instruction address. Stop specifies why the emulation stopped
+// and PC is the address where it stopped.
+type Trace struct {
+	Executed []uint16
+	Jumps    map[uint16][]uint16
+	Cycles   uint64
+	Stop     string
+	PC       uint16
+}
+
+// c64Memory implements a headless C64 memory map for the emulation.
+// The raster counter advances with the CPU cycles and the keyboard
+// has no keys pressed. The memory tracks the written addresses.
+type c64Memory struct {
+	mos6510.RAM
+	cpu     *mos6510.CPU
+	written [0x10000]bool
+}
+
+func (mem *c64Memory) Read(addr uint16) byte {
+	switch addr {
+	case 0xd011:
+		line := mem.cpu.Cycles / CyclesPerLinePAL % 312
+		return mem.RAM[addr]&0x7f | byte(line>>1)&0x80
+	case 0xd012:
+		return byte(mem.cpu.Cycles / CyclesPerLinePAL % 312)
+	case 0xdc00, 0xdc01:
+		return 0xff
+	}
+	return mem.RAM[addr]
+}
+
+func (mem *c64Memory) Write(addr uint16, val byte) {
+	mem.RAM[addr] = val
+	mem.written[addr] = true
+}
+
+// writtenBlock returns the contiguous block [from, to) of written
+// memory containing the address.
+func (mem *c64Memory) writtenBlock(addr uint16) (int, int) {
+	from := int(addr)
+	for from > 0 && mem.written[from-1] {
+		from--
+	}
+	to := int(addr)
+	for to < len(mem.written) && mem.written[to] {
+		to++
+	}
+	return from, to
+}
+
+// romAddr tests if the address is in the BASIC or KERNAL ROM.
+func romAddr(addr uint16) bool {
+	return (addr >= 0xa000 && addr < 0xc000) || addr >= 0xe000
+}
+
+// emulator runs the program in a headless C64 memory map.
+type emulator struct {
+	prg  *Prg
+	mem  *c64Memory
+	cpu  *mos6510.CPU
+	call bool
+}
+
+// newEmulator creates an emulator for the program, starting from the
+// address. If the address is zero, the emulation starts from the
+// program start address.
+func (prg *Prg) newEmulator(start uint16) (*emulator, error) {
+	if start == 0 {
+		start = prg.Start
+	}
+	if _, err := prg.MemToData(start); err != nil {
+		return nil, err
+	}
+	mem := new(c64Memory)
+	copy(mem.RAM[prg.Load:], prg.Data)
+	mem.RAM[0x01] = 0x37
+	cpu := mos6510.NewCPU(mem)
+	mem.cpu = cpu
+
+	ret := uint16(emuExit - 1)
+	cpu.Push(byte(ret >> 8))
+	cpu.Push(byte(ret))
+	cpu.PC = start
+
+	return &emulator{
+		prg: prg,
+		mem: mem,
+		cpu: cpu,
+	}, nil
+}
+
+// step executes the next instruction or ROM stub. It returns the stop
+// reason if the emulation stops, and the executed opcode.
+func (emu *emulator) step() (string, mos6510.Opcode, error) {
+	cpu := emu.cpu
+	pc := cpu.PC
+	if _, err := emu.prg.MemToData(pc); err != nil && romAddr(pc) {
+		if !emu.call {
+			return StopExit, 0, nil
+		}
+		kernalStub(cpu, pc)
+		lo := cpu.Pull()
+		hi := cpu.Pull()
+		cpu.PC = (uint16(hi)<<8 | uint16(lo)) + 1
+		emu.call = false
+		return "", mos6510.OpRTS, nil
+	}
+	op := mos6510.Opcode(emu.mem.RAM[pc])
+	_, err := cpu.Step()
+	if err != nil {
+		var halt *mos6510.HaltError
+		if errors.As(err, &halt) {
+			return StopHalt, op, nil
+		}
+		return "", op, err
+	}
+	emu.call = op == mos6510.OpJSRabs
+	return "", op, nil
+}
+
+// Emulate runs the program in the CPU emulator for a bounded number
+// of cycles and records the executed instructions. The calls into the
+// BASIC and KERNAL ROMs are stubbed: they return immediately with the
+// carry flag clear. The stubbed GETIN returns no key and CHRIN
+// returns a carriage return. The emulation stops when the program
+// jumps or returns into the ROMs, halts, or exceeds the cycle limit.
+func (prg *Prg) Emulate(opts EmulateOptions) (*Trace, error) {
+	emu, err := prg.newEmulator(opts.Start)
+	if err != nil {
+		return nil, err
+	}
+	maxCycles := opts.MaxCycles
+	if maxCycles == 0 {
+		maxCycles = DefaultEmulateCycles
+	}
+
+	trace := &Trace{
+		Jumps: make(map[uint16][]uint16),
+	}
+	executed := make(map[uint16]bool)
+
+	for emu.cpu.Cycles < maxCycles {
+		pc := emu.cpu.PC
+		ofs, err := prg.MemToData(pc)
+		inside := err == nil
+		if inside && prg.Data[ofs] == emu.mem.RAM[pc] {
+			// Record only instructions whose opcodes are not
+			// modified by the program.
+			executed[pc] = true
+		}
+		stop, op, err := emu.step()
+		if err != nil {
+			return nil, err
+		}
+		if len(stop) > 0 {
+			trace.Stop = stop
+			break
+		}
+		if op == mos6510.OpJMPind && inside {
+			trace.addJump(pc, emu.cpu.PC)
+		}
+	}
+	if len(trace.Stop) == 0 {
+		trace.Stop = StopCycles
+	}
+	trace.Cycles = emu.cpu.Cycles
+	trace.PC = emu.cpu.PC
+
+	for addr := range executed {
+		trace.Executed = append(trace.Executed, addr)
+	}
+	sort.Slice(trace.Executed, func(i, j int) bool {
+		return trace.Executed[i] < trace.Executed[j]
+	})
+	return trace, nil
+}
+
+func (trace *Trace) addJump(from, to uint16) {
+	for _, t := range trace.Jumps[from] {
+		if t == to {
+			return
+		}
+	}
+	trace.Jumps[from] = append(trace.Jumps[from], to)
+}
+
+// kernalStub emulates the result of the ROM routine at the address.
+func kernalStub(cpu *mos6510.CPU, addr uint16) {
+	switch addr {
+	case 0xffe4: // GETIN
+		cpu.A = 0
+	case 0xffcf: // CHRIN
+		cpu.A = 0x0d
+	}
+	cpu.SetFlag(mos6510.FlagC, false)
+}
+
+// MergeTrace merges the executed instructions of the trace into the
+// code analysis. The executed instructions not reached by the static
+// analysis are recorded into Dynamic and parsed as code entry points.
+func (prg *Prg) MergeTrace(trace *Trace) error {
+	if prg.starts == nil {
+		return fmt.Errorf("program code not parsed")
+	}
+	var dynamic []uint16
+	for _, addr := range trace.Executed {
+		ofs, err := prg.MemToData(addr)
+		if err != nil || prg.starts[ofs] {
+			continue
+		}
+		dynamic = append(dynamic, addr)
+	}
+	for _, addr := range dynamic {
+		if prg.InstrStart(addr) {
+			continue
+		}
+		if err := prg.parseCodeFromAddr(addr); err != nil {
+			return err
+		}
+	}
+	if prg.Indirect == nil {
+		prg.Indirect = make(map[uint16][]uint16)
+	}
+	for from, targets := range trace.Jumps {
+	next:
+		for _, target := range targets {
+			if !prg.isCode(target) {
+				continue
+			}
+			for _, t := range prg.Indirect[from] {
+				if t == target {
+					continue next
+				}
+			}
+			prg.Indirect[from] = append(prg.Indirect[from], target)
+			prg.invalidate()
+		}
+	}
+	prg.Dynamic = append(prg.Dynamic, dynamic...)
+	sort.Slice(prg.Dynamic, func(i, j int) bool {
+		return prg.Dynamic[i] < prg.Dynamic[j]
+	})
+	return prg.resolveAll()
+}
@@ -0,0 +1,120 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"fmt"
+)
+
+// ErrorKind specifies the program parse error types.
+type ErrorKind byte
+
+// Parse error kinds.
+const (
+	// The program data is too short.
+	ErrShort ErrorKind = iota
+
+	// The program does not fit into memory.
+	ErrSize
+
+	// Invalid BASIC program.
+	ErrBasic
+
+	// Invalid or missing code entry point.
+	ErrEntry
+
+	// Invalid forced segment.
+	ErrSegment
+
+	// Invalid code.
+	ErrCode
+
+	// Emulation failed.
+	ErrEmulate
+)
+
+var errorKinds = map[ErrorKind]string{
+	ErrShort:   "short",
+	ErrSize:    "size",
+	ErrBasic:   "basic",
+	ErrEntry:   "entry",
+	ErrSegment: "segment",
+	ErrCode:    "code",
+	ErrEmulate: "emulate",
+}
+
+func (k ErrorKind) String() string {
+	name, ok := errorKinds[k]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{ErrorKind %d}", k)
+}
+
+// ParseError defines a fatal program parse error. Offset is the PRG
+// file offset of the error, including the two-byte load address, or
+// -1 if the error is not at a file position. Addr is the memory
+// address of the error.
+type ParseError struct {
+	Kind   ErrorKind
+	Offset int
+	Addr   uint16
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("$%04X: %v: %s", e.Addr, e.Kind, e.Msg)
+	}
+	return fmt.Sprintf("$%04X (offset %d): %v: %s", e.Addr, e.Offset, e.Kind,
+		e.Msg)
+}
+
+// errorf creates a parse error at the data offset.
+func (prg *Prg) errorf(kind ErrorKind, ofs int, format string,
+	a ...interface{}) *ParseError {
+
+	return &ParseError{
+		Kind:   kind,
+		Offset: ofs + 2,
+		Addr:   prg.DataToMem(ofs),
+		Msg:    fmt.Sprintf(format, a...),
+	}
+}
+
+// addrErrorf creates a parse error at the memory address. If the
+// address is inside the program, the error has its file offset.
+func (prg *Prg) addrErrorf(kind ErrorKind, addr uint16, format string,
+	a ...interface{}) *ParseError {
+
+	if ofs, err := prg.MemToData(addr); err == nil {
+		return prg.errorf(kind, ofs, format, a...)
+	}
+	return &ParseError{
+		Kind:   kind,
+		Offset: -1,
+		Addr:   addr,
+		Msg:    fmt.Sprintf(format, a...),
+	}
+}
+
+// warn adds a parse warning at the memory address.
+func (prg *Prg) warn(kind WarningKind, addr uint16, format string,
+	a ...interface{}) {
+
+	w := Warning{
+		Addr:    addr,
+		Kind:    kind,
+		Message: fmt.Sprintf(format, a...),
+	}
+	for _, old := range prg.Warnings {
+		if old == w {
+			return
+		}
+	}
+	prg.Warnings = append(prg.Warnings, w)
+}
@@ -0,0 +1,289 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+
+	"github.com/markkurossi/mpc64/mos6510"
+	"github.com/markkurossi/mpc64/petscii"
+)
+
+// htmlStyle defines the style sheet of the HTML report.
+const htmlStyle = `body { font-family: monospace; background: #fdfdf8; color: #222; }
+h1 { font-size: 1.2em; }
+table.lines { border-collapse: collapse; }
+table.lines td { padding: 0 0.8em 0 0; white-space: pre; vertical-align: top; }
+tr:target { background: #ffe9a8; }
+td.addr { color: #888; }
+td.bytes { color: #777; }
+td.label { color: #0a5c8a; font-weight: bold; padding-top: 0.6em; }
+td.xrefs { color: #888; padding-top: 0.6em; }
+td.comment { color: #3a7d3a; }
+td.petscii { color: #7a4a9a; }
+span.op { text-decoration: underline dotted #aaa; cursor: help; }
+a { color: #0a5c8a; text-decoration: none; }
+a:hover { text-decoration: underline; }
+ul.warnings { color: #a33; }
+`
+
+// htmlAnchor returns the HTML anchor ID of the address.
+func htmlAnchor(addr uint16) string {
+	return fmt.Sprintf("a_%04X", addr)
+}
+
+// htmlOpTitle returns the mouseover text of the opcode: its
+// addressing mode, cycles, and flags.
+func htmlOpTitle(op mos6510.Opcode) string {
+	info := mos6510.Instructions[op]
+	title := fmt.Sprintf("$%02X %s", byte(op), info.Name)
+	if mode := info.Addr.String(); len(mode) > 0 {
+		title += " " + mode
+	}
+	if info.Cycles > 0 {
+		title += fmt.Sprintf(", %d cycles", info.Cycles)
+		if info.PageBoundary {
+			title += " (+1 on page cross)"
+		}
+	}
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{info.Data, "data"},
+		{info.Read, "read"},
+		{info.Write, "write"},
+		{info.Jump, "jump"},
+		{info.BlockEnd, "block end"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	if len(flags) > 0 {
+		title += ", " + strings.Join(flags, ", ")
+	}
+	return title
+}
+
+// HTML writes the disassembly as a self-contained HTML document. The
+// operands with labels link to the label definitions, the
+// cross-references are listed beside the labels, and the data
+// segments are shown as hex and PETSCII. The opcodes show their
+// cycles and flags on mouseover.
+func (prg *Prg) HTML(w io.Writer) error {
+	a, err := prg.Analysis()
+	if err != nil {
+		return err
+	}
+	xref, err := prg.XRef()
+	if err != nil {
+		return err
+	}
+	labels := make(map[uint16]string)
+	for _, label := range a.Labels {
+		labels[label.Addr] = label.Name
+	}
+	instrs := make(map[uint16]InstrInfo)
+	for _, info := range a.Instructions {
+		instrs[info.Addr] = info
+	}
+	end := int(prg.Load) + len(prg.Data) - 1
+
+	var buf bytes.Buffer
+	esc := html.EscapeString
+	link := func(addr uint16, text string) string {
+		return fmt.Sprintf(`<a href="#%s">%s</a>`, htmlAnchor(addr), esc(text))
+	}
+
+	title := fmt.Sprintf("Disassembly $%04X-$%04X", prg.Load, end)
+	fmt.Fprintf(&buf, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+%s</style>
+</head>
+<body>
+<h1>%s</h1>
+`, title, htmlStyle, title)
+
+	fmt.Fprintf(&buf, "<p>Start: %s<br>\nEntries:", link(a.Start,
+		fmt.Sprintf("$%04X", a.Start)))
+	for _, entry := range a.Entries {
+		fmt.Fprintf(&buf, " %s", link(entry, fmt.Sprintf("$%04X", entry)))
+	}
+	buf.WriteString("</p>\n")
+
+	if len(a.Warnings) > 0 {
+		buf.WriteString("<ul class=\"warnings\">\n")
+		for _, warning := range a.Warnings {
+			fmt.Fprintf(&buf, "<li>%s: %s</li>\n",
+				link(warning.Addr, fmt.Sprintf("$%04X", warning.Addr)),
+				esc(warning.Message))
+		}
+		buf.WriteString("</ul>\n")
+	}
+
+	buf.WriteString("<table class=\"lines\">\n")
+
+	// labelRow writes the label definition of the address and its
+	// cross-references. If the address is inside the instruction at
+	// the address at, the label is defined relative to the
+	// instruction and the row holds the label's anchor.
+	labelRow := func(addr, at uint16) {
+		name, ok := labels[addr]
+		if !ok {
+			return
+		}
+		var refs []string
+		for _, ref := range xref.To(addr) {
+			refs = append(refs, fmt.Sprintf("%s %s",
+				link(ref.Instr.Addr, fmt.Sprintf("$%04X", ref.Instr.Addr)),
+				ref.Kind))
+		}
+		var xrefs string
+		if len(refs) > 0 {
+			xrefs = "; xrefs: " + strings.Join(refs, ", ")
+		}
+		if addr == at {
+			fmt.Fprintf(&buf,
+				"<tr><td></td><td></td><td class=\"label\" colspan=\"2\">%s:</td><td class=\"xrefs\">%s</td></tr>\n",
+				esc(name), xrefs)
+		} else {
+			fmt.Fprintf(&buf,
+				"<tr id=\"%s\"><td></td><td></td><td class=\"label\" colspan=\"2\">%s = *+%d</td><td class=\"xrefs\">%s</td></tr>\n",
+				htmlAnchor(addr), esc(name), addr-at, xrefs)
+		}
+	}
+	// dataRows writes the data bytes [from, to) as hex and PETSCII.
+	dataRows := func(from, to int, t SegType) {
+		for from < to {
+			labelRow(prg.DataToMem(from), prg.DataToMem(from))
+			next := min(from+8, to)
+			for i := from + 1; i < next; i++ {
+				if _, ok := labels[prg.DataToMem(i)]; ok {
+					next = i
+					break
+				}
+			}
+			var hex []string
+			var str string
+			for i := from; i < next; i++ {
+				b := prg.Data[i]
+				hex = append(hex, fmt.Sprintf("$%02X", b))
+				if t == SegScreen {
+					b = petscii.ScreenToPETSCII(b)
+				}
+				r := petscii.Shifted[b]
+				if r == 0 {
+					r = '.'
+				}
+				str += string(r)
+			}
+			fmt.Fprintf(&buf,
+				"<tr id=\"%s\"><td class=\"addr\">%04X</td><td></td><td>.byte</td><td>%s</td><td class=\"petscii\">%s</td></tr>\n",
+				htmlAnchor(prg.DataToMem(from)), prg.DataToMem(from),
+				strings.Join(hex, ","), esc(str))
+			from = next
+		}
+	}
+
+	var pc int
+	if len(prg.SegTypes) > 0 && prg.SegTypes[0] == SegAddr {
+		lines, basicEnd, err := prg.BasicLines()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Fprintf(&buf,
+				"<tr id=\"%s\"><td class=\"addr\">%04X</td><td></td><td colspan=\"3\">%s</td></tr>\n",
+				htmlAnchor(line.Addr), line.Addr, esc(line.String()))
+		}
+		pc = basicEnd
+	}
+
+	for pc < len(prg.Data) {
+		addr := prg.DataToMem(pc)
+		if prg.SegTypes[pc] != SegCode {
+			to := prg.segEnd(pc)
+			dataRows(pc, to, prg.SegTypes[pc])
+			pc = to
+			continue
+		}
+		info, ok := instrs[addr]
+		if !ok {
+			dataRows(pc, pc+1, SegCode)
+			pc++
+			continue
+		}
+		size := prg.overlapEnd(pc) - pc
+		if size < info.Size {
+			// The instruction overlaps the next instruction.
+			dataRows(pc, pc+size, SegCode)
+			pc += size
+			continue
+		}
+		labelRow(addr, addr)
+		for i := 1; i < info.Size; i++ {
+			labelRow(addr+uint16(i), addr)
+		}
+
+		var hex []string
+		for i := 0; i < info.Size; i++ {
+			hex = append(hex, fmt.Sprintf("%02X", prg.Data[pc+i]))
+		}
+		operand := esc(info.Operand)
+		if mos6510.Opcode(info.Opcode).AddrMode() == mos6510.AddrREL {
+			// Branches are linked to their target addresses.
+			operand = fmt.Sprintf("$%04X", info.Target)
+		}
+		ref, hasRef := info.Target, info.Target != 0
+		if !hasRef {
+			switch mos6510.Opcode(info.Opcode).AddrMode() {
+			case mos6510.AddrImp, mos6510.AddrIMM, mos6510.AddrREL:
+			default:
+				ref, hasRef = info.Arg, true
+			}
+		}
+		if name, ok := labels[ref]; ok && hasRef {
+			var text string
+			if ref > 0xff || info.Size == 3 {
+				text = fmt.Sprintf("$%04X", ref)
+			} else {
+				text = fmt.Sprintf("$%02X", ref)
+			}
+			// Only the addresses inside the program have anchors.
+			if _, err := prg.MemToData(ref); err == nil {
+				name = link(ref, name)
+			} else {
+				name = esc(name)
+			}
+			operand = strings.Replace(operand, text, name, 1)
+		}
+		var comment string
+		if len(info.Comment) > 0 {
+			comment = "; " + esc(info.Comment)
+		}
+		fmt.Fprintf(&buf,
+			"<tr id=\"%s\"><td class=\"addr\">%04X</td><td class=\"bytes\">%s</td><td><span class=\"op\" title=\"%s\">%s</span></td><td>%s</td><td class=\"comment\">%s</td></tr>\n",
+			htmlAnchor(addr), addr, strings.Join(hex, " "),
+			esc(htmlOpTitle(mos6510.Opcode(info.Opcode))), info.Name,
+			operand, comment)
+		pc += info.Size
+	}
+
+	buf.WriteString("</table>\n</body>\n</html>\n")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,307 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"sort"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+// Vectors define the well-known interrupt and KERNAL vectors. The
+// handlers stored into the vectors are code entry points.
+var Vectors = map[uint16]string{
+	0x0314: "CINV",
+	0x0316: "CBINV",
+	0x0318: "NMINV",
+	0xfffa: "NMI",
+	0xfffc: "RESET",
+	0xfffe: "IRQ",
+}
+
+// valueKind specifies the kind of a tracked register or memory
+// value.
+type valueKind byte
+
+const (
+	valUnknown valueKind = iota
+	valImm
+	valTable
+)
+
+// value defines a register or memory value tracked by the indirect
+// jump resolution. The value is an immediate value or a value loaded
+// from a table indexed with the X or Y register.
+type value struct {
+	kind  valueKind
+	imm   byte
+	table uint16
+	index byte
+}
+
+// Register indices for the value tracking.
+const (
+	regA = iota
+	regX
+	regY
+)
+
+// regNames define the names of the register indices.
+var regNames = [...]byte{'A', 'X', 'Y'}
+
+// resolveIndirect resolves the targets of the indirect jumps, RTS
+// dispatches, and vectors the code stores into the interrupt
+// vectors. It records the jump targets into Indirect and returns the
+// targets which are not yet parsed as code.
+func (prg *Prg) resolveIndirect() []uint16 {
+	cfg, err := prg.CFG()
+	if err != nil {
+		return nil
+	}
+	if prg.Indirect == nil {
+		prg.Indirect = make(map[uint16][]uint16)
+	}
+
+	var result []uint16
+	found := make(map[uint16]bool)
+	add := func(target uint16) {
+		if !prg.isCode(target) && !found[target] {
+			found[target] = true
+			result = append(result, target)
+		}
+	}
+	addJump := func(from, target uint16) {
+		for _, t := range prg.Indirect[from] {
+			if t == target {
+				add(target)
+				return
+			}
+		}
+		prg.Indirect[from] = append(prg.Indirect[from], target)
+		prg.invalidate()
+		add(target)
+	}
+
+	vectors := make(map[uint16][][2]value)
+	var jumps []Instr
+
+	for _, bb := range cfg.Blocks {
+		var regs [3]value
+		var stack []value
+		mem := make(map[uint16]value)
+
+		for _, instr := range bb.Instrs {
+			switch instr.Op {
+			case mos6510.OpLDAimm:
+				regs[regA] = value{kind: valImm, imm: byte(instr.Arg)}
+			case mos6510.OpLDXimm:
+				regs[regX] = value{kind: valImm, imm: byte(instr.Arg)}
+			case mos6510.OpLDYimm:
+				regs[regY] = value{kind: valImm, imm: byte(instr.Arg)}
+
+			case mos6510.OpLDAabx:
+				regs[regA] = value{kind: valTable, table: instr.Arg, index: 'X'}
+			case mos6510.OpLDAaby:
+				regs[regA] = value{kind: valTable, table: instr.Arg, index: 'Y'}
+			case mos6510.OpLDXaby:
+				regs[regX] = value{kind: valTable, table: instr.Arg, index: 'Y'}
+			case mos6510.OpLDYabx:
+				regs[regY] = value{kind: valTable, table: instr.Arg, index: 'X'}
+
+			case mos6510.OpTAX:
+				regs[regX] = regs[regA]
+			case mos6510.OpTAY:
+				regs[regY] = regs[regA]
+			case mos6510.OpTXA:
+				regs[regA] = regs[regX]
+			case mos6510.OpTYA:
+				regs[regA] = regs[regY]
+
+			case mos6510.OpSTAabs, mos6510.OpSTAzp,
+				mos6510.OpSTXabs, mos6510.OpSTXzp,
+				mos6510.OpSTYabs, mos6510.OpSTYzp:
+				var reg int
+				switch instr.Op {
+				case mos6510.OpSTXabs, mos6510.OpSTXzp:
+					reg = regX
+				case mos6510.OpSTYabs, mos6510.OpSTYzp:
+					reg = regY
+				}
+				mem[instr.Arg] = regs[reg]
+				for _, vec := range []uint16{instr.Arg - 1, instr.Arg} {
+					lo, ok1 := mem[vec]
+					hi, ok2 := mem[vec+1]
+					if ok1 && ok2 {
+						vectors[vec] = append(vectors[vec], [2]value{lo, hi})
+					}
+				}
+
+			case mos6510.OpPHA:
+				stack = append(stack, regs[regA])
+			case mos6510.OpPHP:
+				stack = append(stack, value{})
+			case mos6510.OpPLA, mos6510.OpPLP:
+				if len(stack) > 0 {
+					stack = stack[:len(stack)-1]
+				}
+				if instr.Op == mos6510.OpPLA {
+					regs[regA] = value{}
+				}
+
+			case mos6510.OpRTS:
+				// RTS dispatch: the target address minus one is
+				// pushed into the stack, high byte first.
+				if len(stack) >= 2 {
+					hi := stack[len(stack)-2]
+					lo := stack[len(stack)-1]
+					for _, target := range prg.pairTargets(lo, hi, 1) {
+						addJump(instr.Addr, target)
+					}
+				}
+
+			case mos6510.OpJMPind:
+				jumps = append(jumps, instr)
+
+			case mos6510.OpJSRabs:
+				// The subroutine can change all registers.
+				regs = [3]value{}
+
+			default:
+				for reg, name := range regNames {
+					if writesReg(instr.Op, name) {
+						regs[reg] = value{}
+					}
+				}
+			}
+		}
+	}
+
+	// Handlers stored into the interrupt vectors.
+	for vec, pairs := range vectors {
+		if _, ok := Vectors[vec]; ok {
+			for _, pair := range pairs {
+				for _, target := range prg.pairTargets(pair[0], pair[1], 0) {
+					add(target)
+				}
+			}
+		}
+	}
+
+	// Indirect jumps through vectors.
+	for _, jump := range jumps {
+		var targets []uint16
+		for _, pair := range vectors[jump.Arg] {
+			targets = append(targets, prg.pairTargets(pair[0], pair[1], 0)...)
+		}
+		ofs, err := prg.MemToData(jump.Arg)
+		if err == nil && ofs+1 < len(prg.Data) {
+			target := bo.Uint16(prg.Data[ofs:])
+			if prg.codeTarget(target) {
+				targets = append(targets, target)
+			}
+		}
+		for _, target := range targets {
+			addJump(jump.Addr, target)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// pairTargets returns the code addresses formed from the lo and hi
+// byte values. If the values are loaded from tables, the function
+// returns all table entries which point to code. The offset is added
+// to the addresses.
+func (prg *Prg) pairTargets(lo, hi value, offset uint16) []uint16 {
+	switch {
+	case lo.kind == valImm && hi.kind == valImm:
+		target := uint16(hi.imm)<<8 | uint16(lo.imm) + offset
+		if prg.codeTarget(target) {
+			return []uint16{target}
+		}
+	case lo.kind == valTable && hi.kind == valTable && lo.index == hi.index:
+		return prg.tableTargets(lo.table, hi.table, offset)
+	}
+	return nil
+}
+
+// tableTargets returns the code addresses from the lo and hi byte
+// tables. If the hi table follows the lo table immediately, the
+// tables are interpreted as a table of words. The table bytes are
+// marked as data.
+func (prg *Prg) tableTargets(lo, hi, offset uint16) []uint16 {
+	stride := 1
+	if hi == lo+1 {
+		stride = 2
+	}
+	var result []uint16
+	for i := 0; i < 256; i += stride {
+		if stride == 1 &&
+			((lo < hi && int(lo)+i >= int(hi)) ||
+				(hi < lo && int(hi)+i >= int(lo))) {
+			break
+		}
+		loOfs, err := prg.MemToData(lo + uint16(i))
+		if err != nil || !prg.tableByte(loOfs) {
+			break
+		}
+		hiOfs, err := prg.MemToData(hi + uint16(i))
+		if err != nil || !prg.tableByte(hiOfs) {
+			break
+		}
+		target := uint16(prg.Data[hiOfs])<<8 | uint16(prg.Data[loOfs])
+		target += offset
+		if !prg.codeTarget(target) {
+			break
+		}
+		for _, ofs := range []int{loOfs, hiOfs} {
+			if prg.SegTypes[ofs] == SegNone {
+				prg.SegTypes[ofs] = SegData
+				prg.invalidate()
+			}
+		}
+		result = append(result, target)
+	}
+	return result
+}
+
+// tableByte tests if the data offset can hold a jump table byte.
+func (prg *Prg) tableByte(ofs int) bool {
+	switch prg.SegTypes[ofs] {
+	case SegNone, SegData, SegPtr:
+		return true
+	default:
+		return false
+	}
+}
+
+// codeTarget tests if the address is a valid jump target inside the
+// program: it is either unmarked or code, and it does not start with
+// a KIL instruction.
+func (prg *Prg) codeTarget(addr uint16) bool {
+	ofs, err := prg.MemToData(addr)
+	if err != nil {
+		return false
+	}
+	switch prg.SegTypes[ofs] {
+	case SegNone, SegCode:
+		switch mos6510.Opcode(prg.Data[ofs]) {
+		case mos6510.OpKIL0x02, mos6510.OpKIL0x12, mos6510.OpKIL0x22,
+			mos6510.OpKIL0x32, mos6510.OpKIL0x42, mos6510.OpKIL0x52,
+			mos6510.OpKIL0x62, mos6510.OpKIL0x72, mos6510.OpKIL0x92,
+			mos6510.OpKIL0xB2, mos6510.OpKIL0xD2, mos6510.OpKIL0xF2:
+			return false
+		default:
+			return true
+		}
+	default:
+		return false
+	}
+}
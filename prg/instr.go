@@ -0,0 +1,120 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"fmt"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+// Instr defines a decoded instruction.
+type Instr struct {
+	Addr uint16
+	Op   mos6510.Opcode
+	Arg  uint16
+}
+
+// Size returns the instruction size in bytes.
+func (i Instr) Size() int {
+	return i.Op.Size()
+}
+
+// Next returns the address of the instruction following i.
+func (i Instr) Next() uint16 {
+	return i.Addr + uint16(i.Op.Size())
+}
+
+// Target returns the absolute target address of a branch or jump
+// instruction. The function returns false if the instruction does
+// not have a static target address.
+func (i Instr) Target() (uint16, bool) {
+	if !i.Op.Jump() {
+		return 0, false
+	}
+	switch i.Op.AddrMode() {
+	case mos6510.AddrREL:
+		return i.Next() + uint16(int8(i.Arg)), true
+	case mos6510.AddrABS:
+		return i.Arg, true
+	default:
+		return 0, false
+	}
+}
+
+// Branch tests if the instruction is a conditional branch.
+func (i Instr) Branch() bool {
+	return i.Op.AddrMode() == mos6510.AddrREL
+}
+
+// Call tests if the instruction is a subroutine call.
+func (i Instr) Call() bool {
+	return i.Op == mos6510.OpJSRabs
+}
+
+// Operand returns the instruction operand in assembler syntax. The
+// relative branch operands are returned as signed offsets; Target
+// returns the branch target address.
+func (i Instr) Operand() string {
+	switch i.Op.AddrMode() {
+	case mos6510.AddrIMM:
+		return fmt.Sprintf("#$%02X", i.Arg)
+	case mos6510.AddrABS:
+		return fmt.Sprintf("$%04X", i.Arg)
+	case mos6510.AddrABX:
+		return fmt.Sprintf("$%04X,X", i.Arg)
+	case mos6510.AddrABY:
+		return fmt.Sprintf("$%04X,Y", i.Arg)
+	case mos6510.AddrZP:
+		return fmt.Sprintf("$%02X", i.Arg)
+	case mos6510.AddrZPX:
+		return fmt.Sprintf("$%02X,X", i.Arg)
+	case mos6510.AddrZPY:
+		return fmt.Sprintf("$%02X,Y", i.Arg)
+	case mos6510.AddrREL:
+		return fmt.Sprintf("#%d", int8(i.Arg))
+	case mos6510.AddrIND:
+		return fmt.Sprintf("($%04X)", i.Arg)
+	case mos6510.AddrIZX:
+		return fmt.Sprintf("($%02X,X)", i.Arg)
+	case mos6510.AddrIZY:
+		return fmt.Sprintf("($%02X),Y", i.Arg)
+	default:
+		return ""
+	}
+}
+
+func (i Instr) String() string {
+	operand := i.Operand()
+	if len(operand) == 0 {
+		return i.Op.String()
+	}
+	return i.Op.String() + " " + operand
+}
+
+// Decode decodes the instruction at the absolute memory address.
+func (prg *Prg) Decode(addr uint16) (Instr, error) {
+	pc, err := prg.MemToData(addr)
+	if err != nil {
+		return Instr{}, err
+	}
+	op := mos6510.Opcode(prg.Data[pc])
+	if pc+op.Size() > len(prg.Data) {
+		return Instr{}, fmt.Errorf("%04X: %v: truncated code", addr, op)
+	}
+	instr := Instr{
+		Addr: addr,
+		Op:   op,
+	}
+	switch op.ArgSize() {
+	case 1:
+		instr.Arg = uint16(prg.Data[pc+1])
+	case 2:
+		instr.Arg = bo.Uint16(prg.Data[pc+1:])
+	}
+	return instr, nil
+}
@@ -0,0 +1,555 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+// Patch defines a modification of the program bytes starting from
+// the address.
+type Patch struct {
+	Addr uint16
+	Data []byte
+}
+
+func (p Patch) String() string {
+	return fmt.Sprintf("$%04X: % X", p.Addr, p.Data)
+}
+
+// PatchSet defines a set of non-overlapping patches to a program.
+// The patches are validated against the code analysis: a patch may
+// replace complete instructions or modify instruction operands, but
+// it may not split an instruction by changing its opcode without
+// covering the whole instruction.
+type PatchSet struct {
+	Prg     *Prg
+	Patches []Patch
+}
+
+// NewPatchSet creates an empty patch set for the program.
+func (prg *Prg) NewPatchSet() *PatchSet {
+	return &PatchSet{
+		Prg: prg,
+	}
+}
+
+// Poke patches the program bytes at the address.
+func (ps *PatchSet) Poke(addr uint16, data ...byte) error {
+	return ps.add(Patch{
+		Addr: addr,
+		Data: append([]byte(nil), data...),
+	})
+}
+
+// Replace replaces the instructions starting at the address with the
+// code. The code must have the same size as the instructions it
+// replaces. The instruction addresses are ignored and the relative
+// branch arguments are signed offsets.
+func (ps *PatchSet) Replace(addr uint16, code ...Instr) error {
+	if !ps.Prg.InstrStart(addr) {
+		return fmt.Errorf("$%04X: not an instruction start", addr)
+	}
+	var data []byte
+	for _, instr := range code {
+		encoded, err := mos6510.Encode(instr.Op, instr.Arg)
+		if err != nil {
+			return fmt.Errorf("$%04X: %v", addr+uint16(len(data)), err)
+		}
+		data = append(data, encoded...)
+	}
+	end, err := ps.Prg.instrEnd(addr, len(data))
+	if err != nil {
+		return err
+	}
+	if end != int(addr-ps.Prg.Load)+len(data) {
+		return fmt.Errorf("$%04X: replacement size %d does not match instructions size %d",
+			addr, len(data), end-int(addr-ps.Prg.Load))
+	}
+	return ps.add(Patch{
+		Addr: addr,
+		Data: data,
+	})
+}
+
+// NOP replaces the instructions [from, to) with NOP instructions.
+// The range must start and end at instruction boundaries.
+func (ps *PatchSet) NOP(from, to uint16) error {
+	if to <= from {
+		return fmt.Errorf("invalid range $%04X-$%04X", from, to)
+	}
+	if !ps.Prg.InstrStart(from) {
+		return fmt.Errorf("$%04X: not an instruction start", from)
+	}
+	end, err := ps.Prg.instrEnd(from, int(to-from))
+	if err != nil {
+		return err
+	}
+	if end != int(to-ps.Prg.Load) {
+		return fmt.Errorf("$%04X: range splits instruction", to)
+	}
+	data := make([]byte, to-from)
+	for i := range data {
+		data[i] = byte(mos6510.OpNOP0xEA)
+	}
+	return ps.add(Patch{
+		Addr: from,
+		Data: data,
+	})
+}
+
+// Operand replaces the argument of the instruction at the address.
+// The argument must fit into the instruction's operand.
+func (ps *PatchSet) Operand(addr uint16, arg uint16) error {
+	if !ps.Prg.InstrStart(addr) {
+		return fmt.Errorf("$%04X: not an instruction start", addr)
+	}
+	instr, err := ps.Prg.Decode(addr)
+	if err != nil {
+		return err
+	}
+	if instr.Op.ArgSize() == 0 {
+		return fmt.Errorf("$%04X: %v has no operand", addr, instr.Op)
+	}
+	data, err := mos6510.Encode(instr.Op, arg)
+	if err != nil {
+		return fmt.Errorf("$%04X: %v", addr, err)
+	}
+	return ps.add(Patch{
+		Addr: addr + 1,
+		Data: data[1:],
+	})
+}
+
+// instrEnd returns the data offset of the end of the instructions
+// starting from the address and covering at least size bytes.
+func (prg *Prg) instrEnd(addr uint16, size int) (int, error) {
+	ofs, err := prg.MemToData(addr)
+	if err != nil {
+		return 0, err
+	}
+	end := ofs + size
+	for ofs < end {
+		if ofs >= len(prg.Data) {
+			return 0, fmt.Errorf("$%04X: patch overflows program",
+				prg.DataToMem(ofs))
+		}
+		if prg.SegTypes[ofs] != SegCode || !prg.starts[ofs] {
+			return 0, fmt.Errorf("$%04X: not an instruction start",
+				prg.DataToMem(ofs))
+		}
+		ofs += prg.instrSize(ofs)
+	}
+	return ofs, nil
+}
+
+// add validates the patch and adds it into the patch set.
+func (ps *PatchSet) add(p Patch) error {
+	if len(p.Data) == 0 {
+		return fmt.Errorf("$%04X: empty patch", p.Addr)
+	}
+	if err := ps.Prg.validatePatch(p); err != nil {
+		return err
+	}
+	end := int(p.Addr) + len(p.Data)
+	for _, old := range ps.Patches {
+		if int(p.Addr) < int(old.Addr)+len(old.Data) &&
+			int(old.Addr) < end {
+			return fmt.Errorf("%v: overlaps patch %v", p, old)
+		}
+	}
+	ps.Patches = append(ps.Patches, p)
+	sort.Slice(ps.Patches, func(i, j int) bool {
+		return ps.Patches[i].Addr < ps.Patches[j].Addr
+	})
+	return nil
+}
+
+// validatePatch verifies that the patch is inside the program and
+// that it does not split instructions. The patch splits an
+// instruction if it changes the instruction's opcode without
+// covering the whole instruction, or if a patched instruction
+// extends past the patch.
+func (prg *Prg) validatePatch(p Patch) error {
+	from, err := prg.MemToData(p.Addr)
+	if err != nil {
+		return err
+	}
+	to := from + len(p.Data)
+	if to > len(prg.Data) {
+		return fmt.Errorf("%v: patch overflows program", p)
+	}
+	if prg.starts == nil {
+		return nil
+	}
+	for ofs := from; ofs < to; ofs++ {
+		if !prg.starts[ofs] || prg.Data[ofs] == p.Data[ofs-from] {
+			continue
+		}
+		if end := ofs + prg.instrSize(ofs); end > to {
+			return fmt.Errorf("%v: patch splits instruction at $%04X",
+				p, prg.DataToMem(ofs))
+		}
+	}
+
+	// Decode the patched code. The new instructions must end inside
+	// the patch, unless the instruction is the old instruction with
+	// its operand patched.
+	pos := from
+	for i := 1; i <= 2 && pos == from; i++ {
+		if from-i >= 0 && prg.starts[from-i] &&
+			from-i+prg.instrSize(from-i) > from {
+			pos = from - i
+		}
+	}
+	for pos < to {
+		if prg.SegTypes[pos] != SegCode {
+			pos++
+			continue
+		}
+		op := mos6510.Opcode(prg.Data[pos])
+		if pos >= from {
+			op = mos6510.Opcode(p.Data[pos-from])
+		}
+		end := pos + op.Size()
+		if end > to && (!prg.starts[pos] || op != mos6510.Opcode(prg.Data[pos])) {
+			return fmt.Errorf("%v: patched %v at $%04X extends past patch",
+				p, op, prg.DataToMem(pos))
+		}
+		pos = end
+	}
+	return nil
+}
+
+// Bytes returns the patched program in the PRG file format.
+func (ps *PatchSet) Bytes() []byte {
+	data := ps.Prg.Bytes()
+	for _, p := range ps.Patches {
+		copy(data[2+int(p.Addr-ps.Prg.Load):], p.Data)
+	}
+	return data
+}
+
+// Apply applies the patches and parses the patched program with the
+// options.
+func (ps *PatchSet) Apply(opts ParseOptions) (*Prg, error) {
+	return ParseWith(ps.Bytes(), opts)
+}
+
+// diffPatches creates a patch set from the differences between the
+// program and the patched PRG file.
+func (prg *Prg) diffPatches(target []byte) (*PatchSet, error) {
+	source := prg.Bytes()
+	if len(target) != len(source) {
+		return nil, fmt.Errorf("patch changes program size from %d to %d",
+			len(source), len(target))
+	}
+	if !bytes.Equal(source[:2], target[:2]) {
+		return nil, fmt.Errorf("patch changes load address")
+	}
+	ps := prg.NewPatchSet()
+	for i := 2; i < len(source); {
+		if source[i] == target[i] {
+			i++
+			continue
+		}
+		start := i
+		end := i
+		for i < len(source) && (i < end || source[i] != target[i]) {
+			// Changed opcodes cover their whole instructions.
+			if prg.starts != nil && prg.starts[i-2] &&
+				source[i] != target[i] {
+				end = max(end, i+prg.instrSize(i-2))
+			}
+			i++
+		}
+		err := ps.add(Patch{
+			Addr: prg.DataToMem(start - 2),
+			Data: append([]byte(nil), target[start:i]...),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+var (
+	ipsMagic = []byte("PATCH")
+	ipsEOF   = []byte("EOF")
+)
+
+// ipsMaxRecord specifies the maximum IPS record size.
+const ipsMaxRecord = 0xffff
+
+// WriteIPS writes the patch set as an IPS patch for the PRG file.
+// The offsets of the patch are PRG file offsets, including the load
+// address.
+func (ps *PatchSet) WriteIPS(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.Write(ipsMagic)
+	for _, p := range ps.Patches {
+		ofs := 2 + int(p.Addr-ps.Prg.Load)
+		data := p.Data
+		for len(data) > 0 {
+			n := min(len(data), ipsMaxRecord)
+			buf.Write([]byte{byte(ofs >> 16), byte(ofs >> 8), byte(ofs),
+				byte(n >> 8), byte(n)})
+			buf.Write(data[:n])
+			data = data[n:]
+			ofs += n
+		}
+	}
+	buf.Write(ipsEOF)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadIPS reads an IPS patch for the PRG file and returns it as a
+// patch set. The patch may not change the program size or its load
+// address.
+func (prg *Prg) ReadIPS(r io.Reader) (*PatchSet, error) {
+	in := bufio.NewReader(r)
+	var hdr [5]byte
+	if _, err := io.ReadFull(in, hdr[:]); err != nil {
+		return nil, fmt.Errorf("invalid IPS patch: %v", err)
+	}
+	if !bytes.Equal(hdr[:], ipsMagic) {
+		return nil, fmt.Errorf("invalid IPS patch: invalid magic")
+	}
+	target := prg.Bytes()
+	for {
+		var rec [5]byte
+		if _, err := io.ReadFull(in, rec[:3]); err != nil {
+			return nil, fmt.Errorf("invalid IPS patch: %v", err)
+		}
+		if bytes.Equal(rec[:3], ipsEOF) {
+			break
+		}
+		if _, err := io.ReadFull(in, rec[3:]); err != nil {
+			return nil, fmt.Errorf("invalid IPS patch: %v", err)
+		}
+		ofs := int(rec[0])<<16 | int(rec[1])<<8 | int(rec[2])
+		n := int(binary.BigEndian.Uint16(rec[3:]))
+		var data []byte
+		if n == 0 {
+			// RLE record.
+			var rle [3]byte
+			if _, err := io.ReadFull(in, rle[:]); err != nil {
+				return nil, fmt.Errorf("invalid IPS patch: %v", err)
+			}
+			n = int(binary.BigEndian.Uint16(rle[:]))
+			data = bytes.Repeat(rle[2:], n)
+		} else {
+			data = make([]byte, n)
+			if _, err := io.ReadFull(in, data); err != nil {
+				return nil, fmt.Errorf("invalid IPS patch: %v", err)
+			}
+		}
+		if ofs+len(data) > len(target) {
+			return nil, fmt.Errorf("IPS record $%06X+%d outside program",
+				ofs, len(data))
+		}
+		copy(target[ofs:], data)
+	}
+	return prg.diffPatches(target)
+}
+
+// BPS actions.
+const (
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+var bpsMagic = []byte("BPS1")
+
+// WriteBPS writes the patch set as a BPS patch for the PRG file.
+func (ps *PatchSet) WriteBPS(w io.Writer) error {
+	source := ps.Prg.Bytes()
+	target := ps.Bytes()
+
+	var buf bytes.Buffer
+	buf.Write(bpsMagic)
+	bpsPutNumber(&buf, uint64(len(source)))
+	bpsPutNumber(&buf, uint64(len(target)))
+	bpsPutNumber(&buf, 0)
+
+	var ofs int
+	for _, p := range ps.Patches {
+		start := 2 + int(p.Addr-ps.Prg.Load)
+		if start > ofs {
+			bpsPutNumber(&buf, uint64(start-ofs-1)<<2|bpsSourceRead)
+		}
+		bpsPutNumber(&buf, uint64(len(p.Data)-1)<<2|bpsTargetRead)
+		buf.Write(p.Data)
+		ofs = start + len(p.Data)
+	}
+	if ofs < len(target) {
+		bpsPutNumber(&buf, uint64(len(target)-ofs-1)<<2|bpsSourceRead)
+	}
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(source))
+	buf.Write(crc[:])
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(target))
+	buf.Write(crc[:])
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(crc[:])
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadBPS reads a BPS patch for the PRG file and returns it as a
+// patch set. The patch must be created for the program and it may
+// not change the program size or its load address.
+func (prg *Prg) ReadBPS(r io.Reader) (*PatchSet, error) {
+	patch, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(patch) < len(bpsMagic)+12 || !bytes.HasPrefix(patch, bpsMagic) {
+		return nil, fmt.Errorf("invalid BPS patch")
+	}
+	footer := patch[len(patch)-12:]
+	if crc32.ChecksumIEEE(patch[:len(patch)-4]) !=
+		binary.LittleEndian.Uint32(footer[8:]) {
+		return nil, fmt.Errorf("BPS patch checksum mismatch")
+	}
+	source := prg.Bytes()
+	if crc32.ChecksumIEEE(source) != binary.LittleEndian.Uint32(footer) {
+		return nil, fmt.Errorf("BPS patch is not for this program")
+	}
+
+	in := bytes.NewReader(patch[len(bpsMagic) : len(patch)-12])
+	sourceSize, err := bpsNumber(in)
+	if err != nil {
+		return nil, err
+	}
+	targetSize, err := bpsNumber(in)
+	if err != nil {
+		return nil, err
+	}
+	metadataSize, err := bpsNumber(in)
+	if err != nil {
+		return nil, err
+	}
+	if sourceSize != uint64(len(source)) {
+		return nil, fmt.Errorf("BPS source size mismatch")
+	}
+	if targetSize > 0x10000 || metadataSize > uint64(in.Len()) {
+		return nil, fmt.Errorf("invalid BPS patch")
+	}
+	if _, err := in.Seek(int64(metadataSize), io.SeekCurrent); err != nil {
+		return nil, err
+	}
+
+	target := make([]byte, 0, targetSize)
+	var sourceOfs, targetOfs int64
+	for in.Len() > 0 {
+		cmd, err := bpsNumber(in)
+		if err != nil {
+			return nil, err
+		}
+		n := int(cmd>>2) + 1
+		if uint64(len(target)+n) > targetSize {
+			return nil, fmt.Errorf("BPS patch overflows target")
+		}
+		switch cmd & 3 {
+		case bpsSourceRead:
+			if len(target)+n > len(source) {
+				return nil, fmt.Errorf("BPS source read out of range")
+			}
+			target = append(target, source[len(target):len(target)+n]...)
+
+		case bpsTargetRead:
+			data := make([]byte, n)
+			if _, err := io.ReadFull(in, data); err != nil {
+				return nil, fmt.Errorf("invalid BPS patch: %v", err)
+			}
+			target = append(target, data...)
+
+		case bpsSourceCopy, bpsTargetCopy:
+			rel, err := bpsNumber(in)
+			if err != nil {
+				return nil, err
+			}
+			delta := int64(rel >> 1)
+			if rel&1 != 0 {
+				delta = -delta
+			}
+			if cmd&3 == bpsSourceCopy {
+				sourceOfs += delta
+				if sourceOfs < 0 || sourceOfs+int64(n) > int64(len(source)) {
+					return nil, fmt.Errorf("BPS source copy out of range")
+				}
+				target = append(target, source[sourceOfs:sourceOfs+int64(n)]...)
+				sourceOfs += int64(n)
+			} else {
+				targetOfs += delta
+				if targetOfs < 0 || targetOfs >= int64(len(target)) {
+					return nil, fmt.Errorf("BPS target copy out of range")
+				}
+				// The copy may overlap its output.
+				for i := 0; i < n; i++ {
+					target = append(target, target[targetOfs])
+					targetOfs++
+				}
+			}
+		}
+	}
+	if uint64(len(target)) != targetSize {
+		return nil, fmt.Errorf("BPS target size mismatch")
+	}
+	if crc32.ChecksumIEEE(target) != binary.LittleEndian.Uint32(footer[4:]) {
+		return nil, fmt.Errorf("BPS target checksum mismatch")
+	}
+	return prg.diffPatches(target)
+}
+
+// bpsPutNumber writes the BPS variable-length number.
+func bpsPutNumber(buf *bytes.Buffer, v uint64) {
+	for {
+		x := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			buf.WriteByte(0x80 | x)
+			return
+		}
+		buf.WriteByte(x)
+		v--
+	}
+}
+
+// bpsNumber reads the BPS variable-length number.
+func bpsNumber(r io.ByteReader) (uint64, error) {
+	var v uint64
+	shift := uint64(1)
+	for i := 0; i < 10; i++ {
+		x, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("invalid BPS patch: %v", err)
+		}
+		v += uint64(x&0x7f) * shift
+		if x&0x80 != 0 {
+			return v, nil
+		}
+		shift <<= 7
+		v += shift
+	}
+	return 0, errors.New("invalid BPS number")
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/markkurossi/mpc64/mos6510"
 	"github.com/markkurossi/mpc64/petscii"
@@ -21,6 +22,9 @@ var (
 	bo = binary.LittleEndian
 )
 
+// BasicStart is the start address of the C64 BASIC program area.
+const BasicStart = 0x0801
+
 // SegType specifies program segment type.
 type SegType byte
 
@@ -31,14 +35,110 @@ const (
 	SegCode
 	SegData
 	SegAddr
+	SegText
+	SegScreen
+	SegWord
+	SegPtr
+	SegSprite
+	SegChar
 )
 
+var segTypes = map[SegType]string{
+	SegNone:   "none",
+	SegBasic:  "basic",
+	SegCode:   "code",
+	SegData:   "data",
+	SegAddr:   "addr",
+	SegText:   "text",
+	SegScreen: "screen",
+	SegWord:   "word",
+	SegPtr:    "ptr",
+	SegSprite: "sprite",
+	SegChar:   "char",
+}
+
+func (t SegType) String() string {
+	name, ok := segTypes[t]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{SegType %d}", t)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t SegType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *SegType) UnmarshalText(text []byte) error {
+	for k, v := range segTypes {
+		if v == string(text) {
+			*t = k
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown segment type: %s", text)
+}
+
 // Prg defines a program.
 type Prg struct {
-	Load     uint16
-	Start    uint16
+	Load  uint16
+	Start uint16
+
+	// Entries lists the code entry points: the program start
+	// address, the SYS targets of the BASIC program or the explicit
+	// ParseOptions.Entries, the code after the BASIC program or at
+	// the load address if there are no other entry points, the
+	// ParseOptions.Code entries and forced code segments, the
+	// resolved indirect jump targets and interrupt handlers, and the
+	// code discovered by the emulation.
+	Entries []uint16
+
 	Data     []byte
 	SegTypes []SegType
+
+	// Conflicts lists the code/data conflicts and overlapping
+	// instructions found during the code analysis.
+	Conflicts []Conflict
+
+	// Indirect holds the resolved targets of the indirect jumps and
+	// RTS dispatches, indexed by the jump instruction address.
+	Indirect map[uint16][]uint16
+
+	// Dynamic lists the instructions executed by the emulation but
+	// not reached by the static analysis.
+	Dynamic []uint16
+
+	// Warnings lists the non-fatal problems found while parsing the
+	// program.
+	Warnings []Warning
+
+	// Labels and Comments hold the address labels and comments shown
+	// in the disassembly.
+	Labels   map[uint16]string
+	Comments map[uint16]string
+
+	strs   []String
+	starts []bool
+	forced []bool
+
+	// guesses lists the code starts guessed from the unmarked
+	// blocks following code. Unlike Entries, they are not known
+	// entry points.
+	guesses []uint16
+
+	// cfg and xref cache the control-flow graph and the
+	// cross-reference index of the current code segments.
+	cfg  *CFG
+	xref *XRef
+}
+
+// invalidate clears the cached analysis results after the segments,
+// entry points, or indirect jump targets have changed.
+func (prg *Prg) invalidate() {
+	prg.cfg = nil
+	prg.xref = nil
 }
 
 // MemToData maps an absolute memory addess into the Data array.
@@ -58,78 +158,114 @@ func (prg *Prg) DataToMem(offset int) uint16 {
 	return uint16(offset) + prg.Load
 }
 
+// Bytes returns the program in the PRG file format: the load
+// address followed by the program data.
+func (prg *Prg) Bytes() []byte {
+	result := make([]byte, 2, 2+len(prg.Data))
+	bo.PutUint16(result, prg.Load)
+	return append(result, prg.Data...)
+}
+
 // Print prints the program to standard output.
 func (prg *Prg) Print() error {
-	pc, err := prg.MemToData(prg.Start)
-	if err != nil {
-		return err
+	var pc int
+	if len(prg.SegTypes) > 0 && prg.SegTypes[0] == SegAddr {
+		lines, end, err := prg.BasicLines()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Printf("%04X: %v\n", line.Addr, line)
+		}
+		pc = end
 	}
+	comments := prg.comments()
+
 	for pc < len(prg.Data) {
+		if label, ok := prg.Labels[prg.DataToMem(pc)]; ok {
+			fmt.Printf("%04X: %s:\n", prg.DataToMem(pc), label)
+		}
 		switch prg.SegTypes[pc] {
 		case SegCode:
-			op := mos6510.Opcode(prg.Data[pc])
-
-			var i8 int8
-			var addr uint16
-
-			switch op.ArgSize() {
-			case 0:
-			case 1:
-				i8 = int8(prg.Data[pc+1])
-			case 2:
-				addr = bo.Uint16(prg.Data[pc+1:])
+			if prg.starts != nil && !prg.starts[pc] {
+				prg.printData(pc, pc+1, ".byte")
+				pc++
+				break
 			}
-			fmt.Printf("%04X: %v", prg.DataToMem(pc), op)
-
-			switch op.AddrMode() {
-			case mos6510.AddrImp:
-			case mos6510.AddrIMM:
-				fmt.Printf(" #$%02X", uint8(i8))
-			case mos6510.AddrABS:
-				fmt.Printf(" $%04X", addr)
-			case mos6510.AddrABX:
-				fmt.Printf(" $%04X,X", addr)
-			case mos6510.AddrABY:
-				fmt.Printf(" $%04X,Y", addr)
-			case mos6510.AddrZP:
-				fmt.Printf(" $%02X", i8)
-			case mos6510.AddrZPX:
-				fmt.Printf(" $%02X,X", i8)
-			case mos6510.AddrZPY:
-				fmt.Printf(" $%02X,Y", i8)
-			case mos6510.AddrREL:
-				fmt.Printf(" #%d", i8)
-			case mos6510.AddrIND:
-				fmt.Printf(" ($%04X)", addr)
-			case mos6510.AddrIZX:
-				fmt.Printf(" ($%02X,X)", addr)
-			case mos6510.AddrIZY:
-				fmt.Printf(" ($%02X),Y", addr)
+			instr, err := prg.Decode(prg.DataToMem(pc))
+			if err != nil {
+				return err
+			}
+			if prg.starts != nil {
+				end := prg.overlapEnd(pc)
+				if end < pc+instr.Size() {
+					// The instruction overlaps the next instruction.
+					var args []string
+					for i := pc; i < end; i++ {
+						args = append(args, fmt.Sprintf("$%02X", prg.Data[i]))
+					}
+					fmt.Printf("%04X: .byte %s\t; %v\n", instr.Addr,
+						strings.Join(args, ","), instr)
+					pc = end
+					break
+				}
+			}
+			comment, ok := comments[instr.Addr]
+			if ok {
+				fmt.Printf("%04X: %v\t; %s\n", instr.Addr, instr, comment)
+			} else {
+				fmt.Printf("%04X: %v\n", instr.Addr, instr)
 			}
-			fmt.Println()
 
-			pc += op.Size()
+			pc += instr.Size()
 
 		case SegData:
 			start := pc
-			for pc < len(prg.Data) {
-				if prg.SegTypes[pc] != SegData {
-					break
-				}
-				pc++
-			}
+			pc = prg.segEnd(pc)
 			prg.printData(start, pc, ".byte")
 
 		case SegNone:
 			start := pc
-			for pc < len(prg.Data) {
-				if prg.SegTypes[pc] != SegNone {
-					break
-				}
-				pc++
-			}
+			pc = prg.segEnd(pc)
 			prg.printData(start, pc, ".none")
 
+		case SegText:
+			start := pc
+			pc = prg.stringEnd(pc)
+			prg.printText(start, pc, ".text", false)
+
+		case SegScreen:
+			start := pc
+			pc = prg.stringEnd(pc)
+			prg.printText(start, pc, ".screen", true)
+
+		case SegWord, SegPtr:
+			label := ".word"
+			if prg.SegTypes[pc] == SegPtr {
+				label = ".addr"
+			}
+			start := pc
+			pc = prg.segEnd(pc)
+			start = prg.printWords(start, pc, label)
+			prg.printData(start, pc, ".byte")
+
+		case SegSprite:
+			start := pc
+			pc = prg.segEnd(pc)
+			for ; start < pc; start += SpriteSize {
+				fmt.Printf("%04X: ; sprite\n", prg.DataToMem(start))
+				prg.printBitmap(start, min(start+SpriteSize, pc), 3)
+			}
+
+		case SegChar:
+			start := pc
+			pc = prg.segEnd(pc)
+			for ofs := start; ofs < pc; ofs += CharSize {
+				fmt.Printf("%04X: ; char $%02X\n", prg.DataToMem(ofs),
+					(ofs-start)/CharSize)
+				prg.printBitmap(ofs, min(ofs+CharSize, pc), 1)
+			}
+
 		default:
 			return fmt.Errorf("%04X: type %v not supported",
 				prg.DataToMem(pc), prg.SegTypes[pc])
@@ -138,6 +274,53 @@ func (prg *Prg) Print() error {
 	return nil
 }
 
+// comments returns the disassembly comments: the user comments, the
+// string references, the self-modifying code sites, and the
+// instructions found by the emulation.
+func (prg *Prg) comments() map[uint16]string {
+	comments := make(map[uint16]string)
+	addComment := func(addr uint16, comment string) {
+		if old, ok := comments[addr]; ok {
+			comment = old + ", " + comment
+		}
+		comments[addr] = comment
+	}
+	for addr, comment := range prg.Comments {
+		addComment(addr, comment)
+	}
+	for _, str := range prg.Strings() {
+		for _, ref := range str.Refs {
+			addComment(ref.Instr, fmt.Sprintf("\"%s\"", str))
+		}
+	}
+	type smcTarget struct {
+		addr    uint16
+		operand bool
+	}
+	var targets []smcTarget
+	writers := make(map[smcTarget][]string)
+	for _, smc := range prg.SelfModifying() {
+		t := smcTarget{smc.Target, smc.Operand}
+		if _, ok := writers[t]; !ok {
+			targets = append(targets, t)
+		}
+		writers[t] = append(writers[t], fmt.Sprintf("$%04X", smc.Instr))
+		addComment(smc.Instr, fmt.Sprintf("SMC: modifies $%04X", smc.Addr))
+	}
+	for _, t := range targets {
+		what := "opcode"
+		if t.operand {
+			what = "operand"
+		}
+		addComment(t.addr, fmt.Sprintf("SMC: %s modified by %s",
+			what, strings.Join(writers[t], ", ")))
+	}
+	for _, addr := range prg.Dynamic {
+		addComment(addr, "dynamic")
+	}
+	return comments
+}
+
 func (prg *Prg) printData(from, to int, label string) {
 	for from < to {
 		fmt.Printf("%04X: %s", prg.DataToMem(from), label)
@@ -174,50 +357,187 @@ func Load(file string) (*Prg, error) {
 	return Parse(data)
 }
 
-// Parse parses the program data.
+// LoadWith loads program from the named file with the parse options.
+func LoadWith(file string, opts ParseOptions) (*Prg, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWith(data, opts)
+}
+
+// ParseOptions define options for parsing programs.
+type ParseOptions struct {
+	// Entries specify explicit code entry points. If set, the
+	// entry points are not resolved from the BASIC program and the
+	// program does not need to have a BASIC stub.
+	Entries []uint16
+
+	// Auto parses programs without a BASIC stub as pure machine code
+	// programs, starting from the load address.
+	Auto bool
+
+	// Emulate runs the program in the CPU emulator for the number of
+	// cycles and merges the executed code into the analysis.
+	Emulate uint64
+
+	// Code lists additional code entry points. Unlike Entries, they
+	// do not replace the entry points resolved from the BASIC
+	// program.
+	Code []uint16
+
+	// Segments force the segment types of the program ranges. The
+	// code segments are parsed as code entry points. The code
+	// analysis does not flow into the other forced segments and the
+	// data detection does not change their types.
+	Segments []Segment
+}
+
+// Parse parses the program data. The program must start with a
+// BASIC stub which specifies the code entry points.
 func Parse(data []byte) (*Prg, error) {
-	if len(data) < 7 {
-		return nil, fmt.Errorf("data too short, need at least 7 bytes")
+	return ParseWith(data, ParseOptions{})
+}
+
+// ParseWith parses the program data with the options.
+func ParseWith(data []byte, opts ParseOptions) (*Prg, error) {
+	basic := len(opts.Entries) == 0 && !opts.Auto
+	need := 3
+	if basic {
+		need = 7
+	}
+	if len(data) < need {
+		var load uint16
+		if len(data) >= 2 {
+			load = bo.Uint16(data)
+		}
+		return nil, &ParseError{
+			Kind:   ErrShort,
+			Offset: len(data),
+			Addr:   load,
+			Msg:    fmt.Sprintf("data too short, need at least %d bytes", need),
+		}
 	}
 	load := bo.Uint16(data)
 	data = data[2:]
+	if int(load)+len(data) > 0x10000 {
+		return nil, &ParseError{
+			Kind:   ErrSize,
+			Offset: 0x10000 - int(load) + 2,
+			Addr:   0xffff,
+			Msg: fmt.Sprintf("program $%04X-$%04X does not fit into memory",
+				load, int(load)+len(data)-1),
+		}
+	}
 
 	prg := &Prg{
 		Load:     load,
 		Data:     data,
 		SegTypes: make([]SegType, len(data)),
+		starts:   make([]bool, len(data)),
 	}
-	prg.SegTypes[0] = SegAddr
-	prg.SegTypes[1] = SegAddr
 
-	next, err := prg.MemToData(bo.Uint16(data))
-	if err != nil {
+	var entries []uint16
+	var lines []Line
+	var end int
+	var err error
+
+	if basic || load == BasicStart {
+		lines, end, err = prg.parseBasic()
+		if err == nil && len(lines) == 0 {
+			err = prg.errorf(ErrBasic, 0, "empty BASIC program")
+		}
+		if err != nil {
+			if basic {
+				return nil, err
+			}
+			// Not a BASIC program.
+			for i := range prg.SegTypes {
+				prg.SegTypes[i] = SegNone
+			}
+			lines = nil
+			end = 0
+		}
+	}
+
+	if err := prg.forceSegments(opts.Segments); err != nil {
 		return nil, err
 	}
-	if next < 2 || next+2 >= len(data) {
-		return nil, fmt.Errorf("next line out of bounds")
+
+	if len(opts.Entries) > 0 {
+		for _, addr := range opts.Entries {
+			if _, err := prg.MemToData(addr); err != nil {
+				return nil, prg.addrErrorf(ErrEntry, addr,
+					"entry point outside program")
+			}
+			entries = append(entries, addr)
+		}
+	} else {
+		// Resolve entry points from the SYS statements.
+		for _, line := range lines {
+			for _, addr := range line.SysTargets() {
+				if _, err := prg.MemToData(addr); err == nil {
+					entries = append(entries, addr)
+				} else {
+					prg.warn(WarnEntry, line.Addr,
+						"SYS target $%04X outside program", addr)
+				}
+			}
+		}
+	}
+	if len(entries) == 0 {
+		// Assume the code follows the BASIC program. For machine
+		// code programs, this is the load address.
+		if end >= len(data) {
+			return nil, prg.errorf(ErrEntry, end, "no code after BASIC program")
+		}
+		entries = append(entries, prg.DataToMem(end))
 	}
-	for i := 2; i < next; i++ {
-		prg.SegTypes[i] = SegBasic
+	prg.Start = entries[0]
+
+	for _, addr := range opts.Code {
+		if _, err := prg.MemToData(addr); err != nil {
+			return nil, prg.addrErrorf(ErrEntry, addr,
+				"entry point outside program")
+		}
+		entries = append(entries, addr)
 	}
-	zero := bo.Uint16(data[next:])
-	if zero != 0 {
-		return nil, fmt.Errorf("next line not $0000")
+	for _, seg := range opts.Segments {
+		if seg.Type == SegCode {
+			entries = append(entries, seg.Addr)
+		}
 	}
-	prg.SegTypes[next] = SegAddr
-	prg.SegTypes[next+1] = SegAddr
 
-	prg.Start = prg.DataToMem(next + 2)
+	for _, entry := range entries {
+		err = prg.parseCodeFromAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	err = prg.parseCodeFromAddr(prg.Start)
+	err = prg.resolveAll()
 	if err != nil {
 		return nil, err
 	}
+	if opts.Emulate > 0 {
+		trace, err := prg.Emulate(EmulateOptions{
+			MaxCycles: opts.Emulate,
+		})
+		if err != nil {
+			return nil, prg.addrErrorf(ErrEmulate, prg.Start, "%v", err)
+		}
+		err = prg.MergeTrace(trace)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Parse all unmarked blocks preceded by code.
 	for pc := 0; pc < len(prg.Data); pc++ {
-		if prg.SegTypes[pc] == 0 && prg.SegTypes[pc-1] == SegCode {
-			err = prg.parseCodeFromAddr(prg.DataToMem(pc))
+		if pc > 0 && prg.SegTypes[pc] == 0 && prg.SegTypes[pc-1] == SegCode {
+			addr := prg.DataToMem(pc)
+			prg.guesses = append(prg.guesses, addr)
+			err = prg.parseCodeFrom(addr)
 			if err != nil {
 				return nil, err
 			}
@@ -230,13 +550,88 @@ func Parse(data []byte) (*Prg, error) {
 			prg.SegTypes[pc] = SegData
 		}
 	}
+	prg.invalidate()
+	prg.detectData()
 
 	return prg, nil
 }
 
+// forceSegments marks the forced segment types.
+func (prg *Prg) forceSegments(segments []Segment) error {
+	for _, seg := range segments {
+		switch seg.Type {
+		case SegCode, SegData, SegText, SegScreen, SegWord, SegPtr,
+			SegSprite, SegChar:
+		default:
+			return prg.addrErrorf(ErrSegment, seg.Addr,
+				"segment type %v can't be forced", seg.Type)
+		}
+		from, err := prg.MemToData(seg.Addr)
+		if err != nil {
+			return prg.addrErrorf(ErrSegment, seg.Addr,
+				"segment outside program")
+		}
+		if seg.Size <= 0 || from+seg.Size > len(prg.Data) {
+			return prg.errorf(ErrSegment, from, "invalid segment size %d",
+				seg.Size)
+		}
+		if seg.Type == SegCode {
+			continue
+		}
+		if prg.forced == nil {
+			prg.forced = make([]bool, len(prg.Data))
+		}
+		for i := from; i < from+seg.Size; i++ {
+			prg.SegTypes[i] = seg.Type
+			prg.forced[i] = true
+		}
+	}
+	return nil
+}
+
+// resolveAll resolves indirect jumps until no new code is found. The
+// targets are parsed only once since a target with truncated code
+// does not become code.
+func (prg *Prg) resolveAll() error {
+	parsed := make(map[uint16]bool)
+	for {
+		var found bool
+		for _, target := range prg.resolveIndirect() {
+			if parsed[target] {
+				continue
+			}
+			parsed[target] = true
+			found = true
+			err := prg.parseCodeFromAddr(target)
+			if err != nil {
+				return err
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+}
+
 func (prg *Prg) parseCodeFromAddr(start uint16) (err error) {
-	var pending []uint16
-	pending = append(pending, start)
+	for _, entry := range prg.Entries {
+		if entry == start {
+			return nil
+		}
+	}
+	prg.Entries = append(prg.Entries, start)
+
+	return prg.parseCodeFrom(start)
+}
+
+// parseCodeFrom parses the code reachable from the start address.
+func (prg *Prg) parseCodeFrom(start uint16) (err error) {
+	prg.invalidate()
+
+	var pending []flow
+	pending = append(pending, flow{
+		to: start,
+	})
 
 	for len(pending) > 0 {
 		pending, err = prg.parseCode(pending[0], pending[1:])
@@ -247,23 +642,61 @@ func (prg *Prg) parseCodeFromAddr(start uint16) (err error) {
 	return nil
 }
 
-func (prg *Prg) parseCode(addr uint16, pending []uint16) ([]uint16, error) {
-	pc, err := prg.MemToData(addr)
+// flow defines a control flow to an address. If hasFrom is true, the
+// flow is from the instruction at the address from.
+type flow struct {
+	to      uint16
+	from    uint16
+	hasFrom bool
+}
+
+func (prg *Prg) parseCode(f flow, pending []flow) ([]flow, error) {
+	pc, err := prg.MemToData(f.to)
 	if err != nil {
-		return nil, err
+		return nil, prg.addrErrorf(ErrEntry, f.to, "code outside program")
 	}
 	for pc < len(prg.Data) {
-		if prg.SegTypes[pc] != 0 {
+		if prg.starts[pc] {
 			break
 		}
+		if prg.forced != nil && prg.forced[pc] {
+			prg.addConflict(ConflictData, pc, f)
+			return pending, nil
+		}
+		switch prg.SegTypes[pc] {
+		case SegNone:
+		case SegData:
+			// Data reference target reached by control flow: the
+			// byte is code.
+		case SegCode:
+			// Flow into the middle of an instruction.
+			prg.addConflict(ConflictOperand, pc, f)
+		default:
+			prg.addConflict(ConflictData, pc, f)
+			return pending, nil
+		}
 		op := mos6510.Opcode(prg.Data[pc])
 		if pc+op.Size() > len(prg.Data) {
-			return nil, fmt.Errorf("%04X: %v: truncated code",
-				prg.DataToMem(pc), op)
+			// The rest of the program is marked as data.
+			prg.warn(WarnTruncated, prg.DataToMem(pc),
+				"%v: truncated code", op)
+			return pending, nil
+		}
+		prg.starts[pc] = true
+		for i := 1; i < op.Size(); i++ {
+			if prg.starts[pc+i] {
+				// The instruction overlaps the following
+				// instruction.
+				prg.addConflict(ConflictOperand, pc+i, flow{})
+			}
 		}
 		for i := 0; i < op.Size(); i++ {
 			prg.SegTypes[pc+i] = SegCode
 		}
+		f = flow{
+			from:    prg.DataToMem(pc),
+			hasFrom: true,
+		}
 		var i8 int8
 		var addr uint16
 
@@ -282,15 +715,19 @@ func (prg *Prg) parseCode(addr uint16, pending []uint16) ([]uint16, error) {
 				if next >= 0 && next < len(prg.Data) {
 					addr := prg.DataToMem(next)
 					if op.Jump() {
-						pending = append(pending, addr)
+						pending = append(pending, flow{
+							to:      addr,
+							from:    f.from,
+							hasFrom: true,
+						})
 					}
 				}
 
 			case mos6510.AddrIZX, mos6510.AddrIZY:
 
 			default:
-				return nil, fmt.Errorf("%04X: %v: %v not supported",
-					prg.DataToMem(pc), op, op.AddrMode())
+				return nil, prg.errorf(ErrCode, pc, "%v: %v not supported",
+					op, op.AddrMode())
 			}
 
 		case 2:
@@ -300,16 +737,28 @@ func (prg *Prg) parseCode(addr uint16, pending []uint16) ([]uint16, error) {
 				switch op.AddrMode() {
 				case mos6510.AddrABS, mos6510.AddrABX, mos6510.AddrABY:
 					if op.Jump() {
-						pending = append(pending, addr)
+						pending = append(pending, flow{
+							to:      addr,
+							from:    f.from,
+							hasFrom: true,
+						})
 					}
 					if op.Data() {
 						if prg.SegTypes[ofs] == 0 {
 							prg.SegTypes[ofs] = SegData
 						}
 					}
+				case mos6510.AddrIND:
+					// The vector targets are resolved by
+					// resolveIndirect.
+					if ofs+1 < len(prg.Data) && prg.SegTypes[ofs] == 0 &&
+						prg.SegTypes[ofs+1] == 0 {
+						prg.SegTypes[ofs] = SegPtr
+						prg.SegTypes[ofs+1] = SegPtr
+					}
 				default:
-					return nil, fmt.Errorf("%04X: %v: %v not supported",
-						prg.DataToMem(pc), op, op.AddrMode())
+					return nil, prg.errorf(ErrCode, pc, "%v: %v not supported",
+						op, op.AddrMode())
 				}
 
 			}
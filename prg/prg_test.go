@@ -7,7 +7,16 @@
 package prg
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/markkurossi/mpc64/mos6510"
 )
 
 func TestLoad(t *testing.T) {
@@ -20,3 +29,2241 @@ func TestLoad(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// basicStub returns a PRG file with the BASIC line `10 SYS2061`
+// followed by code.
+func basicStub(code ...byte) []byte {
+	data := []byte{
+		0x01, 0x08, // Load address
+		0x0b, 0x08, // Next line
+		0x0a, 0x00, // Line number 10
+		0x9e, '2', '0', '6', '1', 0x00,
+		0x00, 0x00, // End of program
+	}
+	return append(data, code...)
+}
+
+func TestCFG(t *testing.T) {
+	// 080D: LDX #$00
+	// 080F: JSR $0816
+	// 0812: INX
+	// 0813: BNE $080F
+	// 0815: RTS
+	// 0816: LDA #$01
+	// 0818: RTS
+	prg, err := Parse(basicStub(
+		0xa2, 0x00,
+		0x20, 0x16, 0x08,
+		0xe8,
+		0xd0, 0xfa,
+		0x60,
+		0xa9, 0x01,
+		0x60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := prg.CFG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, start := range []uint16{0x080d, 0x080f, 0x0812, 0x0815, 0x0816} {
+		if cfg.Block(start) == nil {
+			t.Errorf("block %04X not found", start)
+		}
+	}
+	loop := cfg.Block(0x0812)
+	if len(loop.Succs) != 2 || len(cfg.Block(0x080f).Preds) != 2 {
+		t.Errorf("invalid loop edges")
+	}
+	if len(cfg.Subroutines) != 2 {
+		t.Fatalf("got %d subroutines, expected 2", len(cfg.Subroutines))
+	}
+	sub := cfg.Subroutine(0x0816)
+	if sub == nil || len(sub.Blocks) != 1 || !sub.Returns() {
+		t.Errorf("invalid subroutine $0816: %v", sub)
+	}
+	var buf bytes.Buffer
+	if err := cfg.DOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"080F" -> "sub_0816"`) {
+		t.Errorf("DOT output missing call edge:\n%s", buf.String())
+	}
+}
+
+func TestCallGraph(t *testing.T) {
+	// 080D: JSR $0814
+	// 0810: JSR $FFD2
+	// 0813: RTS
+	// 0814: JSR $0818
+	// 0817: RTS
+	// 0818: JSR $0814
+	// 081B: RTS
+	prg, err := Parse(basicStub(
+		0x20, 0x14, 0x08,
+		0x20, 0xd2, 0xff,
+		0x60,
+		0x20, 0x18, 0x08,
+		0x60,
+		0x20, 0x14, 0x08,
+		0x60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cg, err := prg.CallGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := cg.Function(0x080d)
+	if main == nil || len(main.Callees) != 2 || main.Recursive {
+		t.Errorf("invalid main function: %v", main)
+	}
+	if main.Start != 0x080d || main.End != 0x0814 {
+		t.Errorf("invalid main extent: $%04X-$%04X", main.Start, main.End)
+	}
+	chrout := cg.Function(0xffd2)
+	if chrout == nil || !chrout.External || !chrout.Leaf() {
+		t.Errorf("invalid external function: %v", chrout)
+	}
+	for _, addr := range []uint16{0x0814, 0x0818} {
+		f := cg.Function(addr)
+		if f == nil || !f.Recursive || f.Leaf() {
+			t.Errorf("function $%04X not recursive", addr)
+		}
+	}
+	var buf bytes.Buffer
+	if err := cg.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := cg.DOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// basicProgram returns a PRG file with the tokenized BASIC lines
+// followed by code. The line numbers are 10, 20, 30, etc.
+func basicProgram(lines [][]byte, code ...byte) []byte {
+	data := []byte{0x01, 0x08}
+	addr := 0x0801
+	for idx, line := range lines {
+		addr += 4 + len(line) + 1
+		data = append(data, byte(addr), byte(addr>>8))
+		data = append(data, byte((idx+1)*10), 0)
+		data = append(data, line...)
+		data = append(data, 0)
+	}
+	data = append(data, 0, 0)
+	return append(data, code...)
+}
+
+func TestSysEntries(t *testing.T) {
+	prg, err := Parse(basicProgram([][]byte{
+		{0x8f, ' ', 'H', 'E', 'L', 'L', 'O'},
+		{0x99, '"', 0x9e, '1', '"', ':', 0x9e, '(', '2', 0xac, '1', '0',
+			'2', '4', ')', 0xaa, '6', '4'},
+		{0x9e, ' ', '2', '1', '1', '5', ':', 0x9e, '6', '4', '7', '3', '8'},
+	},
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0xa9, 0x01, // 0x0840: LDA #$01
+		0x60, // 0x0842: RTS
+		0xea, // 0x0843: NOP
+		0x60, // 0x0844: RTS
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prg.Start != 0x0840 {
+		t.Errorf("invalid start $%04X, expected $0840", prg.Start)
+	}
+	if len(prg.Entries) != 2 || prg.Entries[1] != 0x0843 {
+		t.Errorf("invalid entries: %v", prg.Entries)
+	}
+	if prg.SegTypes[0x0843-0x0801] != SegCode {
+		t.Errorf("code not found at $0843")
+	}
+}
+
+func TestParseMachineCode(t *testing.T) {
+	data := []byte{
+		0x00, 0xc0, // Load address $C000
+		0xa9, 0x00, // C000: LDA #$00
+		0x8d, 0x20, 0xd0, // C002: STA $D020
+		0x60,       // C005: RTS
+		0x01, 0x02, // C006: .byte $01, $02
+		0xee, 0x20, 0xd0, // C008: INC $D020
+		0x60, // C00B: RTS
+	}
+	_, err := Parse(data)
+	if err == nil {
+		t.Errorf("Parse succeeded for machine code program")
+	}
+	prg, err := ParseWith(data, ParseOptions{
+		Auto: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prg.Start != 0xc000 || prg.SegTypes[0] != SegCode {
+		t.Errorf("invalid auto start $%04X", prg.Start)
+	}
+	prg, err = ParseWith(data, ParseOptions{
+		Entries: []uint16{0xc008},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prg.Start != 0xc008 || prg.SegTypes[0] != SegData ||
+		prg.SegTypes[8] != SegCode {
+		t.Errorf("invalid explicit entry $%04X: %v", prg.Start, prg.SegTypes)
+	}
+	_, err = ParseWith(data, ParseOptions{
+		Entries: []uint16{0x0801},
+	})
+	if err == nil {
+		t.Errorf("ParseWith accepted entry outside program")
+	}
+}
+
+func TestListBasic(t *testing.T) {
+	prg, err := Parse(basicProgram([][]byte{
+		{0x99, ' ', '"', 0x93, 0x1c, 'H', 'I', 0xff, '"', ';', 0xff},
+		{0x8f, ' ', 'S', 'Y', 'S', 0x99},
+		{0x9e, '2', '0', '6', '1'},
+		{0x8f, '"', 0x99, '"', 0x99, 0xcc},
+	}, 0x60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := prg.ListBasic(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `10 PRINT "{clr}{red}HI{$FF}";π
+20 REM SYSPRINT
+30 SYS2061
+40 REM"{lgrn}"PRINT{$CC}
+`
+	if buf.String() != expected {
+		t.Errorf("ListBasic: got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+
+	// The listing must tokenize back to the same lines, except for
+	// the REM lines with keyword tokens that LIST expands but
+	// Tokenize stores as text.
+	prg2, err := Tokenize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, _, err := prg.BasicLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines2, _, err := prg2.BasicLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != len(lines2) {
+		t.Fatalf("round-trip: got %d lines, expected %d",
+			len(lines2), len(lines))
+	}
+	for idx, line := range lines {
+		if remKeywords(line.Data) {
+			continue
+		}
+		if !bytes.Equal(line.Data, lines2[idx].Data) {
+			t.Errorf("round-trip: line %d: got %x, expected %x",
+				line.Number, lines2[idx].Data, line.Data)
+		}
+	}
+}
+
+// remKeywords tests if the line data has keyword tokens after REM.
+func remKeywords(data []byte) bool {
+	idx := bytes.IndexByte(data, 0x8f)
+	if idx < 0 {
+		return false
+	}
+	for _, b := range data[idx+1:] {
+		if b >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTokenize(t *testing.T) {
+	source := `10 PRINT "{CLR}{red}HI";π
+20 rem sys print
+30 ?"A":pO53280,0:DATA PRINT,"{$FF}":sys 2061
+`
+	prg, err := Tokenize(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prg.Load != BasicStart {
+		t.Errorf("invalid load address $%04X", prg.Load)
+	}
+	var buf bytes.Buffer
+	if err := prg.ListBasic(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `10 PRINT "{clr}{red}HI";π
+20 REM SYS PRINT
+30 PRINT"A":POKE53280,0:DATA PRINT,"{$FF}":SYS 2061
+`
+	if buf.String() != expected {
+		t.Errorf("Tokenize: got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+
+	// The listing must tokenize back to the same program.
+	prg2, err := Tokenize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(prg.Bytes(), prg2.Bytes()) {
+		t.Errorf("round-trip failed")
+	}
+
+	// The text after REM is stored as is.
+	prg, err = Tokenize(strings.NewReader("10 REM STORE TOTAL\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, _, err := prg.BasicLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rem := []byte{0x8f, ' ', 'S', 'T', 'O', 'R', 'E', ' ', 'T', 'O', 'T', 'A', 'L'}
+	if len(lines) != 1 || !bytes.Equal(lines[0].Data, rem) {
+		t.Errorf("REM text tokenized: %v", lines)
+	}
+
+	_, err = Tokenize(strings.NewReader("20 END\n10 END\n"))
+	if err == nil {
+		t.Errorf("Tokenize accepted lines out of order")
+	}
+}
+
+func TestDetectData(t *testing.T) {
+	for _, ref := range []bool{true, false} {
+		prg, err := ParseWith(detectData(ref), ParseOptions{
+			Entries: []uint16{0x3810},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			from, to int
+			t        SegType
+		}{
+			{0x0000, 0x0006, SegPtr},
+			{0x0006, 0x0011, SegScreen},
+			{0x0011, 0x0040, SegData},
+			{0x0040, 0x0040 + SpriteSize, SegSprite},
+			{0x0800, 0x0810, SegChar},
+			{0x0810, 0x081e, SegCode},
+		}
+		if !ref {
+			// The unreferenced pointer table is only a warning.
+			for i := 0; i < 6; i++ {
+				if prg.SegTypes[i] == SegPtr {
+					t.Errorf("$%04X: unreferenced table marked as %v",
+						prg.DataToMem(i), prg.SegTypes[i])
+					break
+				}
+			}
+			tests = tests[1:]
+			if len(prg.Warnings) != 1 || prg.Warnings[0].Kind != WarnTable ||
+				prg.Warnings[0].Addr != 0x3000 {
+				t.Errorf("invalid warnings: %v", prg.Warnings)
+			}
+		}
+		for _, test := range tests {
+			for i := test.from; i < test.to; i++ {
+				if prg.SegTypes[i] != test.t {
+					t.Errorf("$%04X: got %v, expected %v",
+						prg.DataToMem(i), prg.SegTypes[i], test.t)
+					break
+				}
+			}
+		}
+		if err := prg.Print(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// detectData returns a program with typed data segments. If ref is
+// true, the code references the pointer table at $3000.
+func detectData(ref bool) []byte {
+	data := make([]byte, 2+0x081e)
+	bo.PutUint16(data, 0x3000)
+	mem := data[2:]
+
+	// Pointer table.
+	copy(mem[0x0000:], []byte{0x10, 0x38, 0x15, 0x38, 0x1a, 0x38})
+	// Screen codes: "HELLO WORLD".
+	copy(mem[0x0006:], []byte{
+		0x08, 0x05, 0x0c, 0x0c, 0x0f, 0x20, 0x17, 0x0f, 0x12, 0x0c, 0x04,
+	})
+	// Sprite.
+	for i := 0; i < SpriteSize; i++ {
+		mem[0x0040+i] = 0x18
+	}
+	// Character set.
+	for i := 0; i < 2*CharSize; i++ {
+		mem[0x0800+i] = 0x3c
+	}
+	// Code.
+	table := byte(0x00)
+	if !ref {
+		table = 0x40
+	}
+	copy(mem[0x0810:], []byte{
+		0xa9, 0xc1, // LDA #$C1
+		0x8d, 0xf8, 0x07, // STA $07F8
+		0xa9, 0x1e, // LDA #$1E
+		0x8d, 0x18, 0xd0, // STA $D018
+		0xbd, table, 0x30, // LDA $30xx,X
+		0x60, // RTS
+	})
+	return data
+}
+
+func TestDetectWords(t *testing.T) {
+	for _, test := range []struct {
+		arg byte
+		t   SegType
+	}{
+		{0x00, SegWord},
+		{0x06, SegData},
+	} {
+		prg, err := ParseWith([]byte{
+			0x00, 0xc0,
+			0x06, 0xc0, 0x07, 0xc0, 0x08, 0xc0, // C000: .word $C006, $C007, $C008
+			0x01, 0x02, 0x03, // C006: data
+			0xbd, test.arg, 0xc0, // C009: LDA $C0xx,X
+			0x60, // C00C: RTS
+		}, ParseOptions{
+			Entries: []uint16{0xc009},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prg.SegTypes[0] != test.t {
+			t.Errorf("LDA $C0%02X,X: got %v, expected %v", test.arg,
+				prg.SegTypes[0], test.t)
+		}
+	}
+}
+
+func TestStrings(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0x48, 0x45, 0x4c, 0x4c, 0x4f, 0x00, // C000: "hello", 0
+		0x42, 0x59, 0xc5, // C006: "by" + ("e" | $80)
+		0x48, 0x49, 0x00, // C009: "hi", 0
+		0xa9, 0x09, // C00C: LDA #$09
+		0xa0, 0xc0, // C00E: LDY #$C0
+		0x20, 0x1e, 0xab, // C010: JSR $AB1E
+		0xbd, 0x06, 0xc0, // C013: LDA $C006,X
+		0x60, // C016: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc00c},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := prg.Strings()
+	if len(strs) != 3 {
+		t.Fatalf("got %d strings, expected 3", len(strs))
+	}
+	tests := []struct {
+		addr uint16
+		text string
+		term StringTerm
+		ref  uint16
+		call bool
+	}{
+		{0xc000, "hello", TermZero, 0, false},
+		{0xc006, "bye", TermHighBit, 0xc013, false},
+		{0xc009, "hi", TermZero, 0xc010, true},
+	}
+	for idx, test := range tests {
+		str := strs[idx]
+		if str.Addr != test.addr || str.String() != test.text ||
+			str.Term != test.term {
+			t.Errorf("string %d: got $%04X %q %v, expected $%04X %q %v",
+				idx, str.Addr, str, str.Term, test.addr, test.text, test.term)
+		}
+		if test.ref == 0 {
+			if len(str.Refs) != 0 {
+				t.Errorf("string %d: unexpected refs %v", idx, str.Refs)
+			}
+			continue
+		}
+		if len(str.Refs) != 1 || str.Refs[0].Instr != test.ref ||
+			str.Refs[0].Call != test.call {
+			t.Errorf("string %d: invalid refs %v", idx, str.Refs)
+		}
+	}
+	if !strs[2].Refs[0].Call || strs[2].Refs[0].Routine != 0xab1e {
+		t.Errorf("invalid string routine: %v", strs[2].Refs[0])
+	}
+
+	// Strings with control codes.
+	prg, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0x93, 0x48, 0x45, 0x4c, 0x4c, 0x4f, 0x0d, 0x00, // C000: "{clr}hello{return}", 0
+		0x1c, 0x47, 0x41, 0x4d, 0x45, 0x20, 0x4f, 0x56,
+		0x45, 0x52, 0x0d, // C008: "{red}game over{return}"
+		0xff, 0x11, 0x11, 0x0d, // C013: $FF, "{down}{down}{return}"
+		0xa9, 0x00, // C017: LDA #$00
+		0xa0, 0xc0, // C019: LDY #$C0
+		0x20, 0x1e, 0xab, // C01B: JSR $AB1E
+		0x60, // C01E: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc017},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs = prg.Strings()
+	if len(strs) != 2 {
+		t.Fatalf("got %d strings, expected 2: %v", len(strs), strs)
+	}
+	for idx, text := range []string{
+		"{clr}hello{return}", "{red}game over{return}",
+	} {
+		if strs[idx].String() != text {
+			t.Errorf("string %d: got %q, expected %q", idx, strs[idx], text)
+		}
+	}
+	if strs[0].Term != TermZero || len(strs[0].Refs) != 1 {
+		t.Errorf("invalid string: %v %v", strs[0].Term, strs[0].Refs)
+	}
+}
+
+func TestIndirect(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0x78,       // C000: SEI
+		0xa9, 0x39, // C001: LDA #<irq
+		0x8d, 0x14, 0x03, // C003: STA $0314
+		0xa9, 0xc0, // C006: LDA #>irq
+		0x8d, 0x15, 0x03, // C008: STA $0315
+		0x58,             // C00B: CLI
+		0x20, 0x20, 0xc0, // C00C: JSR dispatch
+		0xa2, 0x01, // C00F: LDX #$01
+		0xbd, 0x29, 0xc0, // C011: LDA lo,X
+		0x8d, 0x27, 0xc0, // C014: STA vec
+		0xbd, 0x2b, 0xc0, // C017: LDA hi,X
+		0x8d, 0x28, 0xc0, // C01A: STA vec+1
+		0x6c, 0x27, 0xc0, // C01D: JMP (vec)
+		0xa9, 0xc0, // C020: dispatch: LDA #>(h3-1)
+		0x48,       // C022: PHA
+		0xa9, 0x34, // C023: LDA #<(h3-1)
+		0x48,       // C025: PHA
+		0x60,       // C026: RTS
+		0x00, 0x00, // C027: vec
+		0x2d, 0x31, // C029: lo
+		0xc0, 0xc0, // C02B: hi
+		0xee, 0x20, 0xd0, 0x60, // C02D: h1: INC $D020, RTS
+		0xee, 0x21, 0xd0, 0x60, // C031: h2: INC $D021, RTS
+		0xce, 0x20, 0xd0, 0x60, // C035: h3: DEC $D020, RTS
+		0xee, 0x19, 0xd0, // C039: irq: INC $D019
+		0x4c, 0x31, 0xea, // C03C: JMP $EA31
+	}, ParseOptions{
+		Auto: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []uint16{0xc02d, 0xc031, 0xc035, 0xc039} {
+		if !prg.isCode(addr) {
+			t.Errorf("$%04X not code", addr)
+		}
+	}
+	for _, addr := range []uint16{0xc027, 0xc029, 0xc02a, 0xc02b, 0xc02c} {
+		if prg.isCode(addr) {
+			t.Errorf("$%04X is code", addr)
+		}
+	}
+	if len(prg.Indirect[0xc01d]) != 2 {
+		t.Errorf("JMP (vec) targets: %v", prg.Indirect[0xc01d])
+	}
+	if len(prg.Indirect[0xc026]) != 1 || prg.Indirect[0xc026][0] != 0xc035 {
+		t.Errorf("RTS dispatch targets: %v", prg.Indirect[0xc026])
+	}
+	cfg, err := prg.CFG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Block(0xc00f).Succs) != 2 {
+		t.Errorf("JMP (vec) successors: %v", cfg.Block(0xc00f).Succs)
+	}
+
+	// SEI between the loads and the stores keeps the registers.
+	prg, err = ParseWith(irqSetup, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prg.Entries) != 2 || prg.Entries[1] != 0xc00d {
+		t.Errorf("IRQ handler $C00D not resolved: %v", prg.Entries)
+	}
+}
+
+// irqSetup sets the IRQ vector with SEI between the loads and the
+// stores.
+var irqSetup = []byte{
+	0x00, 0xc0,
+	0xa9, 0x0d, // C000: LDA #<irq
+	0xa2, 0xc0, // C002: LDX #>irq
+	0x78,             // C004: SEI
+	0x8d, 0x14, 0x03, // C005: STA $0314
+	0x8e, 0x15, 0x03, // C008: STX $0315
+	0x58,             // C00B: CLI
+	0x60,             // C00C: RTS
+	0xee, 0x19, 0xd0, // C00D: irq: INC $D019
+	0x4c, 0x31, 0xea, // C010: JMP $EA31
+}
+
+func TestConflicts(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0xa9, 0x01, // C000: LDA #$01
+		0x2c,       // C002: BIT $02A9
+		0xa9, 0x02, // C003: LDA #$02
+		0x8d, 0x20, 0xd0, // C005: STA $D020
+		0x60,             // C008: RTS
+		0x4c, 0x03, 0xc0, // C009: JMP $C003
+	}, ParseOptions{
+		Entries: []uint16{0xc000, 0xc009},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prg.Conflicts) != 1 {
+		t.Fatalf("got %d conflicts, expected 1: %v",
+			len(prg.Conflicts), prg.Conflicts)
+	}
+	c := prg.Conflicts[0]
+	if c.Kind != ConflictOperand || c.Addr != 0xc003 || c.Instr != 0xc002 ||
+		!c.HasFrom || c.From != 0xc009 {
+		t.Errorf("invalid conflict: %v", c)
+	}
+	for _, addr := range []uint16{0xc000, 0xc002, 0xc003, 0xc005} {
+		if !prg.InstrStart(addr) {
+			t.Errorf("no instruction at $%04X", addr)
+		}
+	}
+	if err := prg.Print(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSelfModifying(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0xa2, 0x00, // C000: LDX #$00
+		0x8e, 0x0d, 0xc0, // C002: STX $C00D
+		0xee, 0x0c, 0xc0, // C005: INC $C00C
+		0x8c, 0x0d, 0xc0, // C008: STY $C00D
+		0x60,       // C00B: RTS
+		0xa9, 0x00, // C00C: LDA #$00
+		0x60,       // C00E: RTS
+		0xa2, 0x03, // C00F: LDX #$03
+		0x8d, 0x1c, 0xc0, // C011: STA $C01C
+		0x9d, 0x1b, 0xc0, // C014: STA $C01B,X
+		0xca,       // C017: DEX
+		0x10, 0xfa, // C018: BPL $C014
+		0x60,       // C01A: RTS
+		0xa0, 0x00, // C01B: LDY #$00
+		0xc8, // C01D: INY
+		0x60, // C01E: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000, 0xc00c, 0xc00f, 0xc01b},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	smc := prg.SelfModifying()
+	expected := []SMC{
+		{
+			Instr:  0xc005,
+			Addr:   0xc00c,
+			Target: 0xc00c,
+		},
+		{
+			Instr:   0xc002,
+			Addr:    0xc00d,
+			Target:  0xc00c,
+			Operand: true,
+		},
+		{
+			Instr:   0xc008,
+			Addr:    0xc00d,
+			Target:  0xc00c,
+			Operand: true,
+		},
+	}
+	if len(smc) != len(expected) {
+		t.Fatalf("got %d SMC sites, expected %d: %v",
+			len(smc), len(expected), smc)
+	}
+	for idx, s := range smc {
+		if s != expected[idx] {
+			t.Errorf("SMC %d: got %v, expected %v", idx, s, expected[idx])
+		}
+	}
+	if prg.SegTypes[0x0d] != SegCode {
+		t.Errorf("modified operand is %v, expected code", prg.SegTypes[0x0d])
+	}
+	comments := prg.comments()
+	comment := "SMC: opcode modified by $C005, SMC: operand modified by $C002, $C008"
+	if comments[0xc00c] != comment {
+		t.Errorf("comment: got %q, expected %q", comments[0xc00c], comment)
+	}
+	if err := prg.Print(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestXRef(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0xa2, 0x00, // C000: LDX #$00
+		0xbd, 0x12, 0xc0, // C002: LDA $C012,X
+		0x9d, 0x00, 0x04, // C005: STA $0400,X
+		0xe6, 0xfb, // C008: INC $FB
+		0xb1, 0xfb, // C00A: LDA ($FB),Y
+		0x20, 0xd2, 0xff, // C00C: JSR $FFD2
+		0xd0, 0xf1, // C00F: BNE $C002
+		0x60, // C011: RTS
+		0x01, 0x02,
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	xref, err := prg.XRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr  uint16
+		from  uint16
+		kind  RefKind
+		index byte
+	}{
+		{0x00fb, 0xc008, RefModify, 0},
+		{0x00fb, 0xc00a, RefPointer, 'Y'},
+		{0x00fc, 0xc00a, RefPointer, 'Y'},
+		{0x0400, 0xc005, RefWrite, 'X'},
+		{0xc002, 0xc00f, RefJump, 0},
+		{0xc012, 0xc002, RefRead, 'X'},
+		{0xffd2, 0xc00c, RefCall, 0},
+	}
+	if len(xref.Refs) != len(tests) {
+		t.Fatalf("got %d refs, expected %d", len(xref.Refs), len(tests))
+	}
+	for idx, test := range tests {
+		ref := xref.Refs[idx]
+		if ref.Addr != test.addr || ref.Instr.Addr != test.from ||
+			ref.Kind != test.kind || ref.Index != test.index {
+			t.Errorf("ref %d: got %04X %v %v %c, expected %04X %v %v %c",
+				idx, ref.Addr, ref.Instr, ref.Kind, ref.Index,
+				test.addr, test.from, test.kind, test.index)
+		}
+	}
+	if refs := xref.To(0x00fb); len(refs) != 2 {
+		t.Errorf("got %d refs to $FB, expected 2", len(refs))
+	}
+	if err := xref.Print(os.Stdout); err != nil {
+		t.Error(err)
+	}
+
+	var buf bytes.Buffer
+	if err := xref.JSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var v []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 6 {
+		t.Errorf("got %d JSON addresses, expected 6", len(v))
+	}
+}
+
+func TestZeroPage(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0xa9, 0x00, // C000: LDA #$00
+		0x85, 0xfb, // C002: STA $FB
+		0x85, 0xc6, // C004: STA $C6
+		0xa5, 0xc5, // C006: LDA $C5
+		0x91, 0xfb, // C008: STA ($FB),Y
+		0x60, // C00A: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zp, err := prg.ZeroPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zp.Used) != 4 {
+		t.Fatalf("got %d used locations, expected 4", len(zp.Used))
+	}
+	fb := zp.Used[2]
+	if fb.Addr != 0xfb || !fb.Write || !fb.Pointer || fb.Read ||
+		fb.Owner != ZPFree {
+		t.Errorf("invalid $FB usage: %+v", fb)
+	}
+	conflicts := zp.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Addr != 0xc6 ||
+		conflicts[0].Name != "NDX" {
+		t.Errorf("invalid conflicts: %+v", conflicts)
+	}
+	expected := []byte{0x02, 0xfd, 0xfe}
+	if !bytes.Equal(zp.Free, expected) {
+		t.Errorf("got free %x, expected %x", zp.Free, expected)
+	}
+	if err := zp.Print(os.Stdout); err != nil {
+		t.Error(err)
+	}
+
+	// The STA $02,X loop with X from $19 to $00 writes $02-$1B.
+	prg, err = Load("hello.prg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zp, err = prg.ZeroPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range zp.Used {
+		if u.Addr < 0x03 || u.Addr > 0x1b {
+			continue
+		}
+		var loop bool
+		for _, ref := range u.Refs {
+			if ref.Instr.Addr == 0x082e {
+				loop = true
+			}
+		}
+		if !loop || !u.Conflict() {
+			t.Errorf("$%02X not written by STA $02,X: %+v", u.Addr, u)
+		}
+	}
+	if len(zp.BasicFree) == 0 || zp.BasicFree[0] != 0x1c {
+		t.Errorf("invalid free without BASIC: %x", zp.BasicFree)
+	}
+
+	// The index range is not known after TAX.
+	prg, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0xaa,       // C000: TAX
+		0xb5, 0xf0, // C001: LDA $F0,X
+		0x60, // C003: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zp, err = prg.ZeroPage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zp.Unknown) != 15 || zp.Unknown[0] != 0xf1 ||
+		!bytes.Equal(zp.Free, []byte{0x02}) {
+		t.Errorf("invalid unknown %x, free %x", zp.Unknown, zp.Free)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0xa2, 0x08, // C000: LDX #$08
+		0xbd, 0xf0, 0xc0, // C002: LDA $C0F0,X
+		0x1d, 0xf8, 0xc0, // C005: ORA $C0F8,X
+		0x9d, 0x00, 0x04, // C008: STA $0400,X
+		0xca,       // C00B: DEX
+		0xd0, 0xf4, // C00C: BNE $C002
+		0xa0, 0x01, // C00E: LDY #$01
+		0xb9, 0xfe, 0xc0, // C010: LDA $C0FE,Y
+		0xb9, 0xfe, 0xc1, // C013: LDA $C1FE,Y
+		0xbe, 0xfe, 0xc1, // C016: LDX $C1FE,Y
+		0x60, // C019: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := prg.CFG()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// X is 1-8 in the loop: only ORA $C0F8,X crosses a page.
+	min, max := cfg.Block(0xc002).Cycles()
+	if min != 17 || max != 19 {
+		t.Errorf("block cycles: got %d-%d, expected 17-19", min, max)
+	}
+	crosses := cfg.Block(0xc002).PageCrosses()
+	if len(crosses) != 1 || crosses[0].Addr != 0xc005 {
+		t.Errorf("invalid page crossings: %v", crosses)
+	}
+
+	// Y is 1 after LDY #$01: LDA $C0FE,Y does not cross a page.
+	crosses = cfg.Block(0xc00e).PageCrosses()
+	if len(crosses) != 0 {
+		t.Errorf("invalid page crossings: %v", crosses)
+	}
+	min, max, err = cfg.PathCycles(0xc000, 0xc002, 0xc00e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if min != 39 || max != 40 {
+		t.Errorf("path cycles: got %d-%d, expected 39-40", min, max)
+	}
+	loops := cfg.Loops()
+	if len(loops) != 1 {
+		t.Fatalf("got %d loops, expected 1", len(loops))
+	}
+	loop := loops[0]
+	if loop.Counter != 'X' || loop.Iterations != 8 ||
+		loop.CounterMin != 1 || loop.CounterMax != 8 ||
+		loop.Min != 143 || loop.Max != 151 {
+		t.Errorf("invalid loop: %v", loop)
+	}
+	if err := prg.PrintCycles(os.Stdout); err != nil {
+		t.Error(err)
+	}
+
+	// LAX writes A and X but not the Y loop counter.
+	prg, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0xa0, 0x04, // C000: LDY #$04
+		0xa7, 0xfb, // C002: LAX $FB
+		0x88,       // C004: DEY
+		0xd0, 0xfb, // C005: BNE $C002
+		0x60, // C007: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = prg.CFG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loops = cfg.Loops()
+	if len(loops) != 1 {
+		t.Fatalf("got %d loops, expected 1", len(loops))
+	}
+	loop = loops[0]
+	if loop.Counter != 'Y' || loop.Iterations != 4 {
+		t.Errorf("invalid LAX loop: %v", loop)
+	}
+}
+
+func TestStack(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0x48,             // C000: PHA
+		0x20, 0x06, 0xc0, // C001: JSR $C006
+		0x68, // C004: PLA
+		0x60, // C005: RTS
+		0x08, // C006: PHP
+		0x08, // C007: PHP
+		0x68, // C008: PLA
+		0x68, // C009: PLA
+		0x68, // C00A: PLA
+		0x60, // C00B: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := prg.Stack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("got %d subroutines, expected 2", len(infos))
+	}
+	main, sub := infos[0], infos[1]
+	if main.Own != 1 || main.Max != 5 || !main.Bounded || !main.Balanced() {
+		t.Errorf("invalid main stack: %+v", main)
+	}
+	if sub.Own != 2 || sub.Max != 2 || sub.Balanced() {
+		t.Errorf("invalid sub stack: %+v", sub)
+	}
+	if len(sub.Issues) != 2 || sub.Issues[0].Kind != StackPullReturn ||
+		sub.Issues[0].Addr != 0xc00a || sub.Issues[1].Kind != StackUnbalanced {
+		t.Errorf("invalid sub issues: %v", sub.Issues)
+	}
+
+	prg, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0xa2, 0xff, // C000: LDX #$FF
+		0x9a,             // C002: TXS
+		0x48,             // C003: PHA
+		0x48,             // C004: PHA
+		0x20, 0x0b, 0xc0, // C005: JSR $C00B
+		0x68, // C008: PLA
+		0x68, // C009: PLA
+		0x60, // C00A: RTS
+		0x48, // C00B: PHA
+		0x68, // C00C: PLA
+		0x60, // C00D: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err = prg.Stack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	main = infos[0]
+	if main.Own != 2 || main.Max != 5 || !main.Bounded {
+		t.Errorf("invalid main stack after TXS: %+v", main)
+	}
+	if len(main.Issues) != 1 || main.Issues[0].Kind != StackSetSP ||
+		!main.Balanced() {
+		t.Errorf("invalid main issues after TXS: %v", main.Issues)
+	}
+
+	// The depth after TXS follows the immediate X value.
+	prg, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0xa2, 0xf7, // C000: LDX #$F7
+		0x9a, // C002: TXS
+		0x48, // C003: PHA
+		0x68, // C004: PLA
+		0x60, // C005: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err = prg.Stack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	main = infos[0]
+	if main.Own != 9 || main.Max != 9 || !main.Bounded {
+		t.Errorf("invalid main stack after LDX #$F7, TXS: %+v", main)
+	}
+	if err := prg.PrintStack(os.Stdout); err != nil {
+		t.Error(err)
+	}
+
+	// RTS dispatching to an address pushed on the stack.
+	prg, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0x20, 0x04, 0xc0, // C000: JSR $C004
+		0x60,       // C003: RTS
+		0xa9, 0xc0, // C004: LDA #>$C00A
+		0x48,       // C006: PHA
+		0xa9, 0x0a, // C007: LDA #<$C00A
+		0x48,             // C009: PHA
+		0x60,             // C00A: RTS
+		0xee, 0x20, 0xd0, // C00B: INC $D020
+		0x60, // C00E: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+		Emulate: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prg.Indirect[0xc00a]) != 1 || prg.Indirect[0xc00a][0] != 0xc00b {
+		t.Fatalf("RTS dispatch not resolved: %v", prg.Indirect)
+	}
+	infos, err = prg.Stack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Entry != 0xc004 {
+			continue
+		}
+		if info.Own != 2 || len(info.Issues) != 1 ||
+			info.Issues[0].Kind != StackPushReturn {
+			t.Errorf("invalid RTS dispatch stack: %+v", info)
+		}
+	}
+	if err := prg.PrintStack(os.Stdout); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmulate(t *testing.T) {
+	data := []byte{
+		0x00, 0xc0,
+		0xa9, 0x01, // C000: LDA #$01
+		0x20, 0xd2, 0xff, // C002: JSR $FFD2
+		0x60,       // C005: RTS
+		0xa9, 0xf0, // C006: LDA #$F0
+		0x18,       // C008: CLC
+		0x69, 0x10, // C009: ADC #$10
+		0x85, 0xfb, // C00B: STA $FB
+		0xa9, 0xc0, // C00D: LDA #$C0
+		0x85, 0xfc, // C00F: STA $FC
+		0x6c, 0xfb, 0x00, // C011: JMP ($00FB)
+	}
+	prg, err := ParseWith(data, ParseOptions{
+		Entries: []uint16{0xc006},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prg.InstrStart(0xc000) {
+		t.Fatalf("computed jump target found statically")
+	}
+	trace, err := prg.Emulate(EmulateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.Stop != StopExit || len(trace.Executed) != 10 {
+		t.Errorf("invalid trace: %+v", trace)
+	}
+	if targets := trace.Jumps[0xc011]; len(targets) != 1 ||
+		targets[0] != 0xc000 {
+		t.Errorf("invalid jump targets: %x", targets)
+	}
+
+	prg, err = ParseWith(data, ParseOptions{
+		Entries: []uint16{0xc006},
+		Emulate: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint16{0xc000, 0xc002, 0xc005}
+	if len(prg.Dynamic) != len(expected) {
+		t.Fatalf("got dynamic %x, expected %x", prg.Dynamic, expected)
+	}
+	for idx, addr := range expected {
+		if prg.Dynamic[idx] != addr || !prg.InstrStart(addr) {
+			t.Errorf("dynamic instruction $%04X not found", addr)
+		}
+	}
+	if targets := prg.Indirect[0xc011]; len(targets) != 1 {
+		t.Errorf("invalid indirect targets: %x", targets)
+	}
+	if err := prg.Print(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnpack(t *testing.T) {
+	packed, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0xa2, 0x00, // C000: LDX #$00
+		0xbd, 0x12, 0xc0, // C002: LDA $C012,X
+		0x49, 0xff, // C005: EOR #$FF
+		0x9d, 0x00, 0x40, // C007: STA $4000,X
+		0xe8,       // C00A: INX
+		0xe0, 0x06, // C00B: CPX #$06
+		0xd0, 0xf3, // C00D: BNE $C002
+		0x4c, 0x00, 0x40, // C00F: JMP $4000
+		// Packed LDA #$05, STA $D020, RTS
+		0x56, 0xfa, 0x72, 0xdf, 0x2f, 0x9f,
+	}, ParseOptions{
+		Auto: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prg, err := packed.Unpack(UnpackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prg.Load != 0x4000 || prg.Start != 0x4000 || len(prg.Data) != 6 {
+		t.Fatalf("invalid unpacked program: load=$%04X start=$%04X len=%d",
+			prg.Load, prg.Start, len(prg.Data))
+	}
+	for _, addr := range []uint16{0x4000, 0x4002, 0x4005} {
+		if !prg.InstrStart(addr) {
+			t.Errorf("no instruction at $%04X", addr)
+		}
+	}
+	if err := prg.Print(); err != nil {
+		t.Error(err)
+	}
+
+	// Decruncher copying itself to $CF00 before unpacking.
+	packed, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0xa2, 0x00, // C000: LDX #$00
+		0xbd, 0x10, 0xc0, // C002: LDA $C010,X
+		0x9d, 0x00, 0xcf, // C005: STA $CF00,X
+		0xe8,       // C008: INX
+		0xe0, 0x12, // C009: CPX #$12
+		0xd0, 0xf5, // C00B: BNE $C002
+		0x4c, 0x00, 0xcf, // C00D: JMP $CF00
+		0xa2, 0x00, // C010: CF00: LDX #$00
+		0xbd, 0x22, 0xc0, // C012: CF02: LDA $C022,X
+		0x49, 0xff, // C015: CF05: EOR #$FF
+		0x9d, 0x00, 0x40, // C017: CF07: STA $4000,X
+		0xe8,       // C01A: CF0A: INX
+		0xe0, 0x06, // C01B: CF0B: CPX #$06
+		0xd0, 0xf3, // C01D: CF0D: BNE $CF02
+		0x4c, 0x00, 0x40, // C01F: CF0F: JMP $4000
+		// Packed LDA #$05, STA $D020, RTS
+		0x56, 0xfa, 0x72, 0xdf, 0x2f, 0x9f,
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prg, err = packed.Unpack(UnpackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prg.Load != 0x4000 || prg.Start != 0x4000 || len(prg.Data) != 6 {
+		t.Errorf("invalid unpacked program: load=$%04X start=$%04X len=%d",
+			prg.Load, prg.Start, len(prg.Data))
+	}
+
+	// The load range spans all written blocks.
+	packed, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0xa9, 0x30, // C000: LDA #$30
+		0x0a,             // C002: ASL
+		0x8d, 0x00, 0x40, // C003: STA $4000
+		0x8d, 0x10, 0x40, // C006: STA $4010
+		0x8d, 0x20, 0xd0, // C009: STA $D020
+		0x4c, 0x00, 0x40, // C00C: JMP $4000
+	}, ParseOptions{
+		Auto: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prg, err = packed.Unpack(UnpackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prg.Load != 0x4000 || prg.Start != 0x4000 || len(prg.Data) != 0x11 {
+		t.Errorf("invalid unpacked program: load=$%04X start=$%04X len=%d",
+			prg.Load, prg.Start, len(prg.Data))
+	}
+
+	// Packed BASIC program started with RUN in the BASIC ROM.
+	packed, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0xa2, 0x00, // C000: LDX #$00
+		0xbd, 0x18, 0xc0, // C002: LDA $C018,X
+		0x9d, 0x01, 0x08, // C005: STA $0801,X
+		0xe8,       // C008: INX
+		0xe0, 0x12, // C009: CPX #$12
+		0xd0, 0xf5, // C00B: BNE $C002
+		0xa9, 0x13, // C00D: LDA #$13
+		0x85, 0x2d, // C00F: STA $2D
+		0xa9, 0x08, // C011: LDA #$08
+		0x85, 0x2e, // C013: STA $2E
+		0x4c, 0xae, 0xa7, // C015: JMP $A7AE
+		// 10 SYS2061
+		0x0b, 0x08, 0x0a, 0x00, 0x9e, '2', '0', '6', '1', 0x00, 0x00, 0x00,
+		0xa9, 0x05, // 080D: LDA #$05
+		0x8d, 0x20, 0xd0, // 080F: STA $D020
+		0x60, // 0812: RTS
+	}, ParseOptions{
+		Auto: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prg, err = packed.Unpack(UnpackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prg.Load != BasicStart || prg.Start != 0x080d || len(prg.Data) != 0x12 {
+		t.Errorf("invalid unpacked program: load=$%04X start=$%04X len=%d",
+			prg.Load, prg.Start, len(prg.Data))
+	}
+}
+
+func TestCompareTargets(t *testing.T) {
+	parse := func(call, table byte) *Prg {
+		p, err := ParseWith([]byte{
+			0x00, 0xc0,
+			0x20, call, 0xc0, // C000: JSR $C0xx
+			0x20, 0x0e, 0xc0, // C003: JSR $C00E
+			0xbd, table, 0xc0, // C006: LDA $C0xx,X
+			0x60,             // C009: RTS
+			0xad, 0x12, 0xc0, // C00A: LDA $C012
+			0x60,             // C00D: RTS
+			0xad, 0x16, 0xc0, // C00E: LDA $C016
+			0x60,                   // C011: RTS
+			0x01, 0x02, 0x03, 0x04, // C012: data
+			0x05, 0x06, 0x07, 0x08, // C016: data
+		}, ParseOptions{
+			Entries: []uint16{0xc000, 0xc00a},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	a := parse(0x0a, 0x12)
+	for _, b := range []*Prg{parse(0x0e, 0x12), parse(0x0a, 0x16)} {
+		diff, err := Compare(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rd := range diff.Routines {
+			expected := DiffSame
+			if rd.EntryA == 0xc000 {
+				expected = DiffChanged
+			}
+			if rd.Status != expected || rd.EntryA != rd.EntryB {
+				t.Errorf("routine $%04X: got %v $%04X, expected %v",
+					rd.EntryA, rd.Status, rd.EntryB, expected)
+			}
+			if rd.EntryA != 0xc000 {
+				continue
+			}
+			var changed []uint16
+			for _, l := range rd.Lines {
+				if l.Op == '-' {
+					changed = append(changed, l.A.Addr)
+				}
+			}
+			if len(changed) != 1 {
+				t.Errorf("invalid diff lines: %v", rd.Lines)
+			}
+		}
+		if err := diff.Print(os.Stdout, "a.prg", "b.prg"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0x20, 0x07, 0xc0, // C000: JSR $C007
+		0x20, 0x19, 0xc0, // C003: JSR $C019
+		0x60,       // C006: RTS
+		0xa9, 0x00, // C007: LDA #$00
+		0xa2, 0x08, // C009: LDX #$08
+		0x46, 0xfb, // C00B: LSR $FB
+		0x90, 0x03, // C00D: BCC $C012
+		0x18,       // C00F: CLC
+		0x65, 0xfc, // C010: ADC $FC
+		0x6a,       // C012: ROR
+		0x66, 0xfb, // C013: ROR $FB
+		0xca,       // C015: DEX
+		0xd0, 0xf5, // C016: BNE $C00D
+		0x60,             // C018: RTS
+		0xad, 0x12, 0xd0, // C019: LDA $D012
+		0xc9, 0x80, // C01C: CMP #$80
+		0xd0, 0xf9, // C01E: BNE $C019
+		0x4c, 0x07, 0xc0, // C020: JMP $C007
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := prg.ApplySignatures(BuiltinSignatures())
+	if len(matches) != 2 {
+		t.Fatalf("got %d matches, expected 2: %v", len(matches), matches)
+	}
+	if prg.Labels[0xc007] != "mul8x8" || prg.Labels[0xc019] != "wait_raster" {
+		t.Errorf("invalid labels: %v", prg.Labels)
+	}
+
+	sig, err := prg.MakeSignature("wait_and_mul", "test", 0xc019, 0xc023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	db := &SignatureDB{}
+	db.Add(sig)
+	if err := db.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "wait_and_mul test AD 12 D0 C9 80 D0 F9 4C .. ..\n"
+	if buf.String() != expected {
+		t.Errorf("got signature %q, expected %q", buf.String(), expected)
+	}
+	db, err = ParseSignatures(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches = db.Match(prg)
+	if len(matches) != 1 || matches[0].Addr != 0xc019 {
+		t.Errorf("invalid matches: %v", matches)
+	}
+	if err := prg.Print(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignatureFamilies(t *testing.T) {
+	prg, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0xe8,       // C000: INX
+		0x98,       // C001: TYA
+		0x29, 0x0f, // C002: AND #$0F
+		0xf0, 0x14, // C004: BEQ $C01A
+		0x8a,             // C006: TXA
+		0x4a,             // C007: LSR
+		0xbe, 0xff, 0xc1, // C008: LDX $C1FF,Y
+		0x2a,       // C00B: ROL
+		0x26, 0xfc, // C00C: ROL $FC
+		0xca,       // C00E: DEX
+		0x10, 0xfa, // C00F: BPL $C00B
+		0x79, 0x33, 0xc2, // C011: ADC $C233,Y
+		0xaa,       // C014: TAX
+		0xa5, 0xfc, // C015: LDA $FC
+		0x79, 0x67, 0xc2, // C017: ADC $C267,Y
+		0x99, 0x68, 0xc2, // C01A: STA $C268,Y
+		0x8a,             // C01D: TXA
+		0x99, 0x34, 0xc2, // C01E: STA $C234,Y
+		0xa2, 0x04, // C021: LDX #$04
+		0x20, 0x31, 0xc0, // C023: JSR $C031
+		0x99, 0x00, 0xc2, // C026: STA $C200,Y
+		0xc8,       // C029: INY
+		0xc0, 0x34, // C02A: CPY #$34
+		0xd0, 0xd2, // C02C: BNE $C000
+		0x20, 0x34, 0xc0, // C02E: JSR $C034
+		0xa2, 0x00, // C031: LDX #$00
+		0x60,       // C033: RTS
+		0xa2, 0x18, // C034: LDX #$18
+		0xa9, 0x00, // C036: LDA #$00
+		0x9d, 0x00, 0xd4, // C038: STA $D400,X
+		0xca,       // C03B: DEX
+		0x10, 0xfa, // C03C: BPL $C038
+		0xad, 0x00, 0xdd, // C03E: LDA $DD00
+		0x4a,             // C041: LSR
+		0x4a,             // C042: LSR
+		0x4d, 0x00, 0xdd, // C043: EOR $DD00
+		0x4a,             // C046: LSR
+		0x4a,             // C047: LSR
+		0x4d, 0x00, 0xdd, // C048: EOR $DD00
+		0x4a,             // C04B: LSR
+		0x4a,             // C04C: LSR
+		0x4d, 0x00, 0xdd, // C04D: EOR $DD00
+		0x60,             // C050: RTS
+		0x8d, 0x58, 0xc0, // C051: STA $C058
+		0x60,       // C054: RTS
+		0xa2, 0x00, // C055: LDX #$00
+		0xa0, 0x00, // C057: LDY #$00
+		0x30, 0x0c, // C059: BMI $C067
+		0x8a,       // C05B: TXA
+		0xa2, 0x14, // C05C: LDX #$14
+		0x9d, 0x00, 0xc1, // C05E: STA $C100,X
+		0xca,       // C061: DEX
+		0x10, 0xfa, // C062: BPL $C05E
+		0x8d, 0x15, 0xd4, // C064: STA $D415
+		0x60,       // C067: RTS
+		0x0a,       // C068: ASL
+		0x0a,       // C069: ASL
+		0x0a,       // C06A: ASL
+		0xa8,       // C06B: TAY
+		0xa2, 0x02, // C06C: LDX #$02
+		0xb9, 0x00, 0xc1, // C06E: LDA $C100,Y
+		0x9d, 0x80, 0xc1, // C071: STA $C180,X
+		0xc8,       // C074: INY
+		0xca,       // C075: DEX
+		0x10, 0xf6, // C076: BPL $C06E
+		0xa9, 0x0f, // C078: LDA #$0F
+		0x8d, 0x18, 0xd4, // C07A: STA $D418
+		0x60,             // C07D: RTS
+		0xce, 0x90, 0xc1, // C07E: DEC $C190
+		0x10, 0x06, // C081: BPL $C089
+		0xad, 0x91, 0xc1, // C083: LDA $C191
+		0x8d, 0x90, 0xc1, // C086: STA $C190
+		0xa2, 0x0e, // C089: LDX #$0E
+		0x20, 0xac, 0xc0, // C08B: JSR $C0AC
+		0x8a,       // C08E: TXA
+		0x38,       // C08F: SEC
+		0xe9, 0x07, // C090: SBC #$07
+		0xaa,       // C092: TAX
+		0x10, 0xf6, // C093: BPL $C08B
+		0x60,       // C095: RTS
+		0xa9, 0x01, // C096: LDA #$01
+		0x06, 0xfb, // C098: ASL $FB
+		0xd0, 0x03, // C09A: BNE $C09F
+		0x20, 0xac, 0xc0, // C09C: JSR $C0AC
+		0x90, 0x0a, // C09F: BCC $C0AB
+		0x06, 0xfb, // C0A1: ASL $FB
+		0xd0, 0x03, // C0A3: BNE $C0A8
+		0x20, 0xac, 0xc0, // C0A5: JSR $C0AC
+		0x2a,       // C0A8: ROL
+		0x10, 0xed, // C0A9: BPL $C098
+		0x60, // C0AB: RTS
+		0x60, // C0AC: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000, 0xc051, 0xc055, 0xc068, 0xc07e, 0xc096},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := prg.ApplySignatures(BuiltinSignatures())
+	expected := map[uint16]string{
+		0xc000: "exomizer_tables",
+		0xc034: "sid_reset",
+		0xc03e: "recv_2bit",
+		0xc051: "gt2_init",
+		0xc055: "gt2_play",
+		0xc068: "jch_init",
+		0xc07e: "jch_play",
+		0xc096: "bb2_getlen",
+	}
+	if len(matches) != len(expected) {
+		t.Fatalf("got %d matches, expected %d: %v", len(matches),
+			len(expected), matches)
+	}
+	for _, m := range matches {
+		if expected[m.Addr] != m.Signature.Name {
+			t.Errorf("$%04X: got %s, expected %s", m.Addr, m.Signature.Name,
+				expected[m.Addr])
+		}
+	}
+
+	// Signatures with different names or code are kept.
+	db, err := ParseSignatures(strings.NewReader(`a test 01 02 ..
+b test 01 02 ..
+a test 01 03 ..
+a test 01 .. 02
+a test 01 02 .. ; replaces the first
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Signatures) != 4 || db.Signatures[0].Comment != "replaces the first" {
+		t.Errorf("invalid database: %v", db.Signatures)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	a, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0x01, 0x02, 0x03, // C000: data
+		0x20, 0x0a, 0xc0, // C003: JSR $C00A
+		0x20, 0x10, 0xc0, // C006: JSR $C010
+		0x60,       // C009: RTS
+		0xa9, 0x00, // C00A: LDA #$00
+		0x8d, 0x20, 0xd0, // C00C: STA $D020
+		0x60,       // C00F: RTS
+		0xa2, 0x01, // C010: LDX #$01
+		0x8e, 0x21, 0xd0, // C012: STX $D021
+		0x60, // C015: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc003},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ParseWith([]byte{
+		0x00, 0x40,
+		0x01, 0x02, 0x03, 0x04, // 4000: data
+		0x20, 0x11, 0x40, // 4004: JSR $4011
+		0x20, 0x0b, 0x40, // 4007: JSR $400B
+		0x60,       // 400A: RTS
+		0xa2, 0x01, // 400B: LDX #$01
+		0x8e, 0x21, 0xd0, // 400D: STX $D021
+		0x60,       // 4010: RTS
+		0xa9, 0x00, // 4011: LDA #$00
+		0x8d, 0x20, 0xd0, // 4013: STA $D020
+		0xee, 0x20, 0xd0, // 4016: INC $D020
+		0x60, // 4019: RTS
+	}, ParseOptions{
+		Entries: []uint16{0x4004},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := Compare(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uint16]struct {
+		status DiffStatus
+		entry  uint16
+	}{
+		0xc003: {DiffMoved, 0x4004},
+		0xc00a: {DiffChanged, 0x4011},
+		0xc010: {DiffMoved, 0x400b},
+	}
+	if len(diff.Routines) != len(expected) {
+		t.Fatalf("got %d routines, expected %d", len(diff.Routines),
+			len(expected))
+	}
+	for _, rd := range diff.Routines {
+		e := expected[rd.EntryA]
+		if rd.Status != e.status || rd.EntryB != e.entry {
+			t.Errorf("routine $%04X: got %v $%04X, expected %v $%04X",
+				rd.EntryA, rd.Status, rd.EntryB, e.status, e.entry)
+		}
+	}
+	if len(diff.Data) != 1 || diff.Data[0].Status != DiffChanged {
+		t.Errorf("invalid data diff: %+v", diff.Data)
+	}
+	if err := diff.Print(os.Stdout, "a.prg", "b.prg"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	p, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0xa9, 0x03, // C000: LDA #$03
+		0x8d, 0x00, 0x04, // C002: STA $0400
+		0x20, 0x0a, 0xc0, // C005: JSR $C00A
+		0xd0, 0xf6, // C008: BNE $C000
+		0xce, 0x00, 0x04, // C00A: DEC $0400
+		0x60, // C00D: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := p.NewPatchSet()
+	if err := ps.Operand(0xc000, 0x09); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.NOP(0xc00a, 0xc00d); err != nil {
+		t.Fatal(err)
+	}
+	err = ps.Replace(0xc005, Instr{Op: mos6510.OpNOP0xEA},
+		Instr{Op: mos6510.OpLDXimm, Arg: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Replace(0xc008, Instr{Op: mos6510.OpNOP0xEA}); err == nil {
+		t.Errorf("Replace accepted size mismatch")
+	}
+	if err := ps.Poke(0xc002, 0xea); err == nil {
+		t.Errorf("Poke accepted instruction split")
+	}
+	if err := ps.Poke(0xc001, 0x05); err == nil {
+		t.Errorf("Poke accepted overlapping patch")
+	}
+	if err := ps.NOP(0xc008, 0xc00b); err == nil {
+		t.Errorf("NOP accepted range splitting instruction")
+	}
+	expected := []byte{
+		0x00, 0xc0,
+		0xa9, 0x09,
+		0x8d, 0x00, 0x04,
+		0xea, 0xa2, 0x01,
+		0xd0, 0xf6,
+		0xea, 0xea, 0xea,
+		0x60,
+	}
+	if !bytes.Equal(ps.Bytes(), expected) {
+		t.Fatalf("got % X, expected % X", ps.Bytes(), expected)
+	}
+
+	var ips, bps bytes.Buffer
+	if err := ps.WriteIPS(&ips); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.WriteBPS(&bps); err != nil {
+		t.Fatal(err)
+	}
+	for name, r := range map[string]func() (*PatchSet, error){
+		"IPS": func() (*PatchSet, error) { return p.ReadIPS(&ips) },
+		"BPS": func() (*PatchSet, error) { return p.ReadBPS(&bps) },
+	} {
+		read, err := r()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(read.Bytes(), expected) {
+			t.Errorf("%s: got % X, expected % X", name, read.Bytes(),
+				expected)
+		}
+	}
+
+	p, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0xa9, 0x03, // C000: LDA #$03
+		0xa9, 0x04, // C002: LDA #$04
+		0x60, // C004: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps = p.NewPatchSet()
+	if err := ps.Poke(0xc000, 0xea, 0x20); err == nil {
+		t.Errorf("Poke accepted instruction extending past patch")
+	}
+	if err := ps.Poke(0xc002, 0xad); err == nil {
+		t.Errorf("Poke accepted instruction extending past patch")
+	}
+	if err := ps.Poke(0xc000, 0xea, 0xea); err != nil {
+		t.Error(err)
+	}
+	if err := ps.Poke(0xc003, 0x05); err != nil {
+		t.Error(err)
+	}
+
+	// Patches to a program without code analysis.
+	p, err = Tokenize(strings.NewReader("10 PRINT 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps = p.NewPatchSet()
+	if err := ps.Poke(0x0807, '2'); err != nil {
+		t.Fatal(err)
+	}
+	ips.Reset()
+	bps.Reset()
+	if err := ps.WriteIPS(&ips); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.WriteBPS(&bps); err != nil {
+		t.Fatal(err)
+	}
+	for name, r := range map[string]func() (*PatchSet, error){
+		"IPS": func() (*PatchSet, error) { return p.ReadIPS(&ips) },
+		"BPS": func() (*PatchSet, error) { return p.ReadBPS(&bps) },
+	} {
+		read, err := r()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(read.Bytes(), ps.Bytes()) {
+			t.Errorf("%s: got % X, expected % X", name, read.Bytes(),
+				ps.Bytes())
+		}
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	p, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0x06, 0xc0, 0x0e, 0xc0, 0x14, 0xc0, // C000: .addr $C006, $C00E, $C014
+		0xa9, 0x00, // C006: LDA #$00
+		0x85, 0xfb, // C008: STA $FB
+		0xa9, 0xc0, // C00A: LDA #$C0
+		0x85, 0xfc, // C00C: STA $FC
+		0x20, 0x14, 0xc0, // C00E: JSR $C014
+		0xad, 0x00, 0xc0, // C011: LDA $C000
+		0xa0, 0xc0, // C014: LDY #$C0
+		0x8c, 0x20, 0xd0, // C016: STY $D020
+		0x60, // C019: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc006},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := p.Relocate(0x2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Reloc{
+		{0xc000, RelocWord, 0xc006},
+		{0xc002, RelocWord, 0xc00e},
+		{0xc004, RelocWord, 0xc014},
+		{0xc007, RelocLo, 0xc000},
+		{0xc00b, RelocHi, 0xc000},
+		{0xc00f, RelocAbs, 0xc014},
+		{0xc012, RelocAbs, 0xc000},
+	}
+	if len(rel.Relocs) != len(expected) {
+		t.Fatalf("got relocs %v, expected %v", rel.Relocs, expected)
+	}
+	for i, r := range rel.Relocs {
+		if r != expected[i] {
+			t.Errorf("reloc %d: got %v, expected %v", i, r, expected[i])
+		}
+	}
+	if len(rel.Unresolved) != 1 || rel.Unresolved[0].Addr != 0xc015 {
+		t.Errorf("invalid unresolved references: %v", rel.Unresolved)
+	}
+	data := rel.Prg.Bytes()
+	if !bytes.Equal(data[:9], []byte{
+		0x00, 0x20, 0x06, 0x20, 0x0e, 0x20, 0x14, 0x20, 0xa9,
+	}) || data[13] != 0x20 || data[18] != 0x20 || data[21] != 0x20 ||
+		data[23] != 0xc0 {
+		t.Errorf("invalid relocated program: % X", data)
+	}
+	if rel.Prg.Start != 0x2006 || !rel.Prg.InstrStart(0x2014) {
+		t.Errorf("invalid relocated code analysis")
+	}
+	if _, err := p.Relocate(0xfff0); err == nil {
+		t.Errorf("Relocate accepted overflowing load address")
+	}
+
+	// The IRQ vector setup with SEI between the loads and the stores.
+	p, err = ParseWith(irqSetup, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err = p.Relocate(0x2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Reloc{
+		{0xc001, RelocLo, 0xc00d},
+		{0xc003, RelocHi, 0xc00d},
+	}
+	if len(rel.Relocs) != len(expected) || rel.Relocs[0] != expected[0] ||
+		rel.Relocs[1] != expected[1] {
+		t.Errorf("got relocs %v, expected %v", rel.Relocs, expected)
+	}
+
+	// The machine code after the BASIC stub is relocated and the SYS
+	// statement is rewritten.
+	p, err = Parse(basicStub(
+		0xad, 0x14, 0x08, // 080D: LDA $0814
+		0x8d, 0x20, 0xd0, // 0810: STA $D020
+		0x60, // 0813: RTS
+		0x05, // 0814: .byte $05
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err = p.Relocate(0xc000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rel.Relocs) != 1 || rel.Relocs[0] != (Reloc{0x080e, RelocAbs, 0x0814}) ||
+		len(rel.Unresolved) != 0 {
+		t.Errorf("invalid relocation: %v %v", rel.Relocs, rel.Unresolved)
+	}
+	lines, _, err := rel.Prg.BasicLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Prg.Load != BasicStart || rel.Prg.Start != 0xc000 ||
+		len(lines) != 1 || lines[0].String() != "10 SYS49152" {
+		t.Errorf("invalid relocated BASIC program: $%04X $%04X %v",
+			rel.Prg.Load, rel.Prg.Start, lines)
+	}
+	ofs, err := rel.Prg.MemToData(0xc001)
+	if err != nil || bo.Uint16(rel.Prg.Data[ofs:]) != 0xc007 {
+		t.Errorf("invalid relocated operand")
+	}
+
+	// No room for the stub below the code.
+	rel, err = p.Relocate(0x0805)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel.Prg.Load != 0x0805 || rel.Prg.Start != 0x0805 ||
+		len(rel.Unresolved) != 1 || rel.Unresolved[0].Addr != BasicStart {
+		t.Errorf("invalid relocation without stub: $%04X %v",
+			rel.Prg.Load, rel.Unresolved)
+	}
+
+	// The heuristic table is not referenced by code.
+	p, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0x06, 0xc0, 0x0a, 0xc0, 0x0d, 0xc0, // C000: .addr $C006, $C00A, $C00D
+		0x20, 0x0a, 0xc0, // C006: JSR $C00A
+		0x60,             // C009: RTS
+		0xee, 0x20, 0xd0, // C00A: INC $D020
+		0x60, // C00D: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc006},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err = p.Relocate(0x2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rel.Relocs) != 1 || rel.Relocs[0].Addr != 0xc007 {
+		t.Errorf("invalid relocs: %v", rel.Relocs)
+	}
+	if len(rel.Unresolved) != 3 || rel.Unresolved[0].Addr != 0xc000 ||
+		rel.Unresolved[0].Reason != "possible word table" {
+		t.Errorf("invalid unresolved references: %v", rel.Unresolved)
+	}
+}
+
+func TestAnalysis(t *testing.T) {
+	p, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0x01, 0x02, 0x03, // C000: data
+		0x20, 0x0a, 0xc0, // C003: JSR $C00A
+		0x6c, 0x00, 0xc0, // C006: JMP ($C000)
+		0x60,             // C009: RTS
+		0xad, 0x00, 0xc0, // C00A: LDA $C000
+		0x60, // C00D: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc003},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Labels = map[uint16]string{
+		0xc00a: "load",
+	}
+	a, err := p.Analysis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Segments) != 3 || a.Segments[0].Addr != 0xc000 ||
+		a.Segments[1].Type != SegData || a.Segments[2].Addr != 0xc003 ||
+		a.Segments[2].Type != SegCode || a.Segments[2].Size != 11 {
+		t.Errorf("invalid segments: %v", a.Segments)
+	}
+	if len(a.Instructions) != 5 || a.Instructions[0].Target != 0xc00a ||
+		a.Instructions[0].Name != "JSR" || a.Instructions[3].Cycles[0] != 4 {
+		t.Errorf("invalid instructions: %v", a.Instructions)
+	}
+	// The RTS at $C009 is code guessed after the JMP, not an entry
+	// point.
+	if len(a.Entries) != 1 || a.Entries[0] != 0xc003 {
+		t.Errorf("invalid entries: %v", a.Entries)
+	}
+	labels := map[uint16]string{
+		0xc000: "data_C000",
+		0xc003: "sub_C003",
+		0xc00a: "load",
+	}
+	if len(a.Labels) != len(labels) {
+		t.Errorf("invalid labels: %v", a.Labels)
+	}
+	for _, label := range a.Labels {
+		if labels[label.Addr] != label.Name {
+			t.Errorf("label $%04X: got %s, expected %s", label.Addr,
+				label.Name, labels[label.Addr])
+		}
+	}
+	if len(a.Warnings) != 1 || a.Warnings[0].Kind != WarnIndirect {
+		t.Errorf("invalid warnings: %v", a.Warnings)
+	}
+
+	var buf bytes.Buffer
+	if err := a.JSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Analysis
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, &decoded) {
+		t.Errorf("JSON round-trip mismatch:\n%s", buf.String())
+	}
+
+	// The CFG and XRef are cached until the analysis changes.
+	cfg1, err := p.CFG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg2, err := p.CFG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xref1, err := p.XRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	xref2, err := p.XRef()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg1 != cfg2 || xref1 != xref2 {
+		t.Errorf("CFG or XRef not cached")
+	}
+	err = p.MergeTrace(&Trace{
+		Jumps: map[uint16][]uint16{
+			0xc006: {0xc00a},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg2, err = p.CFG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg1 == cfg2 {
+		t.Errorf("CFG not invalidated")
+	}
+	bb := cfg2.Block(0xc006)
+	if bb == nil || len(bb.Succs) != 1 || bb.Succs[0].Start != 0xc00a {
+		t.Errorf("invalid indirect jump successors: %v", bb)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	p, err := ParseWith([]byte{
+		0x00, 0xc0,
+		0x48, 0x49, 0x3c, // C000: .byte "HI<"
+		0x20, 0x0a, 0xc0, // C003: JSR $C00A
+		0xad, 0x00, 0xc0, // C006: LDA $C000
+		0x60,             // C009: RTS
+		0xee, 0x20, 0xd0, // C00A: INC $D020
+		0x60, // C00D: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc003},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Labels = map[uint16]string{
+		0xd020: "border",
+	}
+	var buf bytes.Buffer
+	if err := p.HTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, s := range []string{
+		`<a href="#a_C00A">sub_C00A</a>`,
+		`<a href="#a_C000">data_C000</a>`,
+		`<tr id="a_C00A">`,
+		`<td>border</td>`,
+		`sub_C00A:</td><td class="xrefs">; xrefs: <a href="#a_C003">$C003</a> call`,
+		`<td>.byte</td><td>$48,$49,$3C</td><td class="petscii">hi&lt;</td>`,
+		`title="$20 JSR abs, 6 cycles, jump"`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("HTML does not contain %s", s)
+		}
+	}
+	if strings.Contains(out, "<script") || strings.Contains(out, "http") {
+		t.Errorf("HTML is not self-contained")
+	}
+	if strings.Contains(out, `href="#a_D020"`) {
+		t.Errorf("HTML links to a label outside the program")
+	}
+
+	// Label inside an instruction.
+	p, err = ParseWith([]byte{
+		0x00, 0xc0,
+		0xa9, 0x00, // C000: LDA #$00
+		0x8d, 0x01, 0xc0, // C002: STA $C001
+		0x60, // C005: RTS
+	}, ParseOptions{
+		Entries: []uint16{0xc000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := p.HTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out = buf.String()
+	for _, s := range []string{
+		`<a href="#a_C001">data_C001</a>`,
+		`<tr id="a_C001"><td></td><td></td><td class="label" colspan="2">data_C001 = *+1</td>`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("HTML does not contain %s", s)
+		}
+	}
+}
+
+func TestProject(t *testing.T) {
+	data := []byte{
+		0x00, 0xc0,
+		0xa9, 0x00, // C000: LDA #$00
+		0x8d, 0x20, 0xd0, // C002: STA $D020
+		0x60,       // C005: RTS
+		0x48, 0x49, // C006: .text "HI"
+		0xee, 0x21, 0xd0, // C008: INC $D021
+		0x60, // C00B: RTS
+	}
+	proj, err := NewProject("test.prg", data, ParseOptions{
+		Auto: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.SetSegment(0xc006, 2, SegText); err != nil {
+		t.Fatal(err)
+	}
+	p, err := proj.Prg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.SegTypes[6] != SegText || p.SegTypes[8] != SegData {
+		t.Errorf("invalid segment types: %v", p.SegTypes)
+	}
+	if err := proj.AddEntry(0xc008); err != nil {
+		t.Fatal(err)
+	}
+	if err := proj.AddEntry(0xd000); err == nil {
+		t.Errorf("AddEntry accepted entry outside program")
+	}
+	proj.SetLabel(0xc008, "flash")
+	proj.SetComment(0xc000, "black border")
+	if err := proj.SetSegment(0xc00b, 2, SegData); err == nil {
+		t.Errorf("SetSegment accepted segment outside program")
+	}
+
+	var buf bytes.Buffer
+	if err := proj.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	proj, err = ReadProject(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = proj.Prg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.SegTypes[6] != SegText || !p.InstrStart(0xc008) {
+		t.Errorf("invalid re-analysis: %v", p.SegTypes)
+	}
+	if p.Labels[0xc008] != "flash" || p.Comments[0xc000] != "black border" {
+		t.Errorf("invalid annotations: %v %v", p.Labels, p.Comments)
+	}
+	p.Labels[0xc008] = "changed"
+	if proj.Labels[0xc008] != "flash" {
+		t.Errorf("program labels alias project labels")
+	}
+	if len(proj.Code) != 1 || len(proj.Segments) != 1 {
+		t.Errorf("invalid project: %v %v", proj.Code, proj.Segments)
+	}
+	if err := proj.SetSegment(0xc006, 2, SegNone); err != nil {
+		t.Fatal(err)
+	}
+	if len(proj.Segments) != 0 {
+		t.Errorf("SetSegment did not remove segment: %v", proj.Segments)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		data []byte
+		opts ParseOptions
+		kind ErrorKind
+	}{
+		{[]byte{0x00}, ParseOptions{}, ErrShort},
+		{[]byte{0xff, 0xff, 0xea, 0xea}, ParseOptions{Auto: true}, ErrSize},
+		{[]byte{0x00, 0xc0, 0xea, 0x60}, ParseOptions{
+			Entries: []uint16{0xd000},
+		}, ErrEntry},
+	}
+	for _, test := range tests {
+		_, err := ParseWith(test.data, test.opts)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("% X: expected ParseError, got %v", test.data, err)
+			continue
+		}
+		if perr.Kind != test.kind {
+			t.Errorf("% X: got %v, expected %v", test.data, perr.Kind, test.kind)
+		}
+	}
+
+	p, err := ParseWith([]byte{0x00, 0xc0, 0xea, 0x20, 0x00},
+		ParseOptions{Auto: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Warnings) != 1 || p.Warnings[0].Kind != WarnTruncated {
+		t.Errorf("invalid warnings: %v", p.Warnings)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	hello, err := os.ReadFile("hello.prg")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(hello, false)
+	f.Add([]byte{0x00, 0xc0, 0xa9, 0x00, 0x8d, 0x20, 0xd0, 0x60}, true)
+	f.Add([]byte{0x00, 0xc0, 0x6c, 0x03, 0xc0, 0x05, 0xc0, 0x60}, true)
+	f.Add([]byte{0xff, 0xff, 0x20}, true)
+	f.Add([]byte{0x00, 0xc0, 0x6c, 0x03, 0xc0, 0x05, 0xc0, 0xe0}, true)
+	f.Add([]byte("eee8}eee10\xff20"), true)
+	f.Fuzz(func(t *testing.T, data []byte, auto bool) {
+		p, err := ParseWith(data, ParseOptions{
+			Auto:    auto,
+			Emulate: 2000,
+		})
+		if err != nil {
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("untyped error: %v", err)
+			}
+			return
+		}
+		a, err := p.Analysis()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.JSON(io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.HTML(io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		p.Stack()
+		p.PrintCycles(io.Discard)
+		p.ZeroPage()
+		p.CallGraph()
+		p.Relocate(0x1000)
+		p.ApplySignatures(BuiltinSignatures())
+	})
+}
+
+func FuzzPatch(f *testing.F) {
+	p, err := Load("hello.prg")
+	if err != nil {
+		f.Fatal(err)
+	}
+	ps := p.NewPatchSet()
+	if err := ps.NOP(0x080d, 0x080f); err != nil {
+		f.Fatal(err)
+	}
+	var ips, bps bytes.Buffer
+	ps.WriteIPS(&ips)
+	ps.WriteBPS(&bps)
+	f.Add(ips.Bytes())
+	f.Add(bps.Bytes())
+
+	// A program without code analysis.
+	basic, err := Tokenize(strings.NewReader("10 PRINT 1\n20 SYS 2061\n"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	ps = basic.NewPatchSet()
+	if err := ps.Poke(0x0807, '2'); err != nil {
+		f.Fatal(err)
+	}
+	ips.Reset()
+	bps.Reset()
+	ps.WriteIPS(&ips)
+	ps.WriteBPS(&bps)
+	f.Add(ips.Bytes())
+	f.Add(bps.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, prg := range []*Prg{p, basic} {
+			prg.ReadIPS(bytes.NewReader(data))
+			prg.ReadBPS(bytes.NewReader(data))
+		}
+	})
+}
@@ -0,0 +1,245 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"sort"
+)
+
+// ProjectVersion specifies the version of the project file format.
+const ProjectVersion = 1
+
+// Project defines a reverse-engineering project: a PRG file and the
+// user annotations. The project is stored in JSON and the PRG file is
+// embedded into it. The Auto, Entries, and Emulate fields specify
+// how the program is parsed, as in ParseOptions. Code lists the
+// entry points added by the user and Segments the forced segment
+// types and data formats.
+type Project struct {
+	Version  int               `json:"version"`
+	Name     string            `json:"name,omitempty"`
+	Data     []byte            `json:"prg"`
+	Auto     bool              `json:"auto,omitempty"`
+	Entries  []uint16          `json:"entries,omitempty"`
+	Emulate  uint64            `json:"emulate,omitempty"`
+	Code     []uint16          `json:"code,omitempty"`
+	Segments []Segment         `json:"segments,omitempty"`
+	Labels   map[uint16]string `json:"labels,omitempty"`
+	Comments map[uint16]string `json:"comments,omitempty"`
+
+	prg   *Prg
+	dirty bool
+}
+
+// NewProject creates a project for the PRG file data. The options
+// specify how the program is parsed.
+func NewProject(name string, data []byte, opts ParseOptions) (*Project, error) {
+	p := &Project{
+		Version:  ProjectVersion,
+		Name:     name,
+		Data:     append([]byte(nil), data...),
+		Auto:     opts.Auto,
+		Entries:  opts.Entries,
+		Emulate:  opts.Emulate,
+		Code:     opts.Code,
+		Segments: opts.Segments,
+		dirty:    true,
+	}
+	if _, err := p.Prg(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ReadProject reads the project from the reader.
+func ReadProject(r io.Reader) (*Project, error) {
+	p := new(Project)
+	if err := json.NewDecoder(r).Decode(p); err != nil {
+		return nil, err
+	}
+	if p.Version != ProjectVersion {
+		return nil, fmt.Errorf("unsupported project version %d", p.Version)
+	}
+	p.dirty = true
+	if _, err := p.Prg(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// OpenProject reads the project from the named file.
+func OpenProject(file string) (*Project, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadProject(f)
+}
+
+// Write writes the project to the writer.
+func (p *Project) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// Save writes the project to the named file.
+func (p *Project) Save(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := p.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Options returns the parse options of the project.
+func (p *Project) Options() ParseOptions {
+	return ParseOptions{
+		Entries:  p.Entries,
+		Auto:     p.Auto,
+		Emulate:  p.Emulate,
+		Code:     p.Code,
+		Segments: p.Segments,
+	}
+}
+
+// Prg returns the analyzed program with the project annotations. If
+// the entry points or segments have changed since the last analysis,
+// the program is fully re-parsed; the labels and comments are applied
+// without re-parsing. The program holds copies of the project's
+// labels and comments: use SetLabel and SetComment to modify the
+// project.
+func (p *Project) Prg() (*Prg, error) {
+	if p.dirty || p.prg == nil {
+		prg, err := ParseWith(append([]byte(nil), p.Data...), p.Options())
+		if err != nil {
+			return nil, err
+		}
+		p.prg = prg
+		p.dirty = false
+	}
+	p.prg.Labels = maps.Clone(p.Labels)
+	p.prg.Comments = maps.Clone(p.Comments)
+	return p.prg, nil
+}
+
+// SetLabel sets the label of the address. An empty name removes the
+// label.
+func (p *Project) SetLabel(addr uint16, name string) {
+	if len(name) == 0 {
+		delete(p.Labels, addr)
+		return
+	}
+	if p.Labels == nil {
+		p.Labels = make(map[uint16]string)
+	}
+	p.Labels[addr] = name
+}
+
+// SetComment sets the comment of the address. An empty comment
+// removes the comment.
+func (p *Project) SetComment(addr uint16, comment string) {
+	if len(comment) == 0 {
+		delete(p.Comments, addr)
+		return
+	}
+	if p.Comments == nil {
+		p.Comments = make(map[uint16]string)
+	}
+	p.Comments[addr] = comment
+}
+
+// AddEntry adds a code entry point and re-analyzes the program. If
+// the re-analysis fails, the entry point is not added.
+func (p *Project) AddEntry(addr uint16) error {
+	for _, entry := range p.Code {
+		if entry == addr {
+			return nil
+		}
+	}
+	return p.update(func() {
+		p.Code = append(append([]uint16(nil), p.Code...), addr)
+		sort.Slice(p.Code, func(i, j int) bool {
+			return p.Code[i] < p.Code[j]
+		})
+	})
+}
+
+// SetSegment forces the segment type of the range. The new segment
+// replaces the overlapping parts of the existing forced segments.
+// The segment type SegNone removes the forced types from the range.
+// The program is re-analyzed and if the re-analysis fails, the
+// segments are not changed.
+func (p *Project) SetSegment(addr uint16, size int, t SegType) error {
+	if size <= 0 {
+		return fmt.Errorf("$%04X: invalid segment size %d", addr, size)
+	}
+	from := int(addr)
+	to := from + size
+	return p.update(func() {
+		var segments []Segment
+		for _, seg := range p.Segments {
+			start := int(seg.Addr)
+			end := start + seg.Size
+			if end <= from || start >= to {
+				segments = append(segments, seg)
+				continue
+			}
+			if start < from {
+				segments = append(segments, Segment{
+					Addr: seg.Addr,
+					Size: from - start,
+					Type: seg.Type,
+				})
+			}
+			if end > to {
+				segments = append(segments, Segment{
+					Addr: uint16(to),
+					Size: end - to,
+					Type: seg.Type,
+				})
+			}
+		}
+		if t != SegNone {
+			segments = append(segments, Segment{
+				Addr: addr,
+				Size: size,
+				Type: t,
+			})
+		}
+		sort.Slice(segments, func(i, j int) bool {
+			return segments[i].Addr < segments[j].Addr
+		})
+		p.Segments = segments
+	})
+}
+
+// update applies the change to the project and re-analyzes the
+// program. If the analysis fails, the change is reverted.
+func (p *Project) update(change func()) error {
+	code := p.Code
+	segments := p.Segments
+	change()
+	p.dirty = true
+	if _, err := p.Prg(); err != nil {
+		p.Code = code
+		p.Segments = segments
+		p.dirty = true
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,591 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+// RelocKind specifies the kind of a relocated reference.
+type RelocKind byte
+
+// Relocation kinds.
+const (
+	RelocAbs RelocKind = iota
+	RelocLo
+	RelocHi
+	RelocWord
+)
+
+var relocKinds = map[RelocKind]string{
+	RelocAbs:  "abs",
+	RelocLo:   "lo",
+	RelocHi:   "hi",
+	RelocWord: "word",
+}
+
+func (k RelocKind) String() string {
+	name, ok := relocKinds[k]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{RelocKind %d}", k)
+}
+
+// Reloc defines a relocated reference at the address Addr. Value is
+// the referenced address, or for RelocLo and RelocHi, the address
+// formed by the lo/hi byte pair. RelocAbs and RelocWord references
+// are 16-bit words and RelocLo and RelocHi references are single
+// bytes.
+type Reloc struct {
+	Addr  uint16
+	Kind  RelocKind
+	Value uint16
+}
+
+func (r Reloc) String() string {
+	return fmt.Sprintf("$%04X: %v $%04X", r.Addr, r.Kind, r.Value)
+}
+
+// Unresolved defines a possible reference at the address Addr which
+// the relocator could not resolve confidently.
+type Unresolved struct {
+	Addr   uint16
+	Reason string
+}
+
+func (u Unresolved) String() string {
+	return fmt.Sprintf("$%04X: %s", u.Addr, u.Reason)
+}
+
+// Relocation defines the result of relocating a program. The
+// addresses of Relocs and Unresolved are in the original program.
+type Relocation struct {
+	Prg        *Prg
+	Relocs     []Reloc
+	Unresolved []Unresolved
+}
+
+// relocSource specifies the source of a register value: an
+// immediate operand or a table indexed with the X or Y register.
+type relocSource struct {
+	kind  valueKind
+	imm   byte
+	instr uint16
+	table uint16
+	index byte
+}
+
+// relocator collects the relocations of a program.
+type relocator struct {
+	prg        *Prg
+	relocs     map[uint16]Reloc
+	unresolved map[uint16]string
+	candidates map[uint16]byte
+}
+
+// inside tests if the address is inside the program.
+func (r *relocator) inside(addr uint16) bool {
+	_, err := r.prg.MemToData(addr)
+	return err == nil
+}
+
+func (r *relocator) add(reloc Reloc) {
+	if old, ok := r.relocs[reloc.Addr]; ok && old != reloc {
+		r.unresolve(reloc.Addr, fmt.Sprintf("conflicting references %v and %v",
+			old, reloc))
+		return
+	}
+	r.relocs[reloc.Addr] = reloc
+}
+
+func (r *relocator) unresolve(addr uint16, reason string) {
+	if _, ok := r.unresolved[addr]; !ok {
+		r.unresolved[addr] = reason
+	}
+}
+
+// Relocate moves the program to the load address. It rewrites the
+// absolute operands, the lo/hi immediate byte pairs stored into
+// consecutive memory locations or pushed for RTS dispatch, the word
+// and pointer tables referenced by the code or forced, and the split
+// lo/hi tables read by the code, which point inside the program. The
+// references the relocator could not resolve confidently are
+// reported in Unresolved. The relocated program is parsed from the
+// relocated entry points.
+//
+// For a program with a BASIC stub, the machine code after the BASIC
+// program is moved to the load address. The stub stays at BasicStart
+// with its SYS statements to the program start rewritten, and the
+// space between the stub and the code is filled with zeros. If the
+// load address does not leave room for the stub, the stub is dropped
+// and reported in Unresolved, and the result is a machine-code
+// program.
+func (prg *Prg) Relocate(load uint16) (*Relocation, error) {
+	if prg.starts == nil {
+		return nil, fmt.Errorf("program code not parsed")
+	}
+	codeStart := prg.Load
+	var lines []Line
+	if len(prg.SegTypes) > 0 && prg.SegTypes[0] == SegAddr {
+		var end int
+		var err error
+		lines, end, err = prg.BasicLines()
+		if err != nil {
+			return nil, err
+		}
+		if end >= len(prg.Data) {
+			return nil, fmt.Errorf("no code after BASIC program")
+		}
+		codeStart = prg.DataToMem(end)
+	}
+	code := prg.Data[codeStart-prg.Load:]
+	if int(load)+len(code) > 0x10000 {
+		return nil, fmt.Errorf("program does not fit at $%04X", load)
+	}
+	cfg, err := prg.CFG()
+	if err != nil {
+		return nil, err
+	}
+	r := &relocator{
+		prg:        prg,
+		relocs:     make(map[uint16]Reloc),
+		unresolved: make(map[uint16]string),
+		candidates: make(map[uint16]byte),
+	}
+	for ofs := range prg.Data {
+		if prg.starts[ofs] && prg.SegTypes[ofs] == SegCode {
+			instr, err := prg.Decode(prg.DataToMem(ofs))
+			if err != nil {
+				return nil, err
+			}
+			r.operand(instr)
+		}
+	}
+	for _, bb := range cfg.Blocks {
+		r.pairs(bb)
+	}
+	xref, err := prg.XRef()
+	if err != nil {
+		return nil, err
+	}
+	r.words(xref)
+	for _, smc := range prg.SelfModifying() {
+		if smc.Operand {
+			r.unresolve(smc.Target, fmt.Sprintf("operand modified by $%04X",
+				smc.Instr))
+		}
+	}
+	end := int(prg.Load) + len(prg.Data)
+	for addr, hi := range r.candidates {
+		if _, ok := r.relocs[addr]; !ok {
+			r.unresolve(addr, fmt.Sprintf("#$%02X may be high byte of $%02X00-$%04X",
+				hi, prg.Load>>8, end-1))
+		}
+	}
+
+	for addr, reloc := range r.relocs {
+		if reloc.Value < codeStart {
+			r.unresolve(addr, fmt.Sprintf("reference to BASIC program $%04X",
+				reloc.Value))
+		}
+	}
+
+	delta := load - codeStart
+	var stub []byte
+	if len(lines) > 0 {
+		var sys bool
+		for idx, line := range lines {
+			var ok bool
+			lines[idx], ok = line.replaceSys(prg.Start, prg.Start+delta)
+			sys = sys || ok
+		}
+		stub = linkBasic(lines)
+		switch {
+		case !sys:
+			r.unresolve(lines[0].Addr, fmt.Sprintf(
+				"BASIC stub dropped: no SYS to $%04X", prg.Start))
+			stub = nil
+		case BasicStart+len(stub) > int(load):
+			r.unresolve(lines[0].Addr, fmt.Sprintf(
+				"BASIC stub dropped: no room below $%04X", load))
+			stub = nil
+		}
+	}
+
+	result := new(Relocation)
+	for _, reloc := range r.relocs {
+		if _, ok := r.unresolved[reloc.Addr]; ok {
+			continue
+		}
+		result.Relocs = append(result.Relocs, reloc)
+	}
+	sort.Slice(result.Relocs, func(i, j int) bool {
+		return result.Relocs[i].Addr < result.Relocs[j].Addr
+	})
+	for addr, reason := range r.unresolved {
+		result.Unresolved = append(result.Unresolved, Unresolved{
+			Addr:   addr,
+			Reason: reason,
+		})
+	}
+	sort.Slice(result.Unresolved, func(i, j int) bool {
+		return result.Unresolved[i].Addr < result.Unresolved[j].Addr
+	})
+
+	data := make([]byte, 2, 2+len(code))
+	bo.PutUint16(data, load)
+	data = append(data, code...)
+	for _, reloc := range result.Relocs {
+		ofs := 2 + int(reloc.Addr-codeStart)
+		value := reloc.Value + delta
+		switch reloc.Kind {
+		case RelocAbs, RelocWord:
+			bo.PutUint16(data[ofs:], value)
+		case RelocLo:
+			data[ofs] = byte(value)
+		case RelocHi:
+			data[ofs] = byte(value >> 8)
+		}
+	}
+
+	// The program start is the first entry point.
+	var entries []uint16
+	for _, entry := range prg.Entries {
+		if entry != prg.Start && entry >= codeStart && r.inside(entry) {
+			entries = append(entries, entry+delta)
+		}
+	}
+	if stub != nil {
+		// The SYS statement specifies the program start.
+		basic := make([]byte, 2, 2+int(load-BasicStart)+len(code))
+		bo.PutUint16(basic, BasicStart)
+		basic = append(basic, stub...)
+		basic = append(basic, make([]byte, int(load)-BasicStart-len(stub))...)
+		data = append(basic, data[2:]...)
+		result.Prg, err = ParseWith(data, ParseOptions{
+			Code: entries,
+		})
+	} else {
+		result.Prg, err = ParseWith(data, ParseOptions{
+			Entries: append([]uint16{prg.Start + delta}, entries...),
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if prg.Labels != nil {
+		result.Prg.Labels = make(map[uint16]string)
+		for addr, label := range prg.Labels {
+			if addr >= codeStart && r.inside(addr) {
+				addr += delta
+			}
+			result.Prg.Labels[addr] = label
+		}
+	}
+	if prg.Comments != nil {
+		result.Prg.Comments = make(map[uint16]string)
+		for addr, comment := range prg.Comments {
+			if addr >= codeStart && r.inside(addr) {
+				addr += delta
+			}
+			result.Prg.Comments[addr] = comment
+		}
+	}
+	return result, nil
+}
+
+// operand relocates the absolute operand of the instruction.
+func (r *relocator) operand(instr Instr) {
+	switch instr.Op.AddrMode() {
+	case mos6510.AddrABS, mos6510.AddrABX, mos6510.AddrABY, mos6510.AddrIND:
+	default:
+		return
+	}
+	prg := r.prg
+	end := int(prg.Load) + len(prg.Data)
+	switch {
+	case r.inside(instr.Arg):
+		r.add(Reloc{
+			Addr:  instr.Addr + 1,
+			Kind:  RelocAbs,
+			Value: instr.Arg,
+		})
+	case int(instr.Arg) == end:
+		r.unresolve(instr.Addr, fmt.Sprintf("%v: operand points to program end",
+			instr))
+	case instr.Op.AddrMode() != mos6510.AddrABS &&
+		instr.Op.AddrMode() != mos6510.AddrIND &&
+		instr.Arg < prg.Load && int(instr.Arg)+0xff >= int(prg.Load):
+		r.unresolve(instr.Addr, fmt.Sprintf("%v: indexed operand may reach program",
+			instr))
+	}
+}
+
+// pairs relocates the lo/hi byte pairs of the basic block.
+func (r *relocator) pairs(bb *BasicBlock) {
+	prg := r.prg
+	var regs [3]relocSource
+	var stack []relocSource
+	mem := make(map[uint16]relocSource)
+	end := int(prg.Load) + len(prg.Data) - 1
+
+	pair := func(lo, hi relocSource, offset uint16) bool {
+		switch {
+		case lo.kind == valImm && hi.kind == valImm:
+			value := uint16(hi.imm)<<8 | uint16(lo.imm)
+			if !r.inside(value + offset) {
+				return false
+			}
+			r.add(Reloc{
+				Addr:  lo.instr + 1,
+				Kind:  RelocLo,
+				Value: value,
+			})
+			r.add(Reloc{
+				Addr:  hi.instr + 1,
+				Kind:  RelocHi,
+				Value: value,
+			})
+			return true
+
+		case lo.kind == valTable && hi.kind == valTable && lo.index == hi.index:
+			return r.tables(lo.table, hi.table, offset)
+		}
+		return false
+	}
+	candidate := func(src relocSource) {
+		if src.kind == valImm && src.imm >= byte(prg.Load>>8) &&
+			int(src.imm) <= end>>8 {
+			r.candidates[src.instr+1] = src.imm
+		}
+	}
+
+	for _, instr := range bb.Instrs {
+		switch instr.Op {
+		case mos6510.OpLDAimm:
+			regs[regA] = relocSource{kind: valImm, imm: byte(instr.Arg),
+				instr: instr.Addr}
+		case mos6510.OpLDXimm:
+			regs[regX] = relocSource{kind: valImm, imm: byte(instr.Arg),
+				instr: instr.Addr}
+		case mos6510.OpLDYimm:
+			regs[regY] = relocSource{kind: valImm, imm: byte(instr.Arg),
+				instr: instr.Addr}
+
+		case mos6510.OpLDAabx:
+			regs[regA] = relocSource{kind: valTable, table: instr.Arg,
+				index: 'X'}
+		case mos6510.OpLDAaby:
+			regs[regA] = relocSource{kind: valTable, table: instr.Arg,
+				index: 'Y'}
+		case mos6510.OpLDXaby:
+			regs[regX] = relocSource{kind: valTable, table: instr.Arg,
+				index: 'Y'}
+		case mos6510.OpLDYabx:
+			regs[regY] = relocSource{kind: valTable, table: instr.Arg,
+				index: 'X'}
+
+		case mos6510.OpTAX:
+			regs[regX] = regs[regA]
+		case mos6510.OpTAY:
+			regs[regY] = regs[regA]
+		case mos6510.OpTXA:
+			regs[regA] = regs[regX]
+		case mos6510.OpTYA:
+			regs[regA] = regs[regY]
+
+		case mos6510.OpSTAabs, mos6510.OpSTAzp,
+			mos6510.OpSTXabs, mos6510.OpSTXzp,
+			mos6510.OpSTYabs, mos6510.OpSTYzp:
+			var reg int
+			switch instr.Op {
+			case mos6510.OpSTXabs, mos6510.OpSTXzp:
+				reg = regX
+			case mos6510.OpSTYabs, mos6510.OpSTYzp:
+				reg = regY
+			}
+			mem[instr.Arg] = regs[reg]
+			var paired bool
+			for _, vec := range []uint16{instr.Arg - 1, instr.Arg} {
+				lo, ok1 := mem[vec]
+				hi, ok2 := mem[vec+1]
+				if ok1 && ok2 && pair(lo, hi, 0) {
+					paired = true
+				}
+			}
+			if !paired {
+				candidate(regs[reg])
+			}
+
+		case mos6510.OpPHA:
+			stack = append(stack, regs[regA])
+		case mos6510.OpPHP:
+			stack = append(stack, relocSource{})
+		case mos6510.OpPLA, mos6510.OpPLP:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			if instr.Op == mos6510.OpPLA {
+				regs[regA] = relocSource{}
+			}
+
+		case mos6510.OpRTS:
+			// RTS dispatch: the target address minus one is pushed
+			// into the stack, high byte first.
+			if len(stack) >= 2 {
+				hi := stack[len(stack)-2]
+				lo := stack[len(stack)-1]
+				if !pair(lo, hi, 1) {
+					candidate(hi)
+				}
+			}
+
+		case mos6510.OpJSRabs:
+			// The subroutine can change all registers.
+			regs = [3]relocSource{}
+
+		default:
+			for reg, name := range regNames {
+				if writesReg(instr.Op, name) {
+					regs[reg] = relocSource{}
+				}
+			}
+		}
+	}
+}
+
+// tables relocates the split lo/hi tables. If the hi table follows
+// the lo table immediately, the tables are interpreted as a table of
+// words. The function returns true if the tables had relocated
+// entries.
+func (r *relocator) tables(lo, hi, offset uint16) bool {
+	prg := r.prg
+	stride := 1
+	if hi == lo+1 {
+		stride = 2
+	}
+	var found bool
+	for i := 0; i < 256; i += stride {
+		if stride == 1 &&
+			((lo < hi && int(lo)+i >= int(hi)) ||
+				(hi < lo && int(hi)+i >= int(lo))) {
+			break
+		}
+		loOfs, err := prg.MemToData(lo + uint16(i))
+		if err != nil || !prg.relocByte(loOfs) {
+			break
+		}
+		hiOfs, err := prg.MemToData(hi + uint16(i))
+		if err != nil || !prg.relocByte(hiOfs) {
+			break
+		}
+		value := uint16(prg.Data[hiOfs])<<8 | uint16(prg.Data[loOfs])
+		if !r.inside(value + offset) {
+			break
+		}
+		if stride == 2 {
+			r.add(Reloc{
+				Addr:  lo + uint16(i),
+				Kind:  RelocWord,
+				Value: value,
+			})
+		} else {
+			r.add(Reloc{
+				Addr:  lo + uint16(i),
+				Kind:  RelocLo,
+				Value: value,
+			})
+			r.add(Reloc{
+				Addr:  hi + uint16(i),
+				Kind:  RelocHi,
+				Value: value,
+			})
+		}
+		found = true
+	}
+	return found
+}
+
+// relocByte tests if the data offset can hold a relocated table
+// byte.
+func (prg *Prg) relocByte(ofs int) bool {
+	switch prg.SegTypes[ofs] {
+	case SegData, SegWord, SegPtr:
+		return true
+	default:
+		return false
+	}
+}
+
+// words relocates the word and pointer table entries pointing inside
+// the program. The tables are relocated if the code references them
+// or if their segment types are forced. The entries of the other
+// tables, detected by the table heuristics, are reported as
+// unresolved.
+func (r *relocator) words(xref *XRef) {
+	prg := r.prg
+	referenced := make([]bool, len(prg.Data))
+	for _, ref := range xref.Refs {
+		if ofs, err := prg.MemToData(ref.Addr); err == nil {
+			referenced[ofs] = true
+		}
+	}
+	for ofs := 0; ofs < len(prg.Data); {
+		t := prg.SegTypes[ofs]
+		end := prg.segEnd(ofs)
+		if t == SegWord || t == SegPtr {
+			confident := prg.forced != nil && prg.forced[ofs]
+			for i := ofs; i < end; i++ {
+				if referenced[i] {
+					confident = true
+					break
+				}
+			}
+			for i := ofs; i+1 < end; i += 2 {
+				value := bo.Uint16(prg.Data[i:])
+				if !r.inside(value) {
+					continue
+				}
+				if !confident {
+					r.unresolve(prg.DataToMem(i), "possible word table")
+					continue
+				}
+				r.add(Reloc{
+					Addr:  prg.DataToMem(i),
+					Kind:  RelocWord,
+					Value: value,
+				})
+			}
+		}
+		ofs = end
+	}
+
+	// The unreferenced pointer tables are left as data.
+	for _, w := range prg.Warnings {
+		if w.Kind != WarnTable {
+			continue
+		}
+		ofs, err := prg.MemToData(w.Addr)
+		if err != nil {
+			continue
+		}
+		for i := ofs; i+1 < len(prg.Data); i += 2 {
+			if prg.SegTypes[i] != SegData || prg.SegTypes[i+1] != SegData {
+				break
+			}
+			value := bo.Uint16(prg.Data[i:])
+			if !r.inside(value) || !prg.isCode(value) {
+				break
+			}
+			r.unresolve(prg.DataToMem(i), "possible word table")
+		}
+	}
+}
@@ -0,0 +1,351 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+//go:embed signatures.txt
+var builtinSignatures string
+
+// Signature defines a known code routine. The Mask specifies which
+// bytes of the Pattern are significant; the masked bytes match any
+// value.
+type Signature struct {
+	Name    string
+	Kind    string
+	Comment string
+	Pattern []byte
+	Mask    []bool
+}
+
+// Hash returns the hash of the signature's significant bytes and
+// mask. Signatures with equal hashes match the same code.
+func (sig *Signature) Hash() uint32 {
+	return maskedHash(sig.Pattern, sig.Mask)
+}
+
+// maskedHash computes the hash of the data bytes with the mask. The
+// masked bytes do not affect the hash.
+func maskedHash(data []byte, mask []bool) uint32 {
+	h := fnv.New32a()
+	for i, b := range mask {
+		if b {
+			h.Write([]byte{1, data[i]})
+		} else {
+			h.Write([]byte{0, 0})
+		}
+	}
+	return h.Sum32()
+}
+
+// Match tests if the signature matches the data.
+func (sig *Signature) Match(data []byte) bool {
+	if len(data) < len(sig.Pattern) {
+		return false
+	}
+	for i, b := range sig.Pattern {
+		if sig.Mask[i] && data[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+func (sig *Signature) String() string {
+	var parts []string
+	for i, b := range sig.Pattern {
+		if sig.Mask[i] {
+			parts = append(parts, fmt.Sprintf("%02X", b))
+		} else {
+			parts = append(parts, "..")
+		}
+	}
+	str := fmt.Sprintf("%s %s %s", sig.Name, sig.Kind,
+		strings.Join(parts, " "))
+	if len(sig.Comment) > 0 {
+		str += " ; " + sig.Comment
+	}
+	return str
+}
+
+// SignatureDB defines a database of routine signatures.
+type SignatureDB struct {
+	Signatures []*Signature
+}
+
+// BuiltinSignatures returns the built-in signature database.
+func BuiltinSignatures() *SignatureDB {
+	db, err := ParseSignatures(strings.NewReader(builtinSignatures))
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// ParseSignatures parses the signature database. Each line of the
+// database defines a signature: the name, the kind, and the pattern
+// bytes in hexadecimal, with .. for masked bytes. An optional comment
+// follows a semicolon. Empty lines and lines starting with # are
+// ignored.
+func ParseSignatures(r io.Reader) (*SignatureDB, error) {
+	db := new(SignatureDB)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		sig := new(Signature)
+		if idx := strings.IndexByte(line, ';'); idx >= 0 {
+			sig.Comment = strings.TrimSpace(line[idx+1:])
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: invalid signature", lineno)
+		}
+		sig.Name = fields[0]
+		sig.Kind = fields[1]
+		for _, field := range fields[2:] {
+			if field == ".." {
+				sig.Pattern = append(sig.Pattern, 0)
+				sig.Mask = append(sig.Mask, false)
+				continue
+			}
+			v, err := strconv.ParseUint(field, 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid byte: %s",
+					lineno, field)
+			}
+			sig.Pattern = append(sig.Pattern, byte(v))
+			sig.Mask = append(sig.Mask, true)
+		}
+		db.Add(sig)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Add adds the signature into the database. If the database already
+// contains a signature with the same name and code, the signature
+// replaces it.
+func (db *SignatureDB) Add(sig *Signature) {
+	hash := sig.Hash()
+	for idx, old := range db.Signatures {
+		if old.Hash() == hash && old.Name == sig.Name && old.sameCode(sig) {
+			db.Signatures[idx] = sig
+			return
+		}
+	}
+	db.Signatures = append(db.Signatures, sig)
+}
+
+// sameCode tests if the signatures have the same mask and significant
+// pattern bytes.
+func (sig *Signature) sameCode(o *Signature) bool {
+	if len(sig.Pattern) != len(o.Pattern) {
+		return false
+	}
+	for i, b := range sig.Mask {
+		if b != o.Mask[i] || (b && sig.Pattern[i] != o.Pattern[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Write writes the signature database in the format read by
+// ParseSignatures.
+func (db *SignatureDB) Write(w io.Writer) error {
+	for _, sig := range db.Signatures {
+		if _, err := fmt.Fprintln(w, sig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SignatureMatch defines a signature matching the code at Addr.
+type SignatureMatch struct {
+	Addr      uint16
+	Signature *Signature
+}
+
+// Match matches the database signatures against the program code. A
+// signature matches at an instruction start if all its bytes are
+// code. The signatures are grouped by their masks and the code is
+// hashed with each mask to find the matching signatures. If several
+// signatures match at the same address, the longest signature wins.
+func (db *SignatureDB) Match(prg *Prg) []SignatureMatch {
+	type group struct {
+		mask   []bool
+		hashes map[uint32][]*Signature
+	}
+	groups := make(map[string]*group)
+	var keys []string
+	for _, sig := range db.Signatures {
+		var key string
+		for _, b := range sig.Mask {
+			if b {
+				key += "1"
+			} else {
+				key += "0"
+			}
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &group{
+				mask:   sig.Mask,
+				hashes: make(map[uint32][]*Signature),
+			}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		hash := sig.Hash()
+		g.hashes[hash] = append(g.hashes[hash], sig)
+	}
+
+	var result []SignatureMatch
+	for ofs := range prg.Data {
+		if prg.starts == nil || !prg.starts[ofs] {
+			continue
+		}
+		var best *Signature
+		for _, key := range keys {
+			g := groups[key]
+			end := ofs + len(g.mask)
+			if end > len(prg.Data) || !prg.allCode(ofs, end) {
+				continue
+			}
+			hash := maskedHash(prg.Data[ofs:end], g.mask)
+			for _, sig := range g.hashes[hash] {
+				if !sig.Match(prg.Data[ofs:end]) {
+					continue
+				}
+				if best == nil || len(sig.Pattern) > len(best.Pattern) {
+					best = sig
+				}
+			}
+		}
+		if best != nil {
+			result = append(result, SignatureMatch{
+				Addr:      prg.DataToMem(ofs),
+				Signature: best,
+			})
+		}
+	}
+	return result
+}
+
+// allCode tests if the data bytes [from, to) are code.
+func (prg *Prg) allCode(from, to int) bool {
+	for i := from; i < to; i++ {
+		if prg.SegTypes[i] != SegCode {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplySignatures matches the database signatures against the program
+// and labels the matching routines. Existing labels are kept. The
+// function returns the matches.
+func (prg *Prg) ApplySignatures(db *SignatureDB) []SignatureMatch {
+	matches := db.Match(prg)
+	if len(matches) == 0 {
+		return nil
+	}
+	if prg.Labels == nil {
+		prg.Labels = make(map[uint16]string)
+	}
+	if prg.Comments == nil {
+		prg.Comments = make(map[uint16]string)
+	}
+	names := make(map[string]int)
+	for _, m := range matches {
+		if _, ok := prg.Labels[m.Addr]; ok {
+			continue
+		}
+		name := m.Signature.Name
+		names[name]++
+		if names[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, names[name])
+		}
+		prg.Labels[m.Addr] = name
+		comment := m.Signature.Kind
+		if len(m.Signature.Comment) > 0 {
+			comment += ": " + m.Signature.Comment
+		}
+		if old, ok := prg.Comments[m.Addr]; ok {
+			comment = old + ", " + comment
+		}
+		prg.Comments[m.Addr] = comment
+	}
+	return matches
+}
+
+// MakeSignature creates a signature from the code [from, to). The
+// absolute operands pointing inside the program are relocatable and
+// they are masked from the signature.
+func (prg *Prg) MakeSignature(name, kind string, from, to uint16) (
+	*Signature, error) {
+
+	start, err := prg.MemToData(from)
+	if err != nil {
+		return nil, err
+	}
+	if int(to) <= int(from) || int(to-prg.Load) > len(prg.Data) {
+		return nil, fmt.Errorf("invalid signature range $%04X-$%04X",
+			from, to)
+	}
+	end := int(to - prg.Load)
+
+	sig := &Signature{
+		Name:    name,
+		Kind:    kind,
+		Pattern: append([]byte(nil), prg.Data[start:end]...),
+		Mask:    make([]bool, end-start),
+	}
+	for i := range sig.Mask {
+		sig.Mask[i] = true
+	}
+	for addr := from; addr < to; {
+		instr, err := prg.Decode(addr)
+		if err != nil {
+			return nil, err
+		}
+		if int(instr.Next()) > int(to) {
+			return nil, fmt.Errorf("%04X: instruction crosses signature end",
+				addr)
+		}
+		switch instr.Op.AddrMode() {
+		case mos6510.AddrABS, mos6510.AddrABX, mos6510.AddrABY,
+			mos6510.AddrIND:
+			if _, err := prg.MemToData(instr.Arg); err == nil {
+				ofs := int(addr-from) + 1
+				sig.Mask[ofs] = false
+				sig.Mask[ofs+1] = false
+				sig.Pattern[ofs] = 0
+				sig.Pattern[ofs+1] = 0
+			}
+		}
+		addr = instr.Next()
+	}
+	return sig, nil
+}
@@ -0,0 +1,153 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/markkurossi/mpc64/mos6510"
+)
+
+// SMC defines a self-modifying code site: the instruction at Instr
+// writes the code byte at Addr, which belongs to the instruction at
+// Target. If Operand is true, the write modifies the operand of the
+// target instruction; otherwise it modifies the opcode. If Indexed is
+// true, the write is indexed and Addr is the base address of the
+// write.
+type SMC struct {
+	Instr   uint16
+	Addr    uint16
+	Target  uint16
+	Operand bool
+	Indexed bool
+}
+
+func (smc SMC) String() string {
+	what := "opcode"
+	if smc.Operand {
+		what = "operand"
+	}
+	var indexed string
+	if smc.Indexed {
+		indexed = " (indexed)"
+	}
+	return fmt.Sprintf("$%04X: writes %s of instruction $%04X at $%04X%s",
+		smc.Instr, what, smc.Target, smc.Addr, indexed)
+}
+
+// SelfModifying returns the self-modifying code sites of the
+// program. The sites are the instructions writing into bytes of the
+// recorded instructions, sorted by the written address. The writes
+// into basic blocks overlapping a buffer are not reported: an
+// indexed write in a counted loop covering more than one instruction
+// is taken as evidence that the code bytes are reused as data.
+func (prg *Prg) SelfModifying() []SMC {
+	cfg, err := prg.CFG()
+	if err != nil || prg.starts == nil {
+		return nil
+	}
+	buffers := prg.buffers(cfg)
+
+	var result []SMC
+	for _, bb := range cfg.Blocks {
+		for _, instr := range bb.Instrs {
+			if !instr.Op.Write() {
+				continue
+			}
+			var indexed bool
+			switch instr.Op.AddrMode() {
+			case mos6510.AddrABS, mos6510.AddrZP:
+			case mos6510.AddrABX, mos6510.AddrABY,
+				mos6510.AddrZPX, mos6510.AddrZPY:
+				indexed = true
+			default:
+				continue
+			}
+			ofs, err := prg.MemToData(instr.Arg)
+			if err != nil || prg.SegTypes[ofs] != SegCode {
+				continue
+			}
+			start, ok := prg.instrContaining(ofs)
+			if !ok {
+				continue
+			}
+			target := prg.DataToMem(start)
+			if overlaps(buffers, cfg.blockContaining(target)) {
+				continue
+			}
+			result = append(result, SMC{
+				Instr:   instr.Addr,
+				Addr:    instr.Arg,
+				Target:  target,
+				Operand: start != ofs,
+				Indexed: indexed,
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Addr != result[j].Addr {
+			return result[i].Addr < result[j].Addr
+		}
+		return result[i].Instr < result[j].Instr
+	})
+	return result
+}
+
+// buffers returns the address ranges written by indexed writes whose
+// index register ranges cover more than one recorded instruction.
+func (prg *Prg) buffers(cfg *CFG) [][2]int {
+	var result [][2]int
+	for _, bb := range cfg.Blocks {
+		bb.walkBounds(func(instr Instr, bounds indexBounds) {
+			if !instr.Op.Write() {
+				return
+			}
+			var reg byte
+			switch instr.Op.AddrMode() {
+			case mos6510.AddrABX, mos6510.AddrZPX:
+				reg = 'X'
+			case mos6510.AddrABY, mos6510.AddrZPY:
+				reg = 'Y'
+			default:
+				return
+			}
+			b, ok := bounds[reg]
+			if !ok {
+				return
+			}
+			from := int(instr.Arg) + b[0]
+			to := int(instr.Arg) + b[1]
+
+			var count int
+			for addr := from; addr <= to; addr++ {
+				ofs, err := prg.MemToData(uint16(addr))
+				if err == nil && prg.starts[ofs] {
+					count++
+				}
+			}
+			if count > 1 {
+				result = append(result, [2]int{from, to})
+			}
+		})
+	}
+	return result
+}
+
+// overlaps tests if the basic block overlaps any of the address
+// ranges.
+func overlaps(ranges [][2]int, bb *BasicBlock) bool {
+	if bb == nil {
+		return false
+	}
+	for _, r := range ranges {
+		if r[0] < int(bb.End) && r[1] >= int(bb.Start) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/markkurossi/mpc64/mos6510"
+	"github.com/markkurossi/tabulate"
+)
+
+// StackSize specifies the size of the 6510 stack in bytes.
+const StackSize = 256
+
+// StackIssueKind specifies the stack usage issues.
+type StackIssueKind byte
+
+// Stack usage issues.
+const (
+	// Paths with different stack depths join.
+	StackJoin StackIssueKind = iota
+
+	// RTS or RTI with pushed bytes left in the stack.
+	StackUnbalanced
+
+	// Pull below the subroutine's return address.
+	StackPullReturn
+
+	// RTS returning to an address pushed by the subroutine.
+	StackPushReturn
+
+	// TXS sets the stack pointer.
+	StackSetSP
+
+	// TSX reads the stack pointer for direct stack access.
+	StackReadSP
+
+	// Recursive call with unbounded stack depth.
+	StackRecursive
+)
+
+var stackIssueKinds = map[StackIssueKind]string{
+	StackJoin:       "join",
+	StackUnbalanced: "unbalanced",
+	StackPullReturn: "pull return",
+	StackPushReturn: "push return",
+	StackSetSP:      "set sp",
+	StackReadSP:     "read sp",
+	StackRecursive:  "recursive",
+}
+
+func (k StackIssueKind) String() string {
+	name, ok := stackIssueKinds[k]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{StackIssueKind %d}", k)
+}
+
+// StackIssue defines a stack usage issue at the instruction Addr. The
+// Depth is the stack depth before the instruction.
+type StackIssue struct {
+	Kind  StackIssueKind
+	Addr  uint16
+	Depth int
+}
+
+func (i StackIssue) String() string {
+	return fmt.Sprintf("$%04X: %v (depth %d)", i.Addr, i.Kind, i.Depth)
+}
+
+// StackInfo defines the stack usage of a subroutine. Own is the
+// maximum number of bytes the subroutine pushes itself and Max
+// includes the stack usage of the called subroutines. The depths do
+// not include the subroutine's own return address. Calls outside the
+// program are counted with their return address only. If Bounded is
+// false, the stack depth could not be determined because of
+// recursion or TXS with an unknown X register. After TXS with an
+// immediate X value, the depths count from the top of the stack
+// page.
+type StackInfo struct {
+	Entry   uint16
+	Own     int
+	Max     int
+	Bounded bool
+	Issues  []StackIssue
+}
+
+// Balanced tests if all paths through the subroutine have balanced
+// stack operations.
+func (si *StackInfo) Balanced() bool {
+	for _, issue := range si.Issues {
+		switch issue.Kind {
+		case StackJoin, StackUnbalanced, StackPullReturn, StackPushReturn:
+			return false
+		}
+	}
+	return true
+}
+
+// Overflow tests if the stack usage exceeds the stack size.
+func (si *StackInfo) Overflow() bool {
+	return si.Max > StackSize
+}
+
+// Stack analyzes the stack usage of the program's subroutines.
+func (prg *Prg) Stack() ([]*StackInfo, error) {
+	cfg, err := prg.CFG()
+	if err != nil {
+		return nil, err
+	}
+	sa := &stackAnalysis{
+		prg:    prg,
+		cfg:    cfg,
+		result: make(map[uint16]*StackInfo),
+		active: make(map[uint16]bool),
+	}
+	var result []*StackInfo
+	for _, sub := range cfg.Subroutines {
+		result = append(result, sa.analyze(sub))
+	}
+	return result, nil
+}
+
+type stackAnalysis struct {
+	prg    *Prg
+	cfg    *CFG
+	result map[uint16]*StackInfo
+	active map[uint16]bool
+}
+
+func (sa *stackAnalysis) analyze(sub *Subroutine) *StackInfo {
+	if info, ok := sa.result[sub.Entry]; ok {
+		return info
+	}
+	sa.active[sub.Entry] = true
+	defer delete(sa.active, sub.Entry)
+
+	info := &StackInfo{
+		Entry:   sub.Entry,
+		Bounded: true,
+	}
+	issue := func(kind StackIssueKind, addr uint16, depth int) {
+		info.Issues = append(info.Issues, StackIssue{
+			Kind:  kind,
+			Addr:  addr,
+			Depth: depth,
+		})
+	}
+
+	type state struct {
+		bb    *BasicBlock
+		depth int
+	}
+	entry := sa.cfg.Block(sub.Entry)
+	depths := map[*BasicBlock]int{
+		entry: 0,
+	}
+	pending := []state{{entry, 0}}
+
+	for len(pending) > 0 {
+		st := pending[0]
+		pending = pending[1:]
+		depth := st.depth
+		xImm := -1
+
+		for _, instr := range st.bb.Instrs {
+			switch instr.Op {
+			case mos6510.OpPHA, mos6510.OpPHP:
+				depth++
+			case mos6510.OpPLA, mos6510.OpPLP:
+				if depth <= 0 {
+					issue(StackPullReturn, instr.Addr, depth)
+				}
+				depth--
+			case mos6510.OpBRK:
+				info.Max = max(info.Max, depth+3)
+			case mos6510.OpJSRabs:
+				callee := 0
+				if sa.active[instr.Arg] {
+					issue(StackRecursive, instr.Addr, depth)
+					info.Bounded = false
+				} else if sub := sa.cfg.Subroutine(instr.Arg); sub != nil {
+					ci := sa.analyze(sub)
+					callee = ci.Max
+					if !ci.Bounded {
+						info.Bounded = false
+					}
+				}
+				info.Max = max(info.Max, depth+2+callee)
+			case mos6510.OpRTS, mos6510.OpRTI:
+				switch {
+				case depth >= 2 && len(sa.prg.Indirect[instr.Addr]) > 0:
+					issue(StackPushReturn, instr.Addr, depth)
+				case depth != 0:
+					issue(StackUnbalanced, instr.Addr, depth)
+				}
+			case mos6510.OpTXS:
+				// The stack pointer is set from X. If X is loaded
+				// with an immediate value, the depth is the stack
+				// space below $01FF; otherwise the depth restarts
+				// from zero and is unknown.
+				issue(StackSetSP, instr.Addr, depth)
+				if xImm < 0 {
+					info.Bounded = false
+					depth = 0
+				} else {
+					depth = 0xff - xImm
+				}
+			case mos6510.OpTSX:
+				issue(StackReadSP, instr.Addr, depth)
+			}
+			switch {
+			case instr.Op == mos6510.OpLDXimm:
+				xImm = int(instr.Arg)
+			case writesReg(instr.Op, 'X'):
+				xImm = -1
+			}
+			info.Own = max(info.Own, depth)
+			info.Max = max(info.Max, depth)
+		}
+		// RTS and RTI dispatching to the pushed addresses pull the
+		// return address, and RTI also the status register.
+		switch st.bb.Last().Op {
+		case mos6510.OpRTS:
+			depth -= 2
+		case mos6510.OpRTI:
+			depth -= 3
+		}
+		for _, succ := range st.bb.Succs {
+			d, ok := depths[succ]
+			if !ok {
+				depths[succ] = depth
+				pending = append(pending, state{succ, depth})
+			} else if d != depth {
+				issue(StackJoin, succ.Start, depth)
+			}
+		}
+	}
+
+	sa.result[sub.Entry] = info
+	return info
+}
+
+// PrintStack prints the stack usage of the program's subroutines.
+func (prg *Prg) PrintStack(w io.Writer) error {
+	infos, err := prg.Stack()
+	if err != nil {
+		return err
+	}
+	tab := tabulate.New(tabulate.Simple)
+	tab.Header("Subroutine")
+	tab.Header("Own").SetAlign(tabulate.MR)
+	tab.Header("Max").SetAlign(tabulate.MR)
+	tab.Header("Issues").SetAlign(tabulate.ML)
+
+	for _, info := range infos {
+		row := tab.Row()
+		row.Column(fmt.Sprintf("sub_%04X", info.Entry))
+		row.Column(fmt.Sprintf("%d", info.Own))
+		if info.Bounded {
+			row.Column(fmt.Sprintf("%d", info.Max))
+		} else {
+			row.Column(fmt.Sprintf("%d+", info.Max))
+		}
+		var lines []string
+		if info.Overflow() {
+			lines = append(lines, "stack overflow")
+		}
+		for _, issue := range info.Issues {
+			lines = append(lines, issue.String())
+		}
+		row.ColumnData(tabulate.NewLinesData(lines))
+	}
+	var buf bytes.Buffer
+	tab.Print(&buf)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,399 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/markkurossi/mpc64/mos6510"
+	"github.com/markkurossi/mpc64/petscii"
+)
+
+// StringTerm specifies how a string is terminated.
+type StringTerm byte
+
+// String terminators.
+const (
+	TermNone StringTerm = iota
+	TermZero
+	TermHighBit
+)
+
+var stringTerms = map[StringTerm]string{
+	TermNone:    "none",
+	TermZero:    "zero",
+	TermHighBit: "highbit",
+}
+
+func (t StringTerm) String() string {
+	name, ok := stringTerms[t]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{StringTerm %d}", t)
+}
+
+// String defines a string found from the program data.
+type String struct {
+	Addr   uint16
+	Size   int
+	Screen bool
+	Term   StringTerm
+	Text   string
+	Refs   []StringRef
+}
+
+// StringRef defines a code reference to a string. If the string
+// address is passed to a subroutine, Routine holds the subroutine
+// address and Call is true.
+type StringRef struct {
+	Instr   uint16
+	Routine uint16
+	Call    bool
+}
+
+// Strings returns the strings found from the program data.
+func (prg *Prg) Strings() []String {
+	refs := prg.stringRefs()
+
+	var result []String
+	for _, str := range prg.strs {
+		for i := 0; i < str.Size; i++ {
+			str.Refs = append(str.Refs, refs[str.Addr+uint16(i)]...)
+		}
+		result = append(result, str)
+	}
+	return result
+}
+
+// stringEnd returns the end offset of the text segment starting from
+// the data offset. The end offset is limited to the end of the string
+// starting from the offset.
+func (prg *Prg) stringEnd(from int) int {
+	end := prg.segEnd(from)
+	addr := prg.DataToMem(from)
+	for _, str := range prg.strs {
+		if str.Addr == addr {
+			return min(from+str.Size, end)
+		}
+	}
+	return end
+}
+
+// Minimum string lengths depending on the evidence that the data is
+// a string.
+const (
+	minTextLen     = 8
+	minTermTextLen = 4
+	minRefTextLen  = 2
+)
+
+// detectStrings detects the PETSCII and screen code strings from the
+// data segments. The strings can be zero-terminated or terminated by
+// setting the high bit of their last character. The strings referenced
+// by the code are accepted with less evidence.
+func (prg *Prg) detectStrings() {
+	refs := prg.stringRefs()
+
+	for _, screen := range []bool{true, false} {
+		for pc := 0; pc < len(prg.Data); pc++ {
+			if prg.SegTypes[pc] != SegData {
+				continue
+			}
+			end, term := prg.scanString(pc, screen)
+			if end == pc {
+				continue
+			}
+			text := prg.stringText(pc, end, screen, term)
+
+			evidence := 0
+			if term != TermNone {
+				evidence++
+			}
+			if len(refs[prg.DataToMem(pc)]) > 0 {
+				evidence++
+			}
+			if screen && !screenLetters(prg.Data[pc:end]) {
+				// Runs without screen code letters are identical in
+				// PETSCII and are left for the PETSCII detection.
+				evidence = -1
+			}
+			if !plausibleText(text, evidence) {
+				continue
+			}
+			t := SegText
+			if screen {
+				t = SegScreen
+			}
+			if !prg.markData(pc, end, t) {
+				continue
+			}
+			prg.strs = append(prg.strs, String{
+				Addr:   prg.DataToMem(pc),
+				Size:   end - pc,
+				Screen: screen,
+				Term:   term,
+				Text:   string(text),
+			})
+			pc = end - 1
+		}
+	}
+	sort.Slice(prg.strs, func(i, j int) bool {
+		return prg.strs[i].Addr < prg.strs[j].Addr
+	})
+}
+
+// scanString scans the string starting from the data offset. The
+// PETSCII strings can contain control codes. It returns the end
+// offset of the string, including the high-bit terminator, and the
+// string terminator.
+func (prg *Prg) scanString(pc int, screen bool) (int, StringTerm) {
+	end := pc
+	for ; end < len(prg.Data) && prg.SegTypes[end] == SegData; end++ {
+		code := prg.Data[end]
+		if screen {
+			if printableScreen(code) {
+				continue
+			}
+			if end > pc && printableScreen(code&0x7f) {
+				return end + 1, TermHighBit
+			}
+			break
+		}
+		// In the shifted character set, $C1-$DA are uppercase
+		// letters. A high-bit character following a lowercase
+		// letter ends a word and is taken as a terminator.
+		if end > pc && code&0x80 != 0 && printable(code&0x7f) &&
+			(!printable(code) || lowercase(prg.Data[end-1])) {
+			return end + 1, TermHighBit
+		}
+		if !printable(code) && !control(code) {
+			break
+		}
+	}
+	if end > pc && end < len(prg.Data) && prg.Data[end] == 0 &&
+		prg.SegTypes[end] == SegData {
+		return end, TermZero
+	}
+	return end, TermNone
+}
+
+// stringText returns the string [from, to) as PETSCII codes. The
+// high bit of the high-bit terminator is cleared.
+func (prg *Prg) stringText(from, to int, screen bool,
+	term StringTerm) []byte {
+
+	var text []byte
+	for i := from; i < to; i++ {
+		code := prg.Data[i]
+		if term == TermHighBit && i+1 == to {
+			code &= 0x7f
+		}
+		if screen {
+			code = petscii.ScreenToPETSCII(code)
+		}
+		text = append(text, code)
+	}
+	return text
+}
+
+// String returns the string text in the shifted character set with
+// the PETSCII control codes escaped.
+func (str String) String() string {
+	var result string
+	for i := 0; i < len(str.Text); i++ {
+		result += petscii.Escape(str.Text[i], petscii.Shifted)
+	}
+	return result
+}
+
+// stringRefs finds the code references to program data which can
+// be strings. The references are returned by their target addresses.
+// The function detects absolute data references and addresses loaded
+// as immediate lo/hi pairs into registers or zero-page pointers.
+func (prg *Prg) stringRefs() map[uint16][]StringRef {
+	result := make(map[uint16][]StringRef)
+	cfg, err := prg.CFG()
+	if err != nil {
+		return result
+	}
+	add := func(addr uint16, ref StringRef) {
+		ofs, err := prg.MemToData(addr)
+		if err != nil {
+			return
+		}
+		switch prg.SegTypes[ofs] {
+		case SegNone, SegData, SegText, SegScreen:
+			result[addr] = append(result[addr], ref)
+		}
+	}
+
+	for _, bb := range cfg.Blocks {
+		regs := [3]int{-1, -1, -1}
+		zp := make(map[uint16]int)
+
+		for _, instr := range bb.Instrs {
+			switch instr.Op {
+			case mos6510.OpLDAimm:
+				regs[regA] = int(instr.Arg)
+			case mos6510.OpLDXimm:
+				regs[regX] = int(instr.Arg)
+			case mos6510.OpLDYimm:
+				regs[regY] = int(instr.Arg)
+
+			case mos6510.OpSTAzp, mos6510.OpSTXzp, mos6510.OpSTYzp:
+				reg := regA
+				switch instr.Op {
+				case mos6510.OpSTXzp:
+					reg = regX
+				case mos6510.OpSTYzp:
+					reg = regY
+				}
+				hi := regs[reg]
+				zp[instr.Arg] = hi
+				lo, ok := zp[instr.Arg-1]
+				if ok && lo >= 0 && hi >= 0 {
+					add(uint16(hi<<8|lo), StringRef{
+						Instr: instr.Addr,
+					})
+				}
+
+			case mos6510.OpJSRabs:
+				for _, pair := range [][2]int{
+					{regA, regX}, {regA, regY}, {regX, regY},
+				} {
+					lo, hi := regs[pair[0]], regs[pair[1]]
+					if lo >= 0 && hi >= 0 {
+						add(uint16(hi<<8|lo), StringRef{
+							Instr:   instr.Addr,
+							Routine: instr.Arg,
+							Call:    true,
+						})
+					}
+				}
+				regs = [3]int{-1, -1, -1}
+
+			default:
+				switch instr.Op.AddrMode() {
+				case mos6510.AddrABS, mos6510.AddrABX, mos6510.AddrABY:
+					if instr.Op.Data() {
+						add(instr.Arg, StringRef{
+							Instr: instr.Addr,
+						})
+					}
+				}
+				switch instr.Op {
+				case mos6510.OpSTAabs, mos6510.OpSTAabx, mos6510.OpSTAaby,
+					mos6510.OpSTAizx, mos6510.OpSTAizy, mos6510.OpSTAzpx,
+					mos6510.OpSTXabs, mos6510.OpSTXzpy,
+					mos6510.OpSTYabs, mos6510.OpSTYzpx:
+				default:
+					regs = [3]int{-1, -1, -1}
+				}
+			}
+		}
+	}
+	return result
+}
+
+// plausibleText tests if the PETSCII codes look like natural
+// text. The evidence argument specifies how much other evidence there
+// is that the data is a string: the more evidence, the less the text
+// itself is checked. The control codes are not counted as text.
+func plausibleText(text []byte, evidence int) bool {
+	var printed []byte
+	for _, code := range text {
+		if !control(code) {
+			printed = append(printed, code)
+		}
+	}
+	text = printed
+
+	switch evidence {
+	case 0:
+		return textLike(text, minTextLen, 4)
+	case 1:
+		return textLike(text, minTermTextLen, 3)
+	case 2:
+		return len(text) >= minRefTextLen
+	default:
+		return false
+	}
+}
+
+// textLike tests if the text is long enough, consists mostly of
+// letters, digits, and spaces, and contains enough distinct
+// characters without any single character dominating the text.
+func textLike(text []byte, minLen, minDistinct int) bool {
+	if len(text) < minLen {
+		return false
+	}
+	var alnum, maxCount int
+	distinct := make(map[byte]int)
+	for _, code := range text {
+		distinct[code]++
+		maxCount = max(maxCount, distinct[code])
+		switch {
+		case code == ' ':
+			alnum++
+		case code >= '0' && code <= '9':
+			alnum++
+		case code >= 0x41 && code <= 0x5a:
+			alnum++
+		case code >= 0xc1 && code <= 0xda:
+			alnum++
+		}
+	}
+	return alnum*4 >= len(text)*3 && len(distinct) >= minDistinct &&
+		maxCount*2 <= len(text)
+}
+
+// screenLetters tests if the screen codes contain letters.
+func screenLetters(codes []byte) bool {
+	for _, code := range codes {
+		if code&0x7f >= 0x01 && code&0x7f <= 0x1a {
+			return true
+		}
+	}
+	return false
+}
+
+// printableScreen tests if the screen code is a letter, digit,
+// space, or punctuation character.
+func printableScreen(code byte) bool {
+	return code >= 0x01 && code < 0x40
+}
+
+// printable tests if the PETSCII code is a printable text character
+// in the shifted character set.
+func printable(code byte) bool {
+	switch {
+	case code >= 0x20 && code < 0x5b:
+		return true
+	case code >= 0xc1 && code <= 0xda:
+		return true
+	default:
+		return false
+	}
+}
+
+// control tests if the PETSCII code is a control code which can be
+// embedded into text printed with CHROUT.
+func control(code byte) bool {
+	if code >= 0x20 && code < 0x80 || code >= 0xa0 {
+		return false
+	}
+	_, ok := petscii.ControlCodes[code]
+	return ok
+}
+
+// lowercase tests if the PETSCII code is a lowercase letter in the
+// shifted character set.
+func lowercase(code byte) bool {
+	return code >= 0x41 && code <= 0x5a
+}
@@ -0,0 +1,192 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/markkurossi/mpc64/petscii"
+)
+
+const (
+	tokenDATA  = 0x83
+	tokenPRINT = 0x99
+
+	maxLineNumber = 63999
+)
+
+var unshifted map[rune]byte
+
+func init() {
+	unshifted = make(map[rune]byte)
+	for code, r := range petscii.Unshifted {
+		if r != 0 {
+			unshifted[r] = byte(code)
+		}
+	}
+	unshifted['π'] = tokenPi
+}
+
+// Tokenize tokenizes the BASIC V2 program source and returns a
+// linked program at BasicStart. The source lines must start with
+// line numbers in ascending order. Keywords can be written in
+// uppercase or lowercase, or abbreviated with a lowercase prefix and
+// an uppercase letter (pO for POKE), and ? stands for PRINT. PETSCII
+// control codes are written as {clr}-style escapes. The text after
+// REM is stored as is, so the token bytes that LIST expands after REM
+// do not survive a LIST and Tokenize round trip.
+func Tokenize(r io.Reader) (*Prg, error) {
+	var data []byte
+	prev := -1
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 {
+			continue
+		}
+		number, tokens, err := tokenizeLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		if number <= prev {
+			return nil, fmt.Errorf("line %d: line number %d out of order",
+				lineno, number)
+		}
+		prev = number
+
+		next := BasicStart + len(data) + 4 + len(tokens) + 1
+		if next > 0xffff {
+			return nil, fmt.Errorf("line %d: program too large", lineno)
+		}
+		data = append(data, byte(next), byte(next>>8))
+		data = append(data, byte(number), byte(number>>8))
+		data = append(data, tokens...)
+		data = append(data, 0)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	data = append(data, 0, 0)
+
+	prg := &Prg{
+		Load:     BasicStart,
+		Start:    BasicStart,
+		Data:     data,
+		SegTypes: make([]SegType, len(data)),
+	}
+	if _, _, err := prg.parseBasic(); err != nil {
+		return nil, err
+	}
+	return prg, nil
+}
+
+func tokenizeLine(text string) (int, []byte, error) {
+	var number int
+	var i int
+	for i = 0; i < len(text) && text[i] >= '0' && text[i] <= '9'; i++ {
+		number = number*10 + int(text[i]-'0')
+		if number > maxLineNumber {
+			return 0, nil, fmt.Errorf("line number too large")
+		}
+	}
+	if i == 0 {
+		return 0, nil, fmt.Errorf("line number expected")
+	}
+	text = strings.TrimLeft(text[i:], " ")
+
+	var result []byte
+	var quoted, data, rem bool
+
+	for len(text) > 0 {
+		if text[0] == '{' {
+			end := strings.IndexByte(text, '}')
+			if end < 0 {
+				return 0, nil, fmt.Errorf("unterminated escape: %s", text)
+			}
+			code, err := petscii.Unescape(text[1:end])
+			if err != nil {
+				return 0, nil, err
+			}
+			result = append(result, code)
+			text = text[end+1:]
+			continue
+		}
+		if !quoted && !data && !rem {
+			token, n := matchKeyword(text)
+			if n > 0 {
+				result = append(result, token)
+				text = text[n:]
+				switch token {
+				case tokenDATA:
+					data = true
+				case tokenREM:
+					rem = true
+				}
+				continue
+			}
+		}
+		r, n := utf8.DecodeRuneInString(text)
+		text = text[n:]
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ':':
+			if !quoted {
+				data = false
+			}
+		}
+		if r >= 'a' && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		code, ok := unshifted[r]
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid character '%c'", r)
+		}
+		result = append(result, code)
+	}
+	if len(result) > 250 {
+		return 0, nil, fmt.Errorf("line too long")
+	}
+	return number, result, nil
+}
+
+// matchKeyword matches the keyword at the beginning of text. It
+// returns the keyword token and the number of bytes matched, or 0 if
+// the text does not start with a keyword. Like the BASIC interpreter,
+// the function returns the first matching keyword in token order.
+func matchKeyword(text string) (byte, int) {
+	if text[0] == '?' {
+		return tokenPRINT, 1
+	}
+	for idx, kw := range Tokens {
+		if strings.HasPrefix(text, kw) ||
+			strings.HasPrefix(text, strings.ToLower(kw)) {
+			return byte(0x80 + idx), len(kw)
+		}
+	}
+
+	// Abbreviations: lowercase prefix followed by an uppercase
+	// letter.
+	var i int
+	for i = 0; i < len(text) && text[i] >= 'a' && text[i] <= 'z'; i++ {
+	}
+	if i == 0 || i >= len(text) || text[i] < 'A' || text[i] > 'Z' {
+		return 0, 0
+	}
+	prefix := strings.ToUpper(text[:i+1])
+	for idx, kw := range Tokens {
+		if len(kw) > len(prefix) && strings.HasPrefix(kw, prefix) {
+			return byte(0x80 + idx), i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,162 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DefaultUnpackCycles specifies the default cycle limit of the
+// unpacking.
+const DefaultUnpackCycles = 100000000
+
+// unpackMinAddr specifies the lowest address of the unpacked program
+// entry point. Decrunchers commonly relocate themselves into the zero
+// page, stack, and system area below it.
+const unpackMinAddr = 0x0400
+
+// UnpackOptions define options for unpacking programs.
+type UnpackOptions struct {
+	// Entry specifies the entry point of the unpacked program. If
+	// zero, the entry point is the first address written by the
+	// program to which the program transfers control, excluding the
+	// zero page, stack, and system area below $0400, and the
+	// relocated copies of the program's own code.
+	Entry uint16
+
+	// MaxCycles limits the number of emulated cycles. If zero,
+	// DefaultUnpackCycles is used.
+	MaxCycles uint64
+
+	// Parse specifies the options for parsing the unpacked program.
+	// If the options do not specify entry points, the unpacked
+	// program is parsed from its entry point.
+	Parse ParseOptions
+}
+
+// Unpack unpacks the crunched program by emulating it until the
+// control transfers into memory the program has written. A written
+// block that is a verbatim copy of the loaded program is a relocated
+// decruncher and the emulation continues until the control leaves
+// it. If the program jumps into the BASIC or KERNAL ROM after writing
+// memory, for example to RUN an unpacked BASIC program, the unpacking
+// is complete and the entry point comes from the SYS statement of the
+// unpacked BASIC program.
+//
+// The function returns the unpacked program. Its load range spans
+// all blocks of written memory, excluding the zero page, stack, and
+// system area below $0400, the screen memory, the I/O area, and the
+// relocated decruncher. The gaps between the blocks hold the memory contents
+// at the end of the unpacking. If the unpacked program starts at
+// BasicStart and the program has set the start of the BASIC
+// variables at $2D-$2E, the load range ends there. The start address
+// of the unpacked program is the entry point.
+func (prg *Prg) Unpack(opts UnpackOptions) (*Prg, error) {
+	emu, err := prg.newEmulator(0)
+	if err != nil {
+		return nil, err
+	}
+	maxCycles := opts.MaxCycles
+	if maxCycles == 0 {
+		maxCycles = DefaultUnpackCycles
+	}
+	mem := emu.mem
+
+	var entry uint16
+	var found, rom bool
+	var copyFrom, copyTo int
+	for !found && emu.cpu.Cycles < maxCycles {
+		pc := emu.cpu.PC
+		stop, op, err := emu.step()
+		if err != nil {
+			return nil, err
+		}
+		if len(stop) > 0 {
+			rom = stop == StopExit && emu.cpu.PC != emuExit &&
+				opts.Entry == 0
+			if rom {
+				_, _, ok := prg.unpackedRange(mem, 0, copyFrom, copyTo)
+				if ok {
+					break
+				}
+			}
+			return nil, fmt.Errorf("%04X: program stopped (%s) before unpacking",
+				emu.cpu.PC, stop)
+		}
+		next := emu.cpu.PC
+		if opts.Entry != 0 {
+			found = next == opts.Entry
+		} else {
+			// Control transfer into written memory.
+			found = next != pc+uint16(op.Size()) &&
+				next >= unpackMinAddr && mem.written[next] &&
+				(int(next) < copyFrom || int(next) >= copyTo)
+			if found {
+				from, to := mem.writtenBlock(next)
+				if bytes.Contains(prg.Data, mem.RAM[from:to]) {
+					copyFrom, copyTo = from, to
+					found = false
+				}
+			}
+		}
+		entry = next
+	}
+	if !found && !rom {
+		return nil, fmt.Errorf("no unpacked code found in %d cycles",
+			maxCycles)
+	}
+
+	if rom {
+		entry = 0
+	}
+	from, to, ok := prg.unpackedRange(mem, entry, copyFrom, copyTo)
+	if !ok || (!rom && (int(entry) < from || int(entry) >= to)) {
+		return nil, fmt.Errorf("%04X: empty unpacked program", entry)
+	}
+
+	data := make([]byte, 2, 2+to-from)
+	bo.PutUint16(data, uint16(from))
+	data = append(data, mem.RAM[from:to]...)
+
+	popts := opts.Parse
+	if len(popts.Entries) == 0 && !rom {
+		popts.Entries = []uint16{entry}
+	}
+	return ParseWith(data, popts)
+}
+
+// unpackedRange returns the load range [from, to) of the unpacked
+// program. The screen memory below BasicStart is excluded unless it
+// contains the entry point. The function returns false if the
+// program has not written any memory outside the excluded areas.
+func (prg *Prg) unpackedRange(mem *c64Memory, entry uint16,
+	copyFrom, copyTo int) (int, int, bool) {
+
+	from, to := -1, -1
+	for addr := unpackMinAddr; addr < len(mem.written); addr++ {
+		if !mem.written[addr] || (addr >= 0xd000 && addr < 0xe000) ||
+			(addr >= copyFrom && addr < copyTo) ||
+			(addr < BasicStart && (entry < unpackMinAddr || entry >= BasicStart)) {
+			continue
+		}
+		if from < 0 {
+			from = addr
+		}
+		to = addr + 1
+	}
+	if from < 0 {
+		return 0, 0, false
+	}
+	if from == BasicStart && mem.written[0x2d] && mem.written[0x2e] {
+		vartab := int(bo.Uint16(mem.RAM[0x2d:]))
+		if vartab > from {
+			to = vartab
+		}
+	}
+	return from, to, true
+}
@@ -0,0 +1,288 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/markkurossi/mpc64/mos6510"
+	"github.com/markkurossi/tabulate"
+)
+
+// RefKind specifies how an instruction references an address.
+type RefKind byte
+
+// Reference kinds.
+const (
+	RefRead RefKind = iota
+	RefWrite
+	RefModify
+	RefPointer
+	RefJump
+	RefCall
+)
+
+var refKinds = map[RefKind]string{
+	RefRead:    "read",
+	RefWrite:   "write",
+	RefModify:  "modify",
+	RefPointer: "pointer",
+	RefJump:    "jump",
+	RefCall:    "call",
+}
+
+func (k RefKind) String() string {
+	name, ok := refKinds[k]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{RefKind %d}", k)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k RefKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (k *RefKind) UnmarshalText(text []byte) error {
+	for kind, name := range refKinds {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown reference kind: %s", text)
+}
+
+// Ref defines a reference from the instruction Instr to the address
+// Addr. For indexed addressing modes, Addr is the base address and
+// Index is the index register 'X' or 'Y'; otherwise Index is 0. The
+// pointer references are to the zero-page pointers and jump vectors
+// of the indirect addressing modes.
+type Ref struct {
+	Addr  uint16
+	Instr Instr
+	Kind  RefKind
+	Index byte
+}
+
+// Mode returns the addressing mode of the reference.
+func (ref Ref) Mode() mos6510.AddrMode {
+	return ref.Instr.Op.AddrMode()
+}
+
+// Region returns the name of the C64 memory region of the address.
+func Region(addr uint16) string {
+	switch {
+	case addr < 0x0100:
+		return "zp"
+	case addr < 0x0200:
+		return "stack"
+	case addr >= 0xa000 && addr < 0xc000:
+		return "basic"
+	case addr >= 0xd000 && addr < 0xe000:
+		return "io"
+	case addr >= 0xe000:
+		return "kernal"
+	default:
+		return "ram"
+	}
+}
+
+// XRef defines the cross-reference index of the program's memory
+// reads, writes, jumps, and calls.
+type XRef struct {
+	Refs []Ref
+	refs map[uint16][]Ref
+}
+
+// To returns the references to the address.
+func (xref *XRef) To(addr uint16) []Ref {
+	return xref.refs[addr]
+}
+
+// Addrs returns the referenced addresses in ascending order.
+func (xref *XRef) Addrs() []uint16 {
+	var result []uint16
+	for addr := range xref.refs {
+		result = append(result, addr)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// XRef creates the cross-reference index from the decoded
+// instructions. The index is cached like the CFG.
+func (prg *Prg) XRef() (*XRef, error) {
+	if prg.xref != nil {
+		return prg.xref, nil
+	}
+	cfg, err := prg.CFG()
+	if err != nil {
+		return nil, err
+	}
+	xref := &XRef{
+		refs: make(map[uint16][]Ref),
+	}
+	for _, bb := range cfg.Blocks {
+		for _, instr := range bb.Instrs {
+			xref.add(prg, instr)
+		}
+	}
+	sort.Slice(xref.Refs, func(i, j int) bool {
+		if xref.Refs[i].Addr != xref.Refs[j].Addr {
+			return xref.Refs[i].Addr < xref.Refs[j].Addr
+		}
+		if xref.Refs[i].Instr.Addr != xref.Refs[j].Instr.Addr {
+			return xref.Refs[i].Instr.Addr < xref.Refs[j].Instr.Addr
+		}
+		return xref.Refs[i].Kind < xref.Refs[j].Kind
+	})
+	for _, ref := range xref.Refs {
+		xref.refs[ref.Addr] = append(xref.refs[ref.Addr], ref)
+	}
+	prg.xref = xref
+
+	return xref, nil
+}
+
+func (xref *XRef) add(prg *Prg, instr Instr) {
+	op := instr.Op
+	add := func(addr uint16, kind RefKind, index byte) {
+		xref.Refs = append(xref.Refs, Ref{
+			Addr:  addr,
+			Instr: instr,
+			Kind:  kind,
+			Index: index,
+		})
+	}
+
+	if target, ok := instr.Target(); ok {
+		if instr.Call() {
+			add(target, RefCall, 0)
+		} else {
+			add(target, RefJump, 0)
+		}
+		return
+	}
+
+	var index byte
+	switch op.AddrMode() {
+	case mos6510.AddrImp, mos6510.AddrIMM, mos6510.AddrREL:
+		return
+
+	case mos6510.AddrIND:
+		add(instr.Arg, RefPointer, 0)
+		for _, target := range prg.Indirect[instr.Addr] {
+			add(target, RefJump, 0)
+		}
+		return
+
+	case mos6510.AddrIZX, mos6510.AddrIZY:
+		if op.AddrMode() == mos6510.AddrIZX {
+			index = 'X'
+		} else {
+			index = 'Y'
+		}
+		add(instr.Arg, RefPointer, index)
+		add((instr.Arg+1)&0xff, RefPointer, index)
+		return
+
+	case mos6510.AddrABX, mos6510.AddrZPX:
+		index = 'X'
+	case mos6510.AddrABY, mos6510.AddrZPY:
+		index = 'Y'
+	}
+	switch {
+	case op.Read() && op.Write():
+		add(instr.Arg, RefModify, index)
+	case op.Write():
+		add(instr.Arg, RefWrite, index)
+	case op.Read():
+		add(instr.Arg, RefRead, index)
+	}
+}
+
+// Print prints the cross-reference index as a table.
+func (xref *XRef) Print(w io.Writer) error {
+	tab := tabulate.New(tabulate.Simple)
+	tab.Header("Addr")
+	tab.Header("Region")
+	tab.Header("Kind")
+	tab.Header("From").SetAlign(tabulate.ML)
+	tab.Header("Mode")
+	tab.Header("Index")
+	tab.Header("Instr").SetAlign(tabulate.ML)
+
+	for _, ref := range xref.Refs {
+		row := tab.Row()
+		row.Column(fmt.Sprintf("$%04X", ref.Addr))
+		row.Column(Region(ref.Addr))
+		row.Column(ref.Kind.String())
+		row.Column(fmt.Sprintf("$%04X", ref.Instr.Addr))
+		row.Column(ref.Mode().String())
+		if ref.Index != 0 {
+			row.Column(string(ref.Index))
+		} else {
+			row.Column("")
+		}
+		row.Column(ref.Instr.String())
+	}
+	var buf bytes.Buffer
+	tab.Print(&buf)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// JSON writes the cross-reference index in JSON. The references are
+// grouped by the referenced addresses.
+func (xref *XRef) JSON(w io.Writer) error {
+	type jsonRef struct {
+		From  uint16 `json:"from"`
+		Kind  string `json:"kind"`
+		Mode  string `json:"mode"`
+		Index string `json:"index,omitempty"`
+		Instr string `json:"instr"`
+	}
+	type jsonAddr struct {
+		Addr   uint16    `json:"addr"`
+		Region string    `json:"region"`
+		Refs   []jsonRef `json:"refs"`
+	}
+
+	result := []jsonAddr{}
+	for _, addr := range xref.Addrs() {
+		item := jsonAddr{
+			Addr:   addr,
+			Region: Region(addr),
+		}
+		for _, ref := range xref.refs[addr] {
+			var index string
+			if ref.Index != 0 {
+				index = string(ref.Index)
+			}
+			item.Refs = append(item.Refs, jsonRef{
+				From:  ref.Instr.Addr,
+				Kind:  ref.Kind.String(),
+				Mode:  ref.Mode().String(),
+				Index: index,
+				Instr: ref.Instr.String(),
+			})
+		}
+		result = append(result, item)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
@@ -0,0 +1,367 @@
+//
+// Copyright (c) 2024 Markku Rossi
+//
+// All rights reserved.
+//
+
+package prg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/markkurossi/mpc64/mos6510"
+	"github.com/markkurossi/tabulate"
+)
+
+// ZPOwner specifies the owner of a zero-page location.
+type ZPOwner byte
+
+// Zero-page owners.
+const (
+	ZPFree ZPOwner = iota
+	ZPCPU
+	ZPBasic
+	ZPKernal
+)
+
+var zpOwners = map[ZPOwner]string{
+	ZPFree:   "free",
+	ZPCPU:    "cpu",
+	ZPBasic:  "basic",
+	ZPKernal: "kernal",
+}
+
+func (o ZPOwner) String() string {
+	name, ok := zpOwners[o]
+	if ok {
+		return name
+	}
+	return fmt.Sprintf("{ZPOwner %d}", o)
+}
+
+// ZPOwnerOf returns the owner of the zero-page location. The
+// locations $02 and $FB-$FE are free for programs, $00-$01 are the CPU
+// I/O port, and the rest are used by BASIC ($03-$8F, $FF) and KERNAL
+// ($90-$FA).
+func ZPOwnerOf(addr byte) ZPOwner {
+	switch {
+	case addr <= 0x01:
+		return ZPCPU
+	case addr == 0x02:
+		return ZPFree
+	case addr <= 0x8f:
+		return ZPBasic
+	case addr <= 0xfa:
+		return ZPKernal
+	case addr <= 0xfe:
+		return ZPFree
+	default:
+		return ZPBasic
+	}
+}
+
+// zpNames define the names of the commonly used system zero-page
+// locations.
+var zpNames = map[byte]string{
+	0x00: "D6510",
+	0x01: "R6510",
+	0x14: "LINNUM",
+	0x22: "INDEX",
+	0x2b: "TXTTAB",
+	0x2d: "VARTAB",
+	0x2f: "ARYTAB",
+	0x31: "STREND",
+	0x33: "FRETOP",
+	0x37: "MEMSIZ",
+	0x39: "CURLIN",
+	0x61: "FAC1",
+	0x69: "FAC2",
+	0x73: "CHRGET",
+	0x7a: "TXTPTR",
+	0x90: "STATUS",
+	0x91: "STKEY",
+	0x93: "VERCK",
+	0x98: "LDTND",
+	0x99: "DFLTN",
+	0x9a: "DFLTO",
+	0xa0: "TIME",
+	0xac: "SAL",
+	0xae: "EAL",
+	0xb7: "FNLEN",
+	0xb8: "LA",
+	0xb9: "SA",
+	0xba: "FA",
+	0xbb: "FNADR",
+	0xc1: "STAL",
+	0xc3: "MEMUSS",
+	0xc5: "LSTX",
+	0xc6: "NDX",
+	0xc7: "RVS",
+	0xcb: "SFDX",
+	0xcc: "BLNSW",
+	0xd1: "PNT",
+	0xd3: "PNTR",
+	0xd4: "QTSW",
+	0xd5: "LNMX",
+	0xd6: "TBLX",
+	0xd8: "INSRT",
+	0xf3: "USER",
+	0xf5: "KEYTAB",
+}
+
+// ZPUsage defines how the program uses a zero-page location.
+type ZPUsage struct {
+	Addr    byte
+	Owner   ZPOwner
+	Name    string
+	Read    bool
+	Write   bool
+	Pointer bool
+	Refs    []Ref
+}
+
+// Conflict tests if the program writes into a location owned by
+// BASIC or KERNAL.
+func (u ZPUsage) Conflict() bool {
+	return u.Write && (u.Owner == ZPBasic || u.Owner == ZPKernal)
+}
+
+// ZeroPage defines the program's zero-page usage map. Used lists the
+// locations the program uses in ascending order. Free lists the
+// unused locations free for programs and BasicFree lists the unused
+// BASIC locations, which are free if the program does not return to
+// BASIC. Unknown lists the locations that the indexed accesses with
+// unknown index ranges may use; they are not listed as free.
+type ZeroPage struct {
+	Used      []ZPUsage
+	Free      []byte
+	BasicFree []byte
+	Unknown   []byte
+}
+
+// Conflicts returns the used locations conflicting with BASIC or
+// KERNAL.
+func (zp *ZeroPage) Conflicts() []ZPUsage {
+	var result []ZPUsage
+	for _, u := range zp.Used {
+		if u.Conflict() {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// ZeroPage creates the program's zero-page usage map from the
+// cross-reference index. The zero-page indexed accesses use the
+// locations over the index register range, which is known for the
+// loop counters and the index registers loaded with immediate values.
+// If the range is not known, the locations from the base address up
+// to $FF are of unknown use.
+func (prg *Prg) ZeroPage() (*ZeroPage, error) {
+	cfg, err := prg.CFG()
+	if err != nil {
+		return nil, err
+	}
+	xref, err := prg.XRef()
+	if err != nil {
+		return nil, err
+	}
+	ranges := make(map[uint16][]byte)
+	for _, bb := range cfg.Blocks {
+		bb.walkBounds(func(instr Instr, bounds indexBounds) {
+			if addrs, ok := zpIndexed(instr, bounds); ok {
+				ranges[instr.Addr] = addrs
+			}
+		})
+	}
+
+	var usage [256]*ZPUsage
+	var unknown [256]bool
+	use := func(addr byte, ref Ref) {
+		u := usage[addr]
+		if u == nil {
+			u = &ZPUsage{
+				Addr:  addr,
+				Owner: ZPOwnerOf(addr),
+				Name:  zpNames[addr],
+			}
+			usage[addr] = u
+		}
+		switch ref.Kind {
+		case RefRead:
+			u.Read = true
+		case RefWrite:
+			u.Write = true
+		case RefModify:
+			u.Read = true
+			u.Write = true
+		case RefPointer:
+			u.Pointer = true
+		}
+		u.Refs = append(u.Refs, ref)
+	}
+	for _, ref := range xref.Refs {
+		if ref.Addr > 0xff {
+			continue
+		}
+		use(byte(ref.Addr), ref)
+
+		switch ref.Mode() {
+		case mos6510.AddrZPX, mos6510.AddrZPY, mos6510.AddrIZX:
+		default:
+			continue
+		}
+		addrs, ok := ranges[ref.Instr.Addr]
+		if !ok {
+			for i := ref.Addr + 1; i <= 0xff; i++ {
+				unknown[i] = true
+			}
+			continue
+		}
+		// The pointer references are to both pointer bytes.
+		ofs := byte(ref.Addr - ref.Instr.Arg)
+		for _, addr := range addrs {
+			if addr+ofs != byte(ref.Addr) {
+				use(addr+ofs, ref)
+			}
+		}
+	}
+
+	zp := new(ZeroPage)
+	for i, u := range usage {
+		if u != nil {
+			u.Refs = sortRefs(u.Refs)
+			zp.Used = append(zp.Used, *u)
+			continue
+		}
+		if unknown[i] {
+			zp.Unknown = append(zp.Unknown, byte(i))
+			continue
+		}
+		switch ZPOwnerOf(byte(i)) {
+		case ZPFree:
+			zp.Free = append(zp.Free, byte(i))
+		case ZPBasic:
+			zp.BasicFree = append(zp.BasicFree, byte(i))
+		}
+	}
+	return zp, nil
+}
+
+// zpIndexed returns the zero-page locations that the zero-page
+// indexed instruction accesses with the index register ranges. The
+// function returns false if the instruction is not zero-page indexed
+// or if its index register range is not known.
+func zpIndexed(instr Instr, bounds indexBounds) ([]byte, bool) {
+	reg := byte('X')
+	switch instr.Op.AddrMode() {
+	case mos6510.AddrZPX, mos6510.AddrIZX:
+	case mos6510.AddrZPY:
+		reg = 'Y'
+	default:
+		return nil, false
+	}
+	b, ok := bounds[reg]
+	if !ok {
+		return nil, false
+	}
+	var result []byte
+	for i := b[0]; i <= b[1]; i++ {
+		result = append(result, byte(int(instr.Arg)+i))
+	}
+	return result, true
+}
+
+// sortRefs sorts the references by the instruction address and
+// removes the duplicate references of an instruction reaching the
+// same location through both pointer bytes.
+func sortRefs(refs []Ref) []Ref {
+	sort.SliceStable(refs, func(i, j int) bool {
+		return refs[i].Instr.Addr < refs[j].Instr.Addr
+	})
+	var result []Ref
+	for _, ref := range refs {
+		n := len(result)
+		if n > 0 && result[n-1].Instr.Addr == ref.Instr.Addr &&
+			result[n-1].Kind == ref.Kind {
+			continue
+		}
+		result = append(result, ref)
+	}
+	return result
+}
+
+// Print prints the zero-page usage map.
+func (zp *ZeroPage) Print(w io.Writer) error {
+	tab := tabulate.New(tabulate.Simple)
+	tab.Header("Addr")
+	tab.Header("Owner")
+	tab.Header("Name").SetAlign(tabulate.ML)
+	tab.Header("Use").SetAlign(tabulate.ML)
+	tab.Header("Refs").SetAlign(tabulate.ML)
+	tab.Header("Conflict")
+
+	for _, u := range zp.Used {
+		row := tab.Row()
+		row.Column(fmt.Sprintf("$%02X", u.Addr))
+		row.Column(u.Owner.String())
+		row.Column(u.Name)
+
+		var use []string
+		if u.Read {
+			use = append(use, "read")
+		}
+		if u.Write {
+			use = append(use, "write")
+		}
+		if u.Pointer {
+			use = append(use, "pointer")
+		}
+		row.Column(strings.Join(use, ","))
+
+		var refs []string
+		for _, ref := range u.Refs {
+			refs = append(refs, fmt.Sprintf("$%04X", ref.Instr.Addr))
+		}
+		row.Column(strings.Join(refs, " "))
+		if u.Conflict() {
+			row.Column("yes")
+		} else {
+			row.Column("")
+		}
+	}
+	var buf bytes.Buffer
+	tab.Print(&buf)
+
+	fmt.Fprintf(&buf, "Free:%s\n", zpList(zp.Free))
+	fmt.Fprintf(&buf, "Free without BASIC:%s\n", zpList(zp.BasicFree))
+	if len(zp.Unknown) > 0 {
+		fmt.Fprintf(&buf, "Unknown:%s\n", zpList(zp.Unknown))
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// zpList formats the zero-page locations as a list of address
+// ranges.
+func zpList(addrs []byte) string {
+	var result string
+	for i := 0; i < len(addrs); {
+		j := i + 1
+		for j < len(addrs) && addrs[j] == addrs[j-1]+1 {
+			j++
+		}
+		if j-i == 1 {
+			result += fmt.Sprintf(" $%02X", addrs[i])
+		} else {
+			result += fmt.Sprintf(" $%02X-$%02X", addrs[i], addrs[j-1])
+		}
+		i = j
+	}
+	return result
+}